@@ -0,0 +1,257 @@
+// Package audit records every 3DS message exchanged to an append-only, hash-chained log file,
+// so that the history of a transaction can be proven in disputes and chargebacks.
+//
+// Each line of the file is a JSON Entry. The hash of each entry is an HMAC-SHA256, keyed with a
+// secret audit key, of the entry itself and the hash of the previous entry, so removing,
+// reordering or editing any entry breaks the chain. Because the hashes are keyed, someone who can
+// write to the log but does not hold the key cannot rewrite the chain to hide a change; the key
+// must therefore be kept apart from the log.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+// Message types recorded in the audit log.
+const (
+	MessageVersionRequest       = "VersionRequest"
+	MessageVersionResponse      = "VersionResponse"
+	MessageAuthenticateRequest  = "AuthenticateRequest"
+	MessageAuthenticateResponse = "AuthenticateResponse"
+	MessageResultRequest        = "ResultRequest"
+	MessageResultResponse       = "ResultResponse"
+	MessageChallengeResponse    = "CRes"
+	MessageMethodNotification   = "MethodNotification"
+	MessageResultsRequest       = "RReq"
+	// MessageFailure records a request to Ravelin's 3DS API which received no usable response.
+	MessageFailure = "Failure"
+)
+
+// genesisHash is the previous hash of the first entry in a log.
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+var (
+	ErrChainBroken = errors.New("audit log hash chain is broken")
+	ErrKeyRequired = errors.New("audit key is required")
+)
+
+// Entry is a single message recorded in the audit log.
+type Entry struct {
+	Sequence             int64           `json:"seq"`
+	Time                 time.Time       `json:"time"`
+	ThreeDSServerTransID string          `json:"threeDSServerTransID"`
+	MessageType          string          `json:"messageType"`
+	Payload              json.RawMessage `json:"payload"`
+	PreviousHash         string          `json:"prevHash"`
+	Hash                 string          `json:"hash"`
+}
+
+// computeHash returns the HMAC of the entry under key, which covers every field other than Hash.
+func (e Entry) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+	bb, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(e.PreviousHash))
+	mac.Write(bb)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Log appends entries to an audit log file. A nil *Log records nothing.
+type Log struct {
+	mu       *sync.Mutex
+	file     *os.File
+	key      []byte
+	sequence int64
+	lastHash string
+	now      func() time.Time
+}
+
+// Open opens the audit log at path for appending, creating it if necessary. The existing
+// entries are verified with key so that new entries continue a valid chain.
+func Open(path string, key []byte) (*Log, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyRequired
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %v", path, err)
+	}
+
+	l := &Log{
+		mu:       &sync.Mutex{},
+		file:     file,
+		key:      key,
+		lastHash: genesisHash,
+		now:      time.Now,
+	}
+
+	err = readEntries(file, key, func(e Entry) error {
+		l.sequence = e.Sequence
+		l.lastHash = e.Hash
+		return nil
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to verify audit log %s: %v", path, err)
+	}
+
+	return l, nil
+}
+
+// Record appends a message to the log. Card numbers, expiry dates and authentication values
+// in the payload are masked before it is written.
+func (l *Log) Record(threeDSServerTransID, messageType string, payload interface{}) error {
+	if l == nil {
+		return nil
+	}
+
+	maskedPayload, err := json.Marshal(logging.Mask("payload", payload))
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit payload: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := Entry{
+		Sequence:             l.sequence + 1,
+		Time:                 l.now().UTC(),
+		ThreeDSServerTransID: threeDSServerTransID,
+		MessageType:          messageType,
+		Payload:              maskedPayload,
+		PreviousHash:         l.lastHash,
+	}
+
+	entry.Hash, err = entry.computeHash(l.key)
+	if err != nil {
+		return fmt.Errorf("failed to hash audit entry: %v", err)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync audit log: %v", err)
+	}
+
+	l.sequence = entry.Sequence
+	l.lastHash = entry.Hash
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Verify checks the hash chain of the audit log read from r against key, and returns the number
+// of entries.
+func Verify(r io.Reader, key []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyRequired
+	}
+
+	count := 0
+	err := readEntries(r, key, func(Entry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Export verifies the audit log read from r against key, and writes every entry for the
+// transaction to w as a JSON array. The entries include their hashes, so they can be checked
+// against the full log.
+func Export(r io.Reader, key []byte, threeDSServerTransID string, w io.Writer) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+
+	entries := []Entry{}
+	err := readEntries(r, key, func(e Entry) error {
+		if e.ThreeDSServerTransID == threeDSServerTransID {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// readEntries reads and verifies every entry from r with key, calling fn for each one in order.
+func readEntries(r io.Reader, key []byte, fn func(Entry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	previousHash := genesisHash
+	var sequence int64
+	for scanner.Scan() {
+		entry := Entry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("%w: entry %d is not valid JSON: %v", ErrChainBroken, sequence+1, err)
+		}
+
+		if entry.Sequence != sequence+1 {
+			return fmt.Errorf("%w: expected entry %d, found entry %d", ErrChainBroken, sequence+1, entry.Sequence)
+		}
+
+		if entry.PreviousHash != previousHash {
+			return fmt.Errorf("%w: entry %d does not follow the previous entry", ErrChainBroken, entry.Sequence)
+		}
+
+		hash, err := entry.computeHash(key)
+		if err != nil {
+			return err
+		}
+		if entry.Hash != hash {
+			return fmt.Errorf("%w: entry %d has been modified", ErrChainBroken, entry.Sequence)
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+
+		previousHash = entry.Hash
+		sequence = entry.Sequence
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("test-audit-key")
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := Open(path, testKey)
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+
+	records := []struct {
+		threeDSServerTransID string
+		messageType          string
+		payload              interface{}
+	}{
+		{"tx-1", MessageVersionRequest, map[string]string{"pan": "4000000000001000", "transactionId": "order-1"}},
+		{"tx-2", MessageVersionRequest, map[string]string{"pan": "5200000000001005"}},
+		{"tx-1", MessageResultResponse, map[string]interface{}{"data": map[string]string{"authenticationValue": "AAABBB=", "transStatus": "Y"}}},
+	}
+	for _, r := range records[:2] {
+		if err := l.Record(r.threeDSServerTransID, r.messageType, r.payload); err != nil {
+			t.Fatalf("expected nil error, actual: %v", err)
+		}
+	}
+	_ = l.Close()
+
+	// reopening continues the existing chain
+	l, err = Open(path, testKey)
+	if err != nil {
+		t.Fatalf("expected nil error reopening log, actual: %v", err)
+	}
+	if err := l.Record(records[2].threeDSServerTransID, records[2].messageType, records[2].payload); err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+	_ = l.Close()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+	for _, leaked := range []string{"4000000000001000", "5200000000001005", "AAABBB="} {
+		if strings.Contains(string(contents), leaked) {
+			t.Errorf("expected %q to be masked in audit log", leaked)
+		}
+	}
+
+	count, err := Verify(bytes.NewReader(contents), testKey)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 verified entries, actual: %d, %v", count, err)
+	}
+
+	exported := &bytes.Buffer{}
+	if err := Export(bytes.NewReader(contents), testKey, "tx-1", exported); err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+	entries := []Entry{}
+	if err := json.Unmarshal(exported.Bytes(), &entries); err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+	if len(entries) != 2 || entries[0].MessageType != MessageVersionRequest || entries[1].MessageType != MessageResultResponse {
+		t.Fatalf("unexpected exported entries: %+v", entries)
+	}
+}
+
+func TestVerify_tampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path, testKey)
+	for _, id := range []string{"tx-1", "tx-2", "tx-3"} {
+		_ = l.Record(id, MessageChallengeResponse, map[string]string{"transStatus": "N"})
+	}
+	_ = l.Close()
+
+	contents, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(strings.TrimSuffix(string(contents), "\n"), "\n")
+
+	tests := map[string]string{
+		"edited":    strings.Replace(string(contents), `"transStatus":"N"`, `"transStatus":"Y"`, 1),
+		"removed":   lines[0] + lines[2],
+		"reordered": lines[1] + lines[0] + lines[2],
+		"truncated": lines[1] + lines[2],
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Verify(strings.NewReader(tampered), testKey); !errors.Is(err, ErrChainBroken) {
+				t.Fatalf("expected %v, actual: %v", ErrChainBroken, err)
+			}
+		})
+	}
+
+	if err := os.WriteFile(path, []byte(tests["edited"]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, testKey); err == nil {
+		t.Fatal("expected opening a tampered log to fail")
+	}
+}
+
+func TestVerify_wrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, _ := Open(path, testKey)
+	_ = l.Record("tx-1", MessageChallengeResponse, map[string]string{"transStatus": "N"})
+	_ = l.Close()
+
+	// a chain recomputed by someone without the key does not verify
+	contents, _ := os.ReadFile(path)
+	if _, err := Verify(bytes.NewReader(contents), []byte("other-key")); !errors.Is(err, ErrChainBroken) {
+		t.Errorf("expected: %v, actual: %v", ErrChainBroken, err)
+	}
+	if _, err := Verify(bytes.NewReader(contents), nil); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("expected: %v, actual: %v", ErrKeyRequired, err)
+	}
+	if _, err := Open(path, nil); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("expected: %v, actual: %v", ErrKeyRequired, err)
+	}
+}
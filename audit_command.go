@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/unravelin/ravelin-3ds-demo/audit"
+)
+
+const auditUsage = `Usage:
+  ravelin-3ds-demo audit verify -file <audit-log> [-key <audit-key>]
+  ravelin-3ds-demo audit export -file <audit-log> -id <threeDSServerTransID> [-key <audit-key>]
+
+The audit key can also be set as $AUDIT_KEY.
+`
+
+// runAuditCommand verifies the audit log hash chain, or exports the history of a transaction
+// as evidence. It returns the process exit code.
+func runAuditCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("audit "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "Path to the audit log")
+	threeDSServerTransID := flags.String("id", "", "threeDSServerTransID of the transaction to export")
+	key := flags.String("key", "", "Key the audit log hash chain was written with - Can also be set as $AUDIT_KEY")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *key == "" {
+		*key = os.Getenv("AUDIT_KEY")
+	}
+
+	if *file == "" || *key == "" {
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	switch args[0] {
+	case "verify":
+		count, err := audit.Verify(f, []byte(*key))
+		if err != nil {
+			fmt.Fprintf(stderr, "audit log verification failed: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "audit log verified: %d entries\n", count)
+	case "export":
+		if *threeDSServerTransID == "" {
+			fmt.Fprint(stderr, auditUsage)
+			return 2
+		}
+		err := audit.Export(f, []byte(*key), *threeDSServerTransID, stdout)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to export audit log: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/tlscert"
+)
+
+const certUsage = `Usage:
+  ravelin-3ds-demo cert [-host localhost,127.0.0.1] [-cert cert.pem] [-key key.pem] [-valid-for 720h]
+`
+
+// runCertCommand generates a self-signed certificate for serving TLS during local development.
+// It returns the process exit code.
+func runCertCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cert", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	hosts := flags.String("host", "localhost,127.0.0.1", "Comma separated host names and IP addresses the certificate is valid for")
+	certFile := flags.String("cert", "cert.pem", "Path the certificate is written to")
+	keyFile := flags.String("key", "key.pem", "Path the private key is written to")
+	validFor := flags.Duration("valid-for", 30*24*time.Hour, "How long the certificate is valid for")
+	if err := flags.Parse(args); err != nil {
+		fmt.Fprint(stderr, certUsage)
+		return 2
+	}
+
+	certPEM, keyPEM, err := tlscert.GenerateSelfSigned(splitList(*hosts), *validFor)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to generate certificate: %v\n", err)
+		return 1
+	}
+
+	if err := os.WriteFile(*certFile, certPEM, 0644); err != nil {
+		fmt.Fprintf(stderr, "failed to write certificate: %v\n", err)
+		return 1
+	}
+
+	if err := os.WriteFile(*keyFile, keyPEM, 0600); err != nil {
+		fmt.Fprintf(stderr, "failed to write private key: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "wrote self-signed certificate for %s to %s and %s\n", *hosts, *certFile, *keyFile)
+	return 0
+}
@@ -0,0 +1,407 @@
+// Package customer keeps a lightweight history of each customer, so the 3DS authenticate request
+// can send Ravelin a stable customer ID, and tell the issuer how long the customer has had an
+// account, when their details last changed and how often they shop. Issuers use this account
+// information to authenticate returning customers without a challenge.
+//
+// Customers are identified by a long lived cookie in their browser, which holds their customer ID
+// signed with HMAC-SHA256, so a customer cannot claim another customer's history. A customer is
+// only remembered once they give an email address, and is forgotten a year after their last visit.
+package customer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/atomicfile"
+	"github.com/unravelin/ravelin-3ds-demo/internal/keyderiv"
+)
+
+const (
+	// historyWindow is how long customers, and their transactions, shipping addresses, cards and
+	// authentications, are remembered for after they were last seen. 3DS only asks about the last year.
+	historyWindow = 365 * 24 * time.Hour
+	// pruneInterval is how often customers who have not been seen for the history window are forgotten.
+	pruneInterval = 24 * time.Hour
+)
+
+// Customer is the history of a customer. The email address, name and addresses are keyed digests
+// made by Store.Digest, and cards are the card vault's fingerprints, so the store never holds the
+// customer's details or a PAN.
+type Customer struct {
+	ID string
+	// CreatedAt is when the customer's account was created, which is the first time they gave an
+	// email address.
+	CreatedAt time.Time
+	// ChangedAt is when the email address, name or billing address were last changed.
+	ChangedAt      time.Time
+	Email          string
+	Name           string
+	BillingAddress string
+	// ShippingAddresses and Cards are when each was first and last used.
+	ShippingAddresses map[string]Usage
+	Cards             map[string]Usage
+	Transactions      []Transaction
+	// Authentications are the most recent successful authentication of each card within the history window.
+	Authentications map[string]Authentication
+}
+
+// HasAccount reports whether the customer has an account, rather than being a guest or a customer
+// whose account is yet to be created.
+func (c Customer) HasAccount() bool {
+	return !c.CreatedAt.IsZero()
+}
+
+// Usage is when a shipping address or card was first and last used by the customer.
+type Usage struct {
+	FirstUsed time.Time
+	LastUsed  time.Time
+}
+
+// Transaction is an authentication attempt made by the customer.
+type Transaction struct {
+	At                   time.Time
+	ThreeDSServerTransID string
+	ProductSKU           string
+}
+
+// Authentication is a successful 3DS authentication of one of the customer's cards.
+type Authentication struct {
+	// Method is how the cardholder was authenticated, as sent in threeDSReqPriorAuthMethod.
+	Method               string
+	At                   time.Time
+	ThreeDSServerTransID string
+	ACSTransID           string
+}
+
+// Visit is what the customer entered for an authentication attempt, with the email address, name
+// and addresses as digests made by Store.Digest. A visit without an email address is a guest checkout.
+type Visit struct {
+	ThreeDSServerTransID string
+	Email                string
+	Name                 string
+	BillingAddress       string
+	ShippingAddress      string
+	CardFingerprint      string
+	ProductSKU           string
+}
+
+// Store holds customers by customer ID.
+type Store struct {
+	cookieKey []byte
+	digestKey []byte
+	now       func() time.Time
+	// path is the file the store is persisted to by Flush. The store is only held in memory if empty.
+	path string
+
+	mu        sync.Mutex
+	customers map[string]*Customer
+	lastPrune time.Time
+}
+
+// NewStore creates an in memory customer store. Customer cookies are signed, and the customer's
+// details digested, with keys derived from key, which must be at least keyderiv.MinKeyLength random
+// bytes. If key is empty a random key is generated, in which case customers will not be recognised
+// after a restart.
+func NewStore(key []byte) (*Store, error) {
+	if len(key) == 0 {
+		key = make([]byte, keyderiv.MinKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate customer cookie key: %v", err)
+		}
+	}
+
+	cookieKey, err := keyderiv.Derive(key, "ravelin-3ds-demo customer cookie")
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer cookie key: %w", err)
+	}
+	digestKey, err := keyderiv.Derive(key, "ravelin-3ds-demo customer details")
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer cookie key: %w", err)
+	}
+
+	return &Store{
+		cookieKey: cookieKey,
+		digestKey: digestKey,
+		now:       time.Now,
+		customers: make(map[string]*Customer),
+	}, nil
+}
+
+// Open creates a customer store which is persisted to the file at path, loading any customers
+// flushed to it previously. The same key must be used to recognise their cookies, so key is required.
+func Open(path string, key []byte) (*Store, error) {
+	if len(key) == 0 {
+		return nil, errors.New("customer cookie key is required to persist customers")
+	}
+
+	s, err := NewStore(key)
+	if err != nil {
+		return nil, err
+	}
+	s.path = path
+
+	bb, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read customer store: %v", err)
+	}
+
+	err = json.Unmarshal(bb, &s.customers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode customer store: %v", err)
+	}
+	s.prune(s.now())
+
+	return s, nil
+}
+
+// NewIdentity issues a new customer ID, along with the signed cookie value which identifies it.
+func (s *Store) NewIdentity() (string, string) {
+	id := uuid.New().String()
+	return id, id + "." + base64.RawURLEncoding.EncodeToString(s.sign(id))
+}
+
+// Identify returns the customer ID in a cookie value issued by NewIdentity. False is returned if
+// the cookie was not signed by the store.
+func (s *Store) Identify(cookie string) (string, bool) {
+	parts := strings.Split(cookie, ".")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.sign(parts[0])) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// Record records the visit against the customer, creating the customer the first time they give
+// an email address. The customer is returned as they were before the visit, so the visit can be
+// compared with their history. A customer who was not known has no history.
+func (s *Store) Record(id string, v Visit) Customer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastPrune) >= pruneInterval {
+		s.prune(now)
+	}
+
+	c, ok := s.customers[id]
+	if ok {
+		c.forget(now)
+		if len(c.Transactions) == 0 {
+			// the customer has not been seen for the history window, so is forgotten
+			delete(s.customers, id)
+			ok = false
+		}
+	}
+	if !ok {
+		if v.Email == "" {
+			// a guest is not remembered
+			return Customer{}
+		}
+		c = &Customer{ID: id, CreatedAt: now, ChangedAt: now}
+		s.customers[id] = c
+	}
+	// customers loaded by Open may not have any shipping addresses or cards
+	if c.ShippingAddresses == nil {
+		c.ShippingAddresses = make(map[string]Usage)
+	}
+	if c.Cards == nil {
+		c.Cards = make(map[string]Usage)
+	}
+	previous := c.copy()
+	if !ok {
+		// the customer's account was created by this visit, so they have no history
+		previous = Customer{}
+	}
+	// an authentication retried because it could not be sent is only counted once
+	previous.Transactions = otherTransactions(previous.Transactions, v.ThreeDSServerTransID)
+
+	if v.Email != "" {
+		if c.Email != v.Email || c.Name != v.Name || c.BillingAddress != v.BillingAddress {
+			c.ChangedAt = now
+		}
+		c.Email = v.Email
+		c.Name = v.Name
+		c.BillingAddress = v.BillingAddress
+	}
+	if v.ShippingAddress != "" {
+		c.ShippingAddresses[v.ShippingAddress] = used(c.ShippingAddresses[v.ShippingAddress], now)
+	}
+	if v.CardFingerprint != "" {
+		c.Cards[v.CardFingerprint] = used(c.Cards[v.CardFingerprint], now)
+	}
+
+	c.Transactions = append(otherTransactions(c.Transactions, v.ThreeDSServerTransID),
+		Transaction{At: now, ThreeDSServerTransID: v.ThreeDSServerTransID, ProductSKU: v.ProductSKU})
+
+	return previous
+}
+
+// used records a use of a shipping address or card.
+func used(u Usage, now time.Time) Usage {
+	if u.FirstUsed.IsZero() {
+		u.FirstUsed = now
+	}
+	u.LastUsed = now
+	return u
+}
+
+// RecordAuthentication records a successful authentication of the card, replacing any earlier
+// authentication of it. Authentications of customers who are not known are ignored.
+func (s *Store) RecordAuthentication(id string, cardFingerprint string, a Authentication) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.customers[id]
+	if !ok {
+		return
+	}
+	if c.Authentications == nil {
+		c.Authentications = make(map[string]Authentication)
+	}
+	if previous, ok := c.Authentications[cardFingerprint]; ok && previous.At.After(a.At) {
+		return
+	}
+	c.Authentications[cardFingerprint] = a
+}
+
+// Get returns the customer with the ID.
+func (s *Store) Get(id string) (Customer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.customers[id]
+	if !ok {
+		return Customer{}, false
+	}
+	return c.copy(), true
+}
+
+// Flush atomically replaces the store's file with every customer. Flush does nothing for an in
+// memory store.
+func (s *Store) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.prune(s.now())
+	bb, err := json.Marshal(s.customers)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode customer store: %v", err)
+	}
+
+	err = atomicfile.WriteFile(s.path, bb)
+	if err != nil {
+		return fmt.Errorf("failed to write customer store: %v", err)
+	}
+
+	return nil
+}
+
+// Digest returns a keyed digest of one of the customer's details, so that it can be compared with
+// the details they gave before without being held. An empty string is returned for an empty value.
+func (s *Store) Digest(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, s.digestKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// prune forgets customers who have not been seen for the history window, along with the history
+// of every other customer which has left it. The caller must hold s.mu.
+func (s *Store) prune(now time.Time) {
+	s.lastPrune = now
+	for id, c := range s.customers {
+		c.forget(now)
+		if len(c.Transactions) == 0 {
+			delete(s.customers, id)
+		}
+	}
+}
+
+func (s *Store) sign(id string) []byte {
+	mac := hmac.New(sha256.New, s.cookieKey)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// forget removes the transactions, shipping addresses, cards and authentications which have left
+// the history window.
+func (c *Customer) forget(now time.Time) {
+	transactions := c.Transactions[:0]
+	for _, t := range c.Transactions {
+		if now.Sub(t.At) < historyWindow {
+			transactions = append(transactions, t)
+		}
+	}
+	c.Transactions = transactions
+
+	for address, u := range c.ShippingAddresses {
+		if now.Sub(u.LastUsed) >= historyWindow {
+			delete(c.ShippingAddresses, address)
+		}
+	}
+	for card, u := range c.Cards {
+		if now.Sub(u.LastUsed) >= historyWindow {
+			delete(c.Cards, card)
+		}
+	}
+	for card, a := range c.Authentications {
+		if now.Sub(a.At) >= historyWindow {
+			delete(c.Authentications, card)
+		}
+	}
+}
+
+// otherTransactions returns the transactions other than the one with threeDSServerTransID.
+func otherTransactions(transactions []Transaction, threeDSServerTransID string) []Transaction {
+	others := make([]Transaction, 0, len(transactions))
+	for _, t := range transactions {
+		if threeDSServerTransID == "" || t.ThreeDSServerTransID != threeDSServerTransID {
+			others = append(others, t)
+		}
+	}
+	return others
+}
+
+func (c *Customer) copy() Customer {
+	cc := *c
+	cc.ShippingAddresses = make(map[string]Usage, len(c.ShippingAddresses))
+	for address, at := range c.ShippingAddresses {
+		cc.ShippingAddresses[address] = at
+	}
+	cc.Cards = make(map[string]Usage, len(c.Cards))
+	for card, at := range c.Cards {
+		cc.Cards[card] = at
+	}
+	cc.Transactions = append([]Transaction(nil), c.Transactions...)
+	cc.Authentications = make(map[string]Authentication, len(c.Authentications))
+	for card, a := range c.Authentications {
+		cc.Authentications[card] = a
+	}
+	return cc
+}
@@ -0,0 +1,297 @@
+package customer
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/keyderiv"
+)
+
+var (
+	testKey  = []byte("customer-test-key-of-at-least-32-bytes")
+	otherKey = []byte("customer-other-key-of-at-least-32-bytes")
+)
+
+func TestStore_Record(t *testing.T) {
+	s, err := NewStore(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	visit := Visit{
+		ThreeDSServerTransID: "tx-1",
+		CardFingerprint:      "card-1",
+		ProductSKU:           "10001",
+	}
+
+	previous := s.Record("customer-1", visit)
+	if previous.HasAccount() || len(previous.Transactions) != 0 {
+		t.Fatalf("expected a new customer, actual: %+v", previous)
+	}
+	if _, ok := s.Get("customer-1"); ok {
+		t.Fatal("expected a guest not to be remembered")
+	}
+
+	// the account is created the first time the customer gives an email address
+	now = now.Add(24 * time.Hour)
+	created := now
+	visit.ThreeDSServerTransID = "tx-2"
+	visit.Email = s.Digest("jane.smith@example.com")
+	visit.Name = s.Digest("Jane Smith")
+	visit.ShippingAddress = s.Digest("1 example street|london")
+	previous = s.Record("customer-1", visit)
+	if previous.HasAccount() || len(previous.Transactions) != 0 {
+		t.Errorf("expected no history before the email address was given, actual: %+v", previous)
+	}
+
+	now = now.Add(40 * 24 * time.Hour)
+	visit.ThreeDSServerTransID = "tx-3"
+	visit.ShippingAddress = s.Digest("2 example street|london")
+	visit.CardFingerprint = "card-2"
+	previous = s.Record("customer-1", visit)
+	if !previous.CreatedAt.Equal(created) || !previous.ChangedAt.Equal(created) {
+		t.Errorf("expected: %v, actual: %v and %v", created, previous.CreatedAt, previous.ChangedAt)
+	}
+	if len(previous.ShippingAddresses) != 1 || len(previous.Cards) != 1 || len(previous.Transactions) != 1 {
+		t.Errorf("expected the customer as they were before the visit, actual: %+v", previous)
+	}
+
+	now = now.Add(24 * time.Hour)
+	visit.ThreeDSServerTransID = "tx-4"
+	visit.Name = s.Digest("Jane Doe")
+	previous = s.Record("customer-1", visit)
+	if len(previous.ShippingAddresses) != 2 || len(previous.Cards) != 2 || len(previous.Transactions) != 2 {
+		t.Errorf("expected every shipping address, card and transaction, actual: %+v", previous)
+	}
+
+	c, _ := s.Get("customer-1")
+	if !c.ChangedAt.Equal(now) {
+		t.Errorf("expected: %v, actual: %v", now, c.ChangedAt)
+	}
+
+	if other := s.Record("customer-2", visit); other.HasAccount() {
+		t.Error("expected customers to be identified by their ID, not their email address")
+	}
+}
+
+func TestStore_Record_expired(t *testing.T) {
+	s, _ := NewStore(testKey)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	email := s.Digest("jane.smith@example.com")
+	s.Record("customer-1", Visit{ThreeDSServerTransID: "tx-1", Email: email, ShippingAddress: "address-1", CardFingerprint: "card-1"})
+	now = now.Add(200 * 24 * time.Hour)
+	s.Record("customer-1", Visit{ThreeDSServerTransID: "tx-2", ShippingAddress: "address-2", CardFingerprint: "card-2"})
+
+	// the first visit has left the history window, but the second has not
+	now = now.Add(200 * 24 * time.Hour)
+	previous := s.Record("customer-1", Visit{ThreeDSServerTransID: "tx-3", CardFingerprint: "card-2"})
+	if !previous.HasAccount() {
+		t.Fatal("expected the customer to be remembered")
+	}
+	if len(previous.Transactions) != 1 || previous.Transactions[0].ThreeDSServerTransID != "tx-2" {
+		t.Errorf("expected transactions older than a year to be forgotten, actual: %+v", previous.Transactions)
+	}
+	if _, ok := previous.ShippingAddresses["address-1"]; ok || len(previous.ShippingAddresses) != 1 {
+		t.Errorf("expected shipping addresses last used over a year ago to be forgotten, actual: %+v", previous.ShippingAddresses)
+	}
+	if _, ok := previous.Cards["card-1"]; ok || len(previous.Cards) != 1 {
+		t.Errorf("expected cards last used over a year ago to be forgotten, actual: %+v", previous.Cards)
+	}
+
+	// the customer is forgotten a year after their last visit
+	now = now.Add(historyWindow)
+	previous = s.Record("customer-1", Visit{ThreeDSServerTransID: "tx-4", Email: email})
+	if previous.HasAccount() || len(previous.Transactions) != 0 {
+		t.Errorf("expected the customer to have been forgotten, actual: %+v", previous)
+	}
+	c, _ := s.Get("customer-1")
+	if !c.CreatedAt.Equal(now) {
+		t.Errorf("expected: %v, actual: %v", now, c.CreatedAt)
+	}
+}
+
+func TestStore_prune(t *testing.T) {
+	s, _ := NewStore(testKey)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	email := s.Digest("jane.smith@example.com")
+	s.Record("customer-1", Visit{ThreeDSServerTransID: "tx-1", Email: email})
+	now = now.Add(historyWindow - time.Hour)
+	s.Record("customer-2", Visit{ThreeDSServerTransID: "tx-2", Email: email})
+
+	// customers who are not seen again are forgotten by the daily prune
+	now = now.Add(pruneInterval)
+	s.Record("customer-3", Visit{ThreeDSServerTransID: "tx-3"})
+	if _, ok := s.Get("customer-1"); ok {
+		t.Error("expected customers not seen for the history window to be forgotten")
+	}
+	if _, ok := s.Get("customer-2"); !ok {
+		t.Error("expected customers seen within the history window to be remembered")
+	}
+}
+
+func TestStore_Digest(t *testing.T) {
+	s, _ := NewStore(testKey)
+	other, _ := NewStore(otherKey)
+
+	digest := s.Digest("jane.smith@example.com")
+	if digest == "" || strings.Contains(digest, "jane") {
+		t.Fatalf("expected a digest, actual: %q", digest)
+	}
+	if actual := s.Digest("jane.smith@example.com"); actual != digest {
+		t.Errorf("expected: %q, actual: %q", digest, actual)
+	}
+	if actual := s.Digest("john.smith@example.com"); actual == digest {
+		t.Error("expected different details to have different digests")
+	}
+	if actual := other.Digest("jane.smith@example.com"); actual == digest {
+		t.Error("expected the digest to depend on the key")
+	}
+	if actual := s.Digest(""); actual != "" {
+		t.Errorf("expected: %q, actual: %q", "", actual)
+	}
+}
+
+func TestNewStore_shortKey(t *testing.T) {
+	_, err := NewStore([]byte("too-short"))
+	if !errors.Is(err, keyderiv.ErrKeyTooShort) {
+		t.Errorf("expected: %v, actual: %v", keyderiv.ErrKeyTooShort, err)
+	}
+}
+
+func TestStore_Record_retried(t *testing.T) {
+	s, _ := NewStore(testKey)
+	visit := Visit{ThreeDSServerTransID: "tx-1", Email: s.Digest("jane.smith@example.com"), CardFingerprint: "card-1"}
+
+	s.Record("customer-1", visit)
+	// the authentication is retried after it could not be sent to Ravelin
+	previous := s.Record("customer-1", visit)
+	if len(previous.Transactions) != 0 {
+		t.Errorf("expected the retried transaction not to be in the history, actual: %+v", previous.Transactions)
+	}
+
+	c, _ := s.Get("customer-1")
+	if len(c.Transactions) != 1 {
+		t.Errorf("expected the transaction to be recorded once, actual: %+v", c.Transactions)
+	}
+}
+
+func TestStore_Identify(t *testing.T) {
+	s, _ := NewStore(testKey)
+	other, _ := NewStore(otherKey)
+
+	id, cookie := s.NewIdentity()
+	otherID, otherCookie := s.NewIdentity()
+	if id == otherID {
+		t.Fatal("expected a new customer ID for each identity")
+	}
+
+	tests := []struct {
+		name   string
+		store  *Store
+		cookie string
+		wantID string
+		wantOK bool
+	}{
+		{name: "valid", store: s, cookie: cookie, wantID: id, wantOK: true},
+		{name: "other key", store: other, cookie: cookie},
+		{name: "customer ID changed", store: s, cookie: otherID + cookie[len(id):]},
+		{name: "signature swapped", store: s, cookie: id + otherCookie[len(otherID):]},
+		{name: "unsigned", store: s, cookie: id},
+		{name: "empty", store: s, cookie: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actualID, ok := tt.store.Identify(tt.cookie)
+			if ok != tt.wantOK || actualID != tt.wantID {
+				t.Errorf("expected: %q %v, actual: %q %v", tt.wantID, tt.wantOK, actualID, ok)
+			}
+		})
+	}
+}
+
+func TestStore_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "customers.json")
+	s, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, cookie := s.NewIdentity()
+	s.Record(id, Visit{Email: s.Digest("jane.smith@example.com"), CardFingerprint: "card-1"})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopenedID, ok := reopened.Identify(cookie)
+	if !ok || reopenedID != id {
+		t.Fatalf("expected: %q, actual: %q", id, reopenedID)
+	}
+	c, ok := reopened.Get(id)
+	if !ok || !c.HasAccount() || len(c.Cards) != 1 {
+		t.Errorf("expected the customer to be persisted, actual: %+v", c)
+	}
+
+	// a random key would not recognise any persisted customer's cookie after a restart
+	if _, err := Open(path, nil); err == nil {
+		t.Error("expected error opening a persisted store without a key")
+	}
+}
+
+func TestStore_RecordAuthentication(t *testing.T) {
+	s, _ := NewStore(testKey)
+	now := time.Now()
+
+	s.RecordAuthentication("unknown", "card-1", Authentication{At: now})
+	if _, ok := s.Get("unknown"); ok {
+		t.Fatal("expected authentications of unknown customers to be ignored")
+	}
+
+	s.Record("customer-1", Visit{Email: s.Digest("jane.smith@example.com"), CardFingerprint: "card-1"})
+	s.RecordAuthentication("customer-1", "card-1", Authentication{At: now, ACSTransID: "acs-2"})
+	s.RecordAuthentication("customer-1", "card-1", Authentication{At: now.Add(-time.Minute), ACSTransID: "acs-1"})
+
+	previous := s.Record("customer-1", Visit{CardFingerprint: "card-1"})
+	if a := previous.Authentications["card-1"]; a.ACSTransID != "acs-2" {
+		t.Errorf("expected the most recent authentication, actual: %+v", a)
+	}
+	if _, ok := previous.Authentications["card-2"]; ok {
+		t.Error("expected authentications to be per card")
+	}
+}
+
+func TestStore_RecordAuthentication_expired(t *testing.T) {
+	s, _ := NewStore(testKey)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	visit := Visit{Email: s.Digest("jane.smith@example.com"), CardFingerprint: "card-1"}
+	s.Record("customer-1", visit)
+	s.RecordAuthentication("customer-1", "card-1", Authentication{At: now, ACSTransID: "acs-1"})
+
+	// the customer keeps shopping with another card, so is remembered after the authentication has left the history window
+	for i := 0; i < 3; i++ {
+		now = now.Add(200 * 24 * time.Hour)
+		s.Record("customer-1", Visit{CardFingerprint: "card-2"})
+	}
+
+	previous := s.Record("customer-1", visit)
+	if !previous.HasAccount() {
+		t.Fatal("expected the customer to be remembered")
+	}
+	if a, ok := previous.Authentications["card-1"]; ok {
+		t.Errorf("expected authentications older than a year to be forgotten, actual: %+v", a)
+	}
+}
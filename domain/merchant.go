@@ -9,11 +9,23 @@ type MerchantCheckoutRequest struct {
 }
 
 type MerchantCheckoutResponse struct {
-	MessageVersion        string `json:"messageVersion,omitempty"`
-	ThreeDSServerTransID  string `json:"threeDSServerTransID,omitempty"`
-	TransactionID         string `json:"transactionId,omitempty"`
-	ThreeDSMethodURL      string `json:"threeDSMethodURL,omitempty"`
-	MethodNotificationURL string `json:"methodNotificationURL,omitempty"`
+	MessageVersion        string            `json:"messageVersion,omitempty"`
+	ThreeDSServerTransID  string            `json:"threeDSServerTransID,omitempty"`
+	TransactionID         string            `json:"transactionId,omitempty"`
+	ThreeDSMethodURL      string            `json:"threeDSMethodURL,omitempty"`
+	MethodNotificationURL string            `json:"methodNotificationURL,omitempty"`
+	CardToken             string            `json:"cardToken,omitempty"`
+	Fallback              *FallbackDecision `json:"fallback,omitempty"`
+}
+
+// FallbackDecision is returned in place of 3DS when the payment cannot be authenticated.
+// Decision is PROCEED_WITHOUT_3DS, RETRY_LATER or DECLINE. No liability shift applies to
+// a payment which proceeds without 3DS.
+type FallbackDecision struct {
+	Decision    string `json:"decision"`
+	ErrorType   string `json:"errorType"`
+	ErrorCode   string `json:"errorCode,omitempty"`
+	SCARequired bool   `json:"scaRequired"`
 }
 
 type MerchantAuthenticateRequest struct {
@@ -21,9 +33,38 @@ type MerchantAuthenticateRequest struct {
 	ThreeDSServerTransID string       `json:"threeDSServerTransID,omitempty"`
 	ProductSKU           string       `json:"productSKU,omitempty"`
 	ProductQuantity      int          `json:"productQuantity,omitempty"`
-	AccountNumber        string       `json:"accountNumber,omitempty"`
+	CardToken            string       `json:"cardToken,omitempty"`
 	CardExpiryDate       string       `json:"cardExpiryDate,omitempty"`
 	BrowserData          *BrowserData `json:"browserData,omitempty"`
+	Cardholder           *Cardholder  `json:"cardholder,omitempty"`
+}
+
+// Cardholder is the customer's details entered at checkout. A guest checkout may leave out any
+// of them, but the more the issuer is sent the less likely a challenge is.
+type Cardholder struct {
+	Name            string   `json:"name,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	MobilePhone     *Phone   `json:"mobilePhone,omitempty"`
+	BillingAddress  *Address `json:"billingAddress,omitempty"`
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
+}
+
+// Address is a postal address. Country is the ISO 3166-1 alpha-2 code, such as "GB", and State
+// is the ISO 3166-2 subdivision code without the country prefix.
+type Address struct {
+	Line1    string `json:"line1,omitempty"`
+	Line2    string `json:"line2,omitempty"`
+	Line3    string `json:"line3,omitempty"`
+	City     string `json:"city,omitempty"`
+	State    string `json:"state,omitempty"`
+	PostCode string `json:"postCode,omitempty"`
+	Country  string `json:"country,omitempty"`
+}
+
+// Phone is a phone number split into its country calling code, such as "44", and subscriber number.
+type Phone struct {
+	CountryCode string `json:"countryCode,omitempty"`
+	Number      string `json:"number,omitempty"`
 }
 
 type BrowserData struct {
@@ -45,5 +86,49 @@ type MerchantAuthenticateResponse struct {
 	ACSTransID           string `json:"acsTransID,omitempty"`
 	ACSURL               string `json:"acsURL,omitempty"`
 	MessageVersion       string `json:"messageVersion,omitempty"`
+	ThreeDSSessionData   string `json:"threeDSSessionData,omitempty"`
+	CardholderInfo       string `json:"cardholderInfo,omitempty"`
 	Error                string `json:"error,omitempty"`
+	ErrorCode            string `json:"errorCode,omitempty"`
+	Retryable            bool   `json:"retryable,omitempty"`
+}
+
+// OperatorTransaction is the operator view of a 3DS transaction.
+type OperatorTransaction struct {
+	ThreeDSServerTransID    string     `json:"threeDSServerTransID"`
+	MessageVersion          string     `json:"messageVersion,omitempty"`
+	MethodStatus            string     `json:"methodStatus,omitempty"`
+	AuthenticateTransStatus string     `json:"authenticateTransStatus,omitempty"`
+	ResultTransStatus       string     `json:"resultTransStatus,omitempty"`
+	ResultSource            string     `json:"resultSource,omitempty"`
+	CardholderInfo          string     `json:"cardholderInfo,omitempty"`
+	BroadInfo               *BroadInfo `json:"broadInfo,omitempty"`
+}
+
+// MerchantErrorResponse is returned by the merchant back-end when a request cannot be completed.
+// ErrorCode can be displayed to the customer, and Retryable indicates whether the customer may try again.
+type MerchantErrorResponse struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+}
+
+// HealthResponse is returned by the liveness endpoint.
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ReadinessResponse is returned by the readiness endpoint. Config must not contain any secrets.
+type ReadinessResponse struct {
+	Status  string                 `json:"status"`
+	Version string                 `json:"version,omitempty"`
+	Checks  map[string]CheckResult `json:"checks"`
+	Config  map[string]string      `json:"config,omitempty"`
+}
+
+// CheckResult is the outcome of one of the readiness checks.
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
@@ -56,6 +56,7 @@ type AReqData struct {
 	ThreeDSRequestorURL               string `json:"threeDSRequestorURL,omitempty"`
 	ThreeDSServerTransID              string `json:"threeDSServerTransID,omitempty"`
 	ThreeDSRequestorAuthenticationInd string `json:"threeDSRequestorAuthenticationInd,omitempty"`
+	ThreeDSRequestorChallengeInd      string `json:"threeDSRequestorChallengeInd,omitempty"`
 	AcquirerMerchantID                string `json:"acquirerMerchantID,omitempty"`
 	AcquirerBIN                       string `json:"acquirerBIN,omitempty"`
 	PAN                               string `json:"pan,omitempty"`
@@ -69,7 +70,8 @@ type AReqData struct {
 	PurchaseDate                      string `json:"purchaseDate,omitempty"`
 	ThreeDSCompInd                    string `json:"threeDSCompInd,omitempty"`
 	BrowserAcceptHeader               string `json:"browserAcceptHeader,omitempty"`
-	BrowserJavaEnabled                bool   `json:"browserJavaEnabled"`
+	BrowserIP                         string `json:"browserIP,omitempty"`
+	BrowserJavaEnabled                *bool  `json:"browserJavaEnabled,omitempty"`
 	BrowserJavascriptEnabled          bool   `json:"browserJavascriptEnabled"`
 	BrowserLanguage                   string `json:"browserLanguage,omitempty"`
 	BrowserColorDepth                 string `json:"browserColorDepth,omitempty"`
@@ -78,6 +80,67 @@ type AReqData struct {
 	BrowserTZ                         string `json:"browserTZ,omitempty"`
 	BrowserUserAgent                  string `json:"browserUserAgent,omitempty"`
 	NotificationURL                   string `json:"notificationURL,omitempty"`
+
+	CardholderName        string                 `json:"cardholderName,omitempty"`
+	Email                 string                 `json:"email,omitempty"`
+	MobilePhone           *PhoneNumber           `json:"mobilePhone,omitempty"`
+	BillAddrLine1         string                 `json:"billAddrLine1,omitempty"`
+	BillAddrLine2         string                 `json:"billAddrLine2,omitempty"`
+	BillAddrLine3         string                 `json:"billAddrLine3,omitempty"`
+	BillAddrCity          string                 `json:"billAddrCity,omitempty"`
+	BillAddrState         string                 `json:"billAddrState,omitempty"`
+	BillAddrPostCode      string                 `json:"billAddrPostCode,omitempty"`
+	BillAddrCountry       string                 `json:"billAddrCountry,omitempty"`
+	ShipAddrLine1         string                 `json:"shipAddrLine1,omitempty"`
+	ShipAddrLine2         string                 `json:"shipAddrLine2,omitempty"`
+	ShipAddrLine3         string                 `json:"shipAddrLine3,omitempty"`
+	ShipAddrCity          string                 `json:"shipAddrCity,omitempty"`
+	ShipAddrState         string                 `json:"shipAddrState,omitempty"`
+	ShipAddrPostCode      string                 `json:"shipAddrPostCode,omitempty"`
+	ShipAddrCountry       string                 `json:"shipAddrCountry,omitempty"`
+	AddrMatch             string                 `json:"addrMatch,omitempty"`
+	AcctInfo              *AcctInfo              `json:"acctInfo,omitempty"`
+	MerchantRiskIndicator *MerchantRiskIndicator `json:"merchantRiskIndicator,omitempty"`
+
+	ThreeDSRequestorPriorAuthenticationInfo *PriorAuthenticationInfo `json:"threeDSRequestorPriorAuthenticationInfo,omitempty"`
+}
+
+// PriorAuthenticationInfo describes a previous successful authentication of the cardholder by the
+// 3DS Requestor. The timestamp is in UTC, formatted YYYYMMDDHHMM.
+type PriorAuthenticationInfo struct {
+	ThreeDSReqPriorAuthData      string `json:"threeDSReqPriorAuthData,omitempty"`
+	ThreeDSReqPriorAuthMethod    string `json:"threeDSReqPriorAuthMethod,omitempty"`
+	ThreeDSReqPriorAuthTimestamp string `json:"threeDSReqPriorAuthTimestamp,omitempty"`
+	ThreeDSReqPriorRef           string `json:"threeDSReqPriorRef,omitempty"`
+}
+
+type PhoneNumber struct {
+	CC         string `json:"cc,omitempty"`
+	Subscriber string `json:"subscriber,omitempty"`
+}
+
+// AcctInfo is the cardholder's account information, which the issuer uses in its risk assessment.
+// Dates are formatted YYYYMMDD.
+type AcctInfo struct {
+	ChAccAgeInd          string `json:"chAccAgeInd,omitempty"`
+	ChAccDate            string `json:"chAccDate,omitempty"`
+	ChAccChange          string `json:"chAccChange,omitempty"`
+	ChAccChangeInd       string `json:"chAccChangeInd,omitempty"`
+	ShipAddressUsage     string `json:"shipAddressUsage,omitempty"`
+	ShipAddressUsageInd  string `json:"shipAddressUsageInd,omitempty"`
+	TxnActivityDay       string `json:"txnActivityDay,omitempty"`
+	TxnActivityYear      string `json:"txnActivityYear,omitempty"`
+	ProvisionAttemptsDay string `json:"provisionAttemptsDay,omitempty"`
+	PaymentAccAge        string `json:"paymentAccAge,omitempty"`
+	PaymentAccInd        string `json:"paymentAccInd,omitempty"`
+}
+
+// MerchantRiskIndicator is the merchant's assessment of the purchase.
+type MerchantRiskIndicator struct {
+	ShipIndicator       string `json:"shipIndicator,omitempty"`
+	DeliveryTimeframe   string `json:"deliveryTimeframe,omitempty"`
+	PreOrderPurchaseInd string `json:"preOrderPurchaseInd,omitempty"`
+	ReorderItemsInd     string `json:"reorderItemsInd,omitempty"`
 }
 
 type RavelinAuthenticateResponse struct {
@@ -118,6 +181,17 @@ type RavelinAuthenticateResponseData struct {
 	ErrorMessageType string `json:"errorMessageType,omitempty"`
 }
 
+// BroadInfo is unstructured information sent by the DS or ACS to the 3DS Server, such as
+// notices about upcoming changes to a card range or scheme. In EMVCo 2.2 it has the fields below,
+// but some 2.1 implementations send a plain string, which is decoded into Description.
+type BroadInfo struct {
+	Category       string   `json:"category,omitempty"`
+	Description    string   `json:"description,omitempty"`
+	ExpirationDate string   `json:"expirationDate,omitempty"`
+	Recipients     []string `json:"recipients,omitempty"`
+	Source         string   `json:"source,omitempty"`
+}
+
 type ACSRenderingType struct {
 	ACSInterface  string `json:"acsInterface,omitempty"`
 	ACSUITemplate string `json:"acsUiTemplate,omitempty"`
@@ -165,6 +239,36 @@ type RavelinResultResponseData struct {
 	WhiteListStatusSource        string `json:"whiteListStatusSource,omitempty"`
 }
 
+// ResultsRequest is the Results Request (RReq) sent server to server once a challenge has completed.
+// The results webhook also accepts the data returned by the /3ds/result endpoint, which shares the same fields.
+// For more detail see: https://developer.ravelin.com/apis/3d-secure/result/
+type ResultsRequest struct {
+	ThreeDSServerTransID string `json:"threeDSServerTransID,omitempty"`
+	ACSTransID           string `json:"acsTransID,omitempty"`
+	DSTransID            string `json:"dsTransID,omitempty"`
+	SDKTransID           string `json:"sdkTransID,omitempty"`
+	MessageType          string `json:"messageType,omitempty"`
+	MessageVersion       string `json:"messageVersion,omitempty"`
+	MessageCategory      string `json:"messageCategory,omitempty"`
+	TransStatus          string `json:"transStatus,omitempty"`
+	TransStatusReason    string `json:"transStatusReason,omitempty"`
+	ECI                  string `json:"eci,omitempty"`
+	AuthenticationType   string `json:"authenticationType,omitempty"`
+	AuthenticationValue  string `json:"authenticationValue,omitempty"`
+	ChallengeCancel      string `json:"challengeCancel,omitempty"`
+	InteractionCounter   string `json:"interactionCounter,omitempty"`
+}
+
+// ResultsResponse (RRes) acknowledges a Results Request.
+type ResultsResponse struct {
+	ThreeDSServerTransID string `json:"threeDSServerTransID,omitempty"`
+	ACSTransID           string `json:"acsTransID,omitempty"`
+	DSTransID            string `json:"dsTransID,omitempty"`
+	MessageType          string `json:"messageType,omitempty"`
+	MessageVersion       string `json:"messageVersion,omitempty"`
+	ResultsStatus        string `json:"resultsStatus,omitempty"`
+}
+
 type RavelinTestCardsResponse struct {
 	Code      int        `json:"status"`
 	Message   string     `json:"message,omitempty"`
@@ -172,6 +276,24 @@ type RavelinTestCardsResponse struct {
 	Data      []TestCard `json:"data,omitempty"`
 }
 
+// RavelinErrorResponse is returned by Ravelin's 3DS API when a request fails.
+// Data is only populated when the failure was caused by an EMVCo Error message.
+type RavelinErrorResponse struct {
+	Code      int                       `json:"status"`
+	Message   string                    `json:"message,omitempty"`
+	Timestamp int64                     `json:"timestamp,omitempty"`
+	Data      *RavelinErrorResponseData `json:"data,omitempty"`
+}
+
+type RavelinErrorResponseData struct {
+	ThreeDSServerTransID string `json:"threeDSServerTransID,omitempty"`
+	ErrorCode            string `json:"errorCode,omitempty"`
+	ErrorComponent       string `json:"errorComponent,omitempty"`
+	ErrorDescription     string `json:"errorDescription,omitempty"`
+	ErrorDetail          string `json:"errorDetail,omitempty"`
+	ErrorMessageType     string `json:"errorMessageType,omitempty"`
+}
+
 type TestCard struct {
 	TestPan     string `json:"testPan,omitempty"`
 	Description string `json:"description,omitempty"`
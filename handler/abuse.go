@@ -0,0 +1,354 @@
+package handler
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+var (
+	ErrRateLimited     = errors.New("too many requests")
+	ErrVelocityBlocked = errors.New("request blocked by velocity rules")
+)
+
+// Actions taken by the abuse protection.
+const (
+	AbuseActionAllow     = "allow"
+	AbuseActionChallenge = "challenge"
+	AbuseActionBlock     = "block"
+)
+
+// Rules which can cause the abuse protection to add friction to, or block, a request.
+const (
+	AbuseRuleIPRate       = "ip_rate"
+	AbuseRuleCardRate     = "card_rate"
+	AbuseRuleCardsPerIP   = "cards_per_ip"
+	AbuseRuleCardFailures = "card_failures"
+)
+
+// threeDSRequestorChallengeIndMandated is the threeDSRequestorChallengeInd sent in the AReq to ask
+// the issuer to always challenge the cardholder.
+const threeDSRequestorChallengeIndMandated = "04"
+
+// AbuseLimits configures the abuse protection. Rates are in requests per minute, and a rule is
+// disabled if its limit is zero.
+type AbuseLimits struct {
+	IPRate    float64
+	IPBurst   int
+	CardRate  float64
+	CardBurst int
+
+	// Window is how long distinct cards and card failures are counted for.
+	Window time.Duration
+	// A challenge is mandated once an IP address has used ChallengeCardsPerIP distinct cards in
+	// the window, and requests are blocked once it has used more than MaxCardsPerIP.
+	ChallengeCardsPerIP int
+	MaxCardsPerIP       int
+	// A challenge is mandated once a card has failed authentication ChallengeCardFailures times in
+	// the window, and requests are blocked once it has failed MaxCardFailures times.
+	ChallengeCardFailures int
+	MaxCardFailures       int
+
+	// MaxTracked is how many IP addresses, and how many cards, are remembered. Beyond it the least
+	// recently seen are forgotten, so a flood of addresses or cards cannot exhaust memory.
+	// Unlimited if zero.
+	MaxTracked int
+}
+
+// DefaultAbuseLimits allows a customer a few attempts at a checkout, with a couple of cards,
+// while stopping card testing. Each attempt makes both a checkout and an authenticate request.
+func DefaultAbuseLimits() AbuseLimits {
+	return AbuseLimits{
+		IPRate:                60,
+		IPBurst:               20,
+		CardRate:              6,
+		CardBurst:             6,
+		Window:                time.Hour,
+		ChallengeCardsPerIP:   3,
+		MaxCardsPerIP:         5,
+		ChallengeCardFailures: 2,
+		MaxCardFailures:       5,
+		MaxTracked:            100000,
+	}
+}
+
+// AbuseDecision is the action the abuse protection takes on a request, and the rule which caused it.
+type AbuseDecision struct {
+	Action string
+	Rule   string
+	// RetryAfter is how long until a blocked request would be allowed.
+	RetryAfter time.Duration
+}
+
+// abusePruneBatch is how many of the least recently seen IP addresses and cards each Check
+// considers forgetting, so that state is pruned a little at a time rather than all at once.
+const abusePruneBatch = 8
+
+// AbuseProtection limits how often checkouts and authentications can be attempted, so that card
+// testing does not reach Ravelin's 3DS API. Cards are identified by the card vault's keyed
+// fingerprint of the PAN, so PANs are never held by the abuse protection. Counts are held in
+// memory only, so they are reset on restart. All methods are safe to call on a nil
+// *AbuseProtection, in which case every request is allowed.
+type AbuseProtection struct {
+	limits      AbuseLimits
+	fingerprint func(pan string) string
+	now         func() time.Time
+
+	mu    sync.Mutex
+	ips   *abuseLRU
+	cards *abuseLRU
+}
+
+// NewAbuseProtection creates an AbuseProtection which identifies cards with fingerprint, which
+// must be the card vault's Fingerprint, as failures are recorded with the fingerprint held by the
+// transaction.
+func NewAbuseProtection(limits AbuseLimits, fingerprint func(pan string) string) *AbuseProtection {
+	return &AbuseProtection{
+		limits:      limits,
+		fingerprint: fingerprint,
+		now:         time.Now,
+		ips:         newAbuseLRU(limits.MaxTracked),
+		cards:       newAbuseLRU(limits.MaxTracked),
+	}
+}
+
+// Fingerprint returns the fingerprint which identifies a card without revealing its PAN.
+func (a *AbuseProtection) Fingerprint(pan string) string {
+	if a == nil || pan == "" {
+		return ""
+	}
+
+	return a.fingerprint(pan)
+}
+
+// Check records an attempt to use the card from the IP address, and decides whether it is allowed,
+// needs a challenge or is blocked.
+func (a *AbuseProtection) Check(ip string, pan string) AbuseDecision {
+	if a == nil {
+		return AbuseDecision{Action: AbuseActionAllow}
+	}
+
+	fingerprint := a.Fingerprint(pan)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	a.prune(now)
+
+	ipEntry := a.ips.get(ip)
+	if wait := ipEntry.bucket.take(a.limits.IPRate, a.limits.IPBurst, now); wait > 0 {
+		return AbuseDecision{Action: AbuseActionBlock, Rule: AbuseRuleIPRate, RetryAfter: wait}
+	}
+	cardEntry := a.cards.get(fingerprint)
+	if wait := cardEntry.bucket.take(a.limits.CardRate, a.limits.CardBurst, now); wait > 0 {
+		return AbuseDecision{Action: AbuseActionBlock, Rule: AbuseRuleCardRate, RetryAfter: wait}
+	}
+
+	if ipEntry.cards == nil {
+		ipEntry.cards = make(map[string]time.Time)
+	}
+	ipEntry.cards[fingerprint] = now
+	var cardsSeen []time.Time
+	for card, lastSeen := range ipEntry.cards {
+		if now.Sub(lastSeen) >= a.limits.Window {
+			delete(ipEntry.cards, card)
+			continue
+		}
+		cardsSeen = append(cardsSeen, lastSeen)
+	}
+	sort.Slice(cardsSeen, func(i, j int) bool { return cardsSeen[i].Before(cardsSeen[j]) })
+
+	cardEntry.failures = a.recent(cardEntry.failures, now)
+	failures := cardEntry.failures
+
+	switch {
+	case a.limits.MaxCardsPerIP > 0 && len(cardsSeen) > a.limits.MaxCardsPerIP:
+		// allowed again once enough cards have left the window to bring the count down to the limit
+		expires := cardsSeen[len(cardsSeen)-a.limits.MaxCardsPerIP-1].Add(a.limits.Window)
+		return AbuseDecision{Action: AbuseActionBlock, Rule: AbuseRuleCardsPerIP, RetryAfter: expires.Sub(now)}
+	case exceeds(len(failures), a.limits.MaxCardFailures):
+		expires := failures[len(failures)-a.limits.MaxCardFailures].Add(a.limits.Window)
+		return AbuseDecision{Action: AbuseActionBlock, Rule: AbuseRuleCardFailures, RetryAfter: expires.Sub(now)}
+	case exceeds(len(cardsSeen), a.limits.ChallengeCardsPerIP):
+		return AbuseDecision{Action: AbuseActionChallenge, Rule: AbuseRuleCardsPerIP}
+	case exceeds(len(failures), a.limits.ChallengeCardFailures):
+		return AbuseDecision{Action: AbuseActionChallenge, Rule: AbuseRuleCardFailures}
+	}
+
+	return AbuseDecision{Action: AbuseActionAllow}
+}
+
+// RecordFailure records that authentication of the card with the given fingerprint failed.
+func (a *AbuseProtection) RecordFailure(fingerprint string) {
+	if a == nil || fingerprint == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := a.cards.get(fingerprint)
+	entry.failures = append(entry.failures, a.now())
+}
+
+// recent returns the times which are still in the window, reusing the slice.
+func (a *AbuseProtection) recent(times []time.Time, now time.Time) []time.Time {
+	recent := times[:0]
+	for _, t := range times {
+		if now.Sub(t) < a.limits.Window {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// prune forgets the least recently seen IP addresses and cards once their buckets have refilled
+// and nothing they did is still in the window.
+func (a *AbuseProtection) prune(now time.Time) {
+	a.ips.prune(abusePruneBatch, func(e *abuseEntry) bool {
+		if !e.bucket.full(a.limits.IPRate, a.limits.IPBurst, now) {
+			return false
+		}
+		for _, lastSeen := range e.cards {
+			if now.Sub(lastSeen) < a.limits.Window {
+				return false
+			}
+		}
+		return true
+	})
+	a.cards.prune(abusePruneBatch, func(e *abuseEntry) bool {
+		e.failures = a.recent(e.failures, now)
+		return e.bucket.full(a.limits.CardRate, a.limits.CardBurst, now) && len(e.failures) == 0
+	})
+}
+
+// exceeds reports whether count has reached limit, where a limit of zero is never reached.
+func exceeds(count int, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+// abuseEntry is what the abuse protection remembers about an IP address or a card.
+type abuseEntry struct {
+	key    string
+	bucket tokenBucket
+	// cards is when each card was last used from an IP address.
+	cards map[string]time.Time
+	// failures is when a card failed authentication, oldest first.
+	failures []time.Time
+}
+
+// abuseLRU holds entries in the order they were last used, forgetting the least recently used
+// once it holds more than max.
+type abuseLRU struct {
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newAbuseLRU(max int) *abuseLRU {
+	return &abuseLRU{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry for key, creating it if needed, and marks it as the most recently used.
+func (l *abuseLRU) get(key string) *abuseEntry {
+	if el, ok := l.entries[key]; ok {
+		l.order.MoveToFront(el)
+		return el.Value.(*abuseEntry)
+	}
+
+	e := &abuseEntry{key: key}
+	l.entries[key] = l.order.PushFront(e)
+	if l.max > 0 && l.order.Len() > l.max {
+		l.remove(l.order.Back())
+	}
+	return e
+}
+
+// prune removes up to n of the least recently used entries for which stale is true, stopping at
+// the first entry which is not.
+func (l *abuseLRU) prune(n int, stale func(e *abuseEntry) bool) {
+	for i := 0; i < n; i++ {
+		el := l.order.Back()
+		if el == nil || !stale(el.Value.(*abuseEntry)) {
+			return
+		}
+		l.remove(el)
+	}
+}
+
+func (l *abuseLRU) remove(el *list.Element) {
+	l.order.Remove(el)
+	delete(l.entries, el.Value.(*abuseEntry).key)
+}
+
+// tokenBucket allows bursts of requests, refilling at a steady rate. A bucket which has never been
+// used is full.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token from the bucket, returning zero if one was available or how long until one
+// will be. A rate of zero disables the limit.
+func (b *tokenBucket) take(ratePerMinute float64, burst int, now time.Time) time.Duration {
+	if ratePerMinute <= 0 || burst <= 0 {
+		return 0
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+		b.last = now
+	}
+
+	ratePerSecond := ratePerMinute / 60
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*ratePerSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / ratePerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (b *tokenBucket) full(ratePerMinute float64, burst int, now time.Time) bool {
+	return b.last.IsZero() || b.tokens+now.Sub(b.last).Seconds()*ratePerMinute/60 >= float64(burst)
+}
+
+// checkAbuse applies the abuse protection to a request using the card, writing an error response
+// if it is blocked. It returns the decision so the caller can add friction when asked to.
+func (h Handler) checkAbuse(rw http.ResponseWriter, r *http.Request, endpoint string, pan string) AbuseDecision {
+	decision := h.AbuseProtection.Check(h.TrustedProxies.ClientIP(r), pan)
+	if decision.Action == AbuseActionAllow {
+		return decision
+	}
+
+	logging.FromContext(r.Context()).Warn("abuse protection rule triggered",
+		"endpoint", endpoint,
+		"rule", decision.Rule,
+		"action", decision.Action,
+		"cardLastFour", getLastFour(pan),
+	)
+	h.Metrics.RecordAbuse(endpoint, decision.Rule, decision.Action)
+
+	if decision.Action == AbuseActionBlock {
+		err := ErrVelocityBlocked
+		if decision.Rule == AbuseRuleIPRate || decision.Rule == AbuseRuleCardRate {
+			err = ErrRateLimited
+		}
+		if decision.RetryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+		}
+		respondError(err, rw)
+	}
+
+	return decision
+}
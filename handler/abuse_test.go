@@ -0,0 +1,314 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestAbuseProtection_Check(t *testing.T) {
+	type attempt struct {
+		ip      string
+		pan     string
+		failure bool
+		after   time.Duration
+	}
+
+	tests := []struct {
+		name           string
+		limits         AbuseLimits
+		attempts       []attempt
+		wantAction     string
+		wantRule       string
+		wantRetryAfter time.Duration
+	}{
+		{
+			name:       "allowed",
+			limits:     DefaultAbuseLimits(),
+			attempts:   []attempt{{ip: "192.0.2.1", pan: "4000000000001000"}},
+			wantAction: AbuseActionAllow,
+		},
+		{
+			name:   "ip rate limited",
+			limits: AbuseLimits{IPRate: 60, IPBurst: 2},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+			},
+			wantAction:     AbuseActionBlock,
+			wantRule:       AbuseRuleIPRate,
+			wantRetryAfter: time.Second,
+		},
+		{
+			name:   "ip bucket refills",
+			limits: AbuseLimits{IPRate: 60, IPBurst: 2},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001000", after: time.Second},
+			},
+			wantAction: AbuseActionAllow,
+		},
+		{
+			name:   "other ip not rate limited",
+			limits: AbuseLimits{IPRate: 60, IPBurst: 1},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.2", pan: "4000000000001000"},
+			},
+			wantAction: AbuseActionAllow,
+		},
+		{
+			name:   "card rate limited across ips",
+			limits: AbuseLimits{CardRate: 1, CardBurst: 1},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.2", pan: "4000000000001000"},
+			},
+			wantAction:     AbuseActionBlock,
+			wantRule:       AbuseRuleCardRate,
+			wantRetryAfter: time.Minute,
+		},
+		{
+			name:   "many cards from one ip challenged",
+			limits: AbuseLimits{Window: time.Hour, ChallengeCardsPerIP: 2, MaxCardsPerIP: 3},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001091"},
+			},
+			wantAction: AbuseActionChallenge,
+			wantRule:   AbuseRuleCardsPerIP,
+		},
+		{
+			name:   "too many cards from one ip blocked",
+			limits: AbuseLimits{Window: time.Hour, ChallengeCardsPerIP: 2, MaxCardsPerIP: 3},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001091"},
+				{ip: "192.0.2.1", pan: "4000000000001109"},
+				{ip: "192.0.2.1", pan: "4000000000001117"},
+			},
+			wantAction:     AbuseActionBlock,
+			wantRule:       AbuseRuleCardsPerIP,
+			wantRetryAfter: time.Hour,
+		},
+		{
+			name:   "cards outside window not counted",
+			limits: AbuseLimits{Window: time.Hour, ChallengeCardsPerIP: 2},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+				{ip: "192.0.2.1", pan: "4000000000001091", after: time.Hour},
+			},
+			wantAction: AbuseActionAllow,
+		},
+		{
+			name:   "failing card challenged",
+			limits: AbuseLimits{Window: time.Hour, ChallengeCardFailures: 1, MaxCardFailures: 2},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000", failure: true},
+				{ip: "192.0.2.2", pan: "4000000000001000"},
+			},
+			wantAction: AbuseActionChallenge,
+			wantRule:   AbuseRuleCardFailures,
+		},
+		{
+			name:   "failing card blocked",
+			limits: AbuseLimits{Window: time.Hour, ChallengeCardFailures: 1, MaxCardFailures: 2},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000", failure: true},
+				{ip: "192.0.2.1", pan: "4000000000001000", failure: true},
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+			},
+			wantAction:     AbuseActionBlock,
+			wantRule:       AbuseRuleCardFailures,
+			wantRetryAfter: time.Hour,
+		},
+		{
+			name:   "disabled",
+			limits: AbuseLimits{},
+			attempts: []attempt{
+				{ip: "192.0.2.1", pan: "4000000000001000", failure: true},
+				{ip: "192.0.2.1", pan: "4000000000001091", failure: true},
+				{ip: "192.0.2.1", pan: "4000000000001000"},
+			},
+			wantAction: AbuseActionAllow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAbuseProtection(tt.limits, testCardVault(t).Fingerprint)
+			now := time.Now()
+			a.now = func() time.Time { return now }
+
+			var decision AbuseDecision
+			for _, at := range tt.attempts {
+				now = now.Add(at.after)
+				decision = a.Check(at.ip, at.pan)
+				if at.failure {
+					a.RecordFailure(a.Fingerprint(at.pan))
+				}
+			}
+
+			if decision.Action != tt.wantAction {
+				t.Errorf("expected: %v, actual: %v", tt.wantAction, decision.Action)
+			}
+			if decision.Rule != tt.wantRule {
+				t.Errorf("expected: %v, actual: %v", tt.wantRule, decision.Rule)
+			}
+			if decision.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("expected: %v, actual: %v", tt.wantRetryAfter, decision.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestAbuseProtection_MaxTracked(t *testing.T) {
+	a := NewAbuseProtection(AbuseLimits{IPRate: 60, IPBurst: 1, MaxTracked: 2}, testCardVault(t).Fingerprint)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if decision := a.Check(ip, "4000000000001000"); decision.Action != AbuseActionAllow {
+			t.Fatalf("expected: %v, actual: %v", AbuseActionAllow, decision.Action)
+		}
+	}
+	if len(a.ips.entries) != 2 || len(a.cards.entries) != 1 {
+		t.Errorf("expected: 2 ips and 1 card, actual: %d ips and %d cards", len(a.ips.entries), len(a.cards.entries))
+	}
+
+	// the least recently seen address was forgotten, the others are still limited
+	if decision := a.Check("192.0.2.1", "4000000000001000"); decision.Action != AbuseActionAllow {
+		t.Errorf("expected: %v, actual: %v", AbuseActionAllow, decision.Action)
+	}
+	if decision := a.Check("192.0.2.3", "4000000000001000"); decision.Action != AbuseActionBlock {
+		t.Errorf("expected: %v, actual: %v", AbuseActionBlock, decision.Action)
+	}
+}
+
+func TestAbuseProtection_prune(t *testing.T) {
+	a := NewAbuseProtection(DefaultAbuseLimits(), testCardVault(t).Fingerprint)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	a.Check("192.0.2.1", "4000000000001000")
+	a.RecordFailure(a.Fingerprint("4000000000001000"))
+	a.Check("192.0.2.2", "4000000000001091")
+
+	// nothing is forgotten while it is still in the window
+	now = now.Add(30 * time.Minute)
+	a.Check("192.0.2.3", "4000000000001109")
+	if len(a.ips.entries) != 3 || len(a.cards.entries) != 3 {
+		t.Errorf("expected: 3 ips and 3 cards, actual: %d ips and %d cards", len(a.ips.entries), len(a.cards.entries))
+	}
+
+	now = now.Add(time.Hour)
+	a.Check("192.0.2.4", "4000000000001117")
+	if len(a.ips.entries) != 1 || len(a.cards.entries) != 1 {
+		t.Errorf("expected: 1 ip and 1 card, actual: %d ips and %d cards", len(a.ips.entries), len(a.cards.entries))
+	}
+}
+
+func TestAbuseProtection_Fingerprint(t *testing.T) {
+	cardVault := testCardVault(t)
+	a := NewAbuseProtection(DefaultAbuseLimits(), cardVault.Fingerprint)
+
+	fingerprint := a.Fingerprint("4000000000001000")
+	if fingerprint != a.Fingerprint("4000000000001000") {
+		t.Error("expected the same card to have the same fingerprint")
+	}
+	if fingerprint == a.Fingerprint("4000000000001091") {
+		t.Error("expected different cards to have different fingerprints")
+	}
+	if bytes.Contains([]byte(fingerprint), []byte("4000000000001000")) {
+		t.Error("expected fingerprint not to contain the PAN")
+	}
+
+	// a restarted process with the same card vault key identifies the same card
+	restarted := NewAbuseProtection(DefaultAbuseLimits(), cardVault.Fingerprint)
+	if restarted.Fingerprint("4000000000001000") != fingerprint {
+		t.Error("expected the fingerprint to be stable across restarts")
+	}
+}
+
+func TestHandler_Checkout_rateLimited(t *testing.T) {
+	ravelinRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ravelinRequests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	abuseProtection := NewAbuseProtection(AbuseLimits{CardRate: 1, CardBurst: 1}, testCardVault(t).Fingerprint)
+
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		FallbackPolicy:          DefaultFallbackPolicy(),
+		AbuseProtection:         abuseProtection,
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	body, _ := json.Marshal(domain.MerchantCheckoutRequest{AccountNumber: "4000000000001000"})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader(body)))
+		if i == 0 {
+			continue
+		}
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected: %d, actual: %d", http.StatusTooManyRequests, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected: %s, actual: %s", "60", w.Header().Get("Retry-After"))
+		}
+
+		rsp := domain.MerchantErrorResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		if rsp.ErrorCode != merchantErrorCodeRateLimited {
+			t.Errorf("expected: %s, actual: %s", merchantErrorCodeRateLimited, rsp.ErrorCode)
+		}
+	}
+
+	if ravelinRequests != 1 {
+		t.Errorf("expected: %d, actual: %d", 1, ravelinRequests)
+	}
+}
+
+func TestHandler_Checkout_velocityBlocked(t *testing.T) {
+	abuseProtection := NewAbuseProtection(AbuseLimits{Window: time.Hour, MaxCardFailures: 1}, testCardVault(t).Fingerprint)
+	abuseProtection.RecordFailure(abuseProtection.Fingerprint("4000000000001000"))
+
+	h := Handler{
+		FallbackPolicy:          DefaultFallbackPolicy(),
+		AbuseProtection:         abuseProtection,
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	body, _ := json.Marshal(domain.MerchantCheckoutRequest{AccountNumber: "4000000000001000"})
+	w := httptest.NewRecorder()
+	h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader(body)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected: %d, actual: %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected: %s, actual: %s", "3600", w.Header().Get("Retry-After"))
+	}
+
+	rsp := domain.MerchantErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.ErrorCode != merchantErrorCodeVelocityBlocked {
+		t.Errorf("expected: %s, actual: %s", merchantErrorCodeVelocityBlocked, rsp.ErrorCode)
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrApiKeyNotConfigured = errors.New("ravelin api key not configured")
+
+// ApiKey is a Ravelin API key pair. The secondary key is used when the primary is rejected,
+// so that requests keep working while a key is being rotated.
+type ApiKey struct {
+	Primary   string
+	Secondary string
+}
+
+// ApiKeys holds the current Ravelin API keys, loaded from flags, the environment or secret files.
+// Keys loaded from files are reloaded when the files change. Each request takes a snapshot of the
+// keys with Get, so a rotation never mixes old and new keys within a request.
+type ApiKeys struct {
+	primaryFile   string
+	secondaryFile string
+
+	mu  *sync.RWMutex
+	key ApiKey
+	// primaryRejected is set once the current primary key has been rejected, and cleared once it is
+	// accepted or replaced, so the readiness check can report a primary key which needs rotating.
+	primaryRejected bool
+}
+
+// NewApiKeys creates ApiKeys from the given keys, which are overridden by the contents of
+// primaryFile and secondaryFile if they are set.
+func NewApiKeys(key ApiKey, primaryFile, secondaryFile string) (*ApiKeys, error) {
+	k := &ApiKeys{
+		primaryFile:   primaryFile,
+		secondaryFile: secondaryFile,
+		mu:            &sync.RWMutex{},
+		key:           key,
+	}
+
+	_, err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Get returns the current keys. A nil *ApiKeys has no keys.
+func (k *ApiKeys) Get() ApiKey {
+	if k == nil {
+		return ApiKey{}
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.key
+}
+
+// Reload reads the key files, and reports whether either key changed. The current keys are kept
+// if a file cannot be read.
+func (k *ApiKeys) Reload() (bool, error) {
+	key := k.Get()
+
+	if k.primaryFile != "" {
+		primary, err := readApiKeyFile(k.primaryFile)
+		if err != nil {
+			return false, err
+		}
+		key.Primary = primary
+	}
+
+	if k.secondaryFile != "" {
+		secondary, err := readApiKeyFile(k.secondaryFile)
+		if err != nil {
+			return false, err
+		}
+		key.Secondary = secondary
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changed := key != k.key
+	if key.Primary != k.key.Primary {
+		k.primaryRejected = false
+	}
+	k.key = key
+	return changed, nil
+}
+
+// PrimaryRejected reports whether the current primary key was rejected by the last request which used it.
+func (k *ApiKeys) PrimaryRejected() bool {
+	if k == nil {
+		return false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.primaryRejected
+}
+
+// recordPrimary records whether primary was rejected, unless it has since been replaced.
+func (k *ApiKeys) recordPrimary(primary string, rejected bool) {
+	if k == nil {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.key.Primary == primary {
+		k.primaryRejected = rejected
+	}
+}
+
+// Watch reloads the key files every interval until ctx is done. The contents of the files are
+// compared rather than their modification times, as mounted secrets are replaced by swapping symlinks.
+func (k *ApiKeys) Watch(ctx context.Context, interval time.Duration, onReload func(), onError func(error)) {
+	if k.primaryFile == "" && k.secondaryFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := k.Reload()
+			if err != nil {
+				onError(err)
+			} else if changed {
+				onReload()
+			}
+		}
+	}
+}
+
+func readApiKeyFile(path string) (string, error) {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read api key file: %v", err)
+	}
+	return strings.TrimSpace(string(bb)), nil
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestApiKeys_Reload(t *testing.T) {
+	dir := t.TempDir()
+	primaryFile := filepath.Join(dir, "primary")
+	if err := os.WriteFile(primaryFile, []byte("key-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewApiKeys(ApiKey{Primary: "flag-key", Secondary: "flag-secondary"}, primaryFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ApiKey{Primary: "key-1", Secondary: "flag-secondary"}
+	if actual := keys.Get(); actual != expected {
+		t.Errorf("expected: %+v, actual: %+v", expected, actual)
+	}
+
+	changed, err := keys.Reload()
+	if err != nil || changed {
+		t.Errorf("expected unchanged file not to change the keys, actual: %v %v", changed, err)
+	}
+
+	if err := os.WriteFile(primaryFile, []byte("key-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = keys.Reload()
+	if err != nil || !changed {
+		t.Errorf("expected rotated key to be reloaded, actual: %v %v", changed, err)
+	}
+	if actual := keys.Get().Primary; actual != "key-2" {
+		t.Errorf("expected: %s, actual: %s", "key-2", actual)
+	}
+
+	// a missing file keeps the current key
+	if err := os.Remove(primaryFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Reload(); err == nil {
+		t.Error("expected missing file to fail to reload")
+	}
+	if actual := keys.Get().Primary; actual != "key-2" {
+		t.Errorf("expected: %s, actual: %s", "key-2", actual)
+	}
+}
+
+func Test_sendToRavelin3DSServer_apiKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         ApiKey
+		wantErr     error
+		wantHeaders []string
+	}{
+		{
+			name:        "primary key",
+			key:         ApiKey{Primary: "valid", Secondary: "other"},
+			wantHeaders: []string{"token valid"},
+		},
+		{
+			name:        "falls back to secondary key",
+			key:         ApiKey{Primary: "expired", Secondary: "valid"},
+			wantHeaders: []string{"token expired", "token valid"},
+		},
+		{
+			name:        "no secondary key",
+			key:         ApiKey{Primary: "expired"},
+			wantErr:     ErrUnauthorised,
+			wantHeaders: []string{"token expired"},
+		},
+		{
+			name:    "not configured",
+			key:     ApiKey{},
+			wantErr: ErrApiKeyNotConfigured,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var headers []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				headers = append(headers, r.Header.Get("Authorization"))
+				mu.Unlock()
+
+				if r.Header.Get("Authorization") != "token valid" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			keys, err := NewApiKeys(tt.key, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// authenticate is not retry-safe, but an unauthorised request is never processed
+			h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: keys}
+			_, err = h.sendToRavelin3DSServer(context.Background(), http.MethodPost, struct{}{}, domain.RavelinThreeDSAuthenticateEndpoint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected: %v, actual: %v", tt.wantErr, err)
+			}
+
+			if len(headers) != len(tt.wantHeaders) {
+				t.Fatalf("expected: %v, actual: %v", tt.wantHeaders, headers)
+			}
+			for i := range headers {
+				if headers[i] != tt.wantHeaders[i] {
+					t.Errorf("expected: %v, actual: %v", tt.wantHeaders, headers)
+				}
+			}
+		})
+	}
+}
+
+func TestApiKeys_PrimaryRejected(t *testing.T) {
+	keys, err := NewApiKeys(ApiKey{Primary: "expired", Secondary: "valid"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.recordPrimary("expired", true)
+	if !keys.PrimaryRejected() {
+		t.Error("expected the primary key to be rejected")
+	}
+
+	// an outcome for a key which has since been replaced is ignored
+	keys.key.Primary = "renewed"
+	keys.recordPrimary("expired", false)
+	if !keys.PrimaryRejected() {
+		t.Error("expected an outcome for a replaced key to be ignored")
+	}
+	keys.recordPrimary("renewed", false)
+	if keys.PrimaryRejected() {
+		t.Error("expected an accepted primary key not to be rejected")
+	}
+}
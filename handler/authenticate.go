@@ -4,14 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/unravelin/ravelin-3ds-demo/audit"
 	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/metrics"
+	"github.com/unravelin/ravelin-3ds-demo/vault"
 )
 
 // Authenticate calls the Ravelin /3ds/authenticate endpoint and handles the response.
@@ -26,53 +29,119 @@ func (h Handler) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Handling %s request", AuthenticateEndpoint)
+	logger := logging.FromContext(r.Context())
+	logger.Info("Handling request", "endpoint", AuthenticateEndpoint)
 
-	requestBody, err := readBody(r.Body)
+	authenticateRequest := domain.MerchantAuthenticateRequest{}
+	err := h.decodeJSONRequest(w, r, true, &authenticateRequest)
 	if err != nil {
-		log.Printf("failed to read authenticate request body :%v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to decode authenticate request", "error", err)
+		respondRequestError(err, w)
 		return
 	}
 
-	authenticateRequest := domain.MerchantAuthenticateRequest{}
-	err = json.Unmarshal(requestBody, &authenticateRequest)
+	err = validateMerchantAuthenticateRequest(authenticateRequest)
 	if err != nil {
-		log.Printf("failed to unmarshal authenticate request json: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn("invalid authenticate request", "error", err)
+		respondRequestError(err, w)
 		return
 	}
 
-	err = validateMerchantAuthenticateRequest(authenticateRequest)
+	logger = h.transactionLogger(logger, authenticateRequest.ThreeDSServerTransID)
+
+	r, span := h.joinTransactionTrace(r, authenticateRequest.ThreeDSServerTransID, "threeds.authenticate")
+	defer span.End()
+
+	browserData, err := normaliseBrowserData(r, *authenticateRequest.BrowserData)
 	if err != nil {
-		log.Printf("invalid authenticate request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn("invalid browser data", "error", err)
+		respondRequestError(err, w)
+		return
+	}
+	authenticateRequest.BrowserData = &browserData
+
+	if authenticateRequest.Cardholder != nil {
+		cardholder, err := normaliseCardholder(*authenticateRequest.Cardholder)
+		if err != nil {
+			logger.Warn("invalid cardholder data", "error", err)
+			respondRequestError(err, w)
+			return
+		}
+		authenticateRequest.Cardholder = &cardholder
+	}
+
+	pan, err := h.CardVault.Detokenise(authenticateRequest.CardToken, authenticateRequest.ThreeDSServerTransID)
+	if errors.Is(err, vault.ErrTokenNotFound) || errors.Is(err, vault.ErrTokenExpired) || errors.Is(err, vault.ErrTokenMismatch) {
+		logger.Warn("invalid card token", "error", err)
+		respondRequestError(&RequestError{
+			StatusCode: http.StatusBadRequest,
+			ErrorCode:  merchantErrorCodeInvalidCardToken,
+			Message:    err.Error(),
+		}, w)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to detokenise card", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	acceptHeader := r.Header.Get("Accept")
-	if authenticateRequest.BrowserData != nil {
-		authenticateRequest.BrowserData.BrowserAcceptHeader = acceptHeader
+	ravelinAuthenticateRequest := h.createRavelinAuthenticateRequest(authenticateRequest, pan, h.TrustedProxies.ClientIP(r))
+
+	abuseDecision := h.checkAbuse(w, r, AuthenticateEndpoint, ravelinAuthenticateRequest.AReqData.PAN)
+	if abuseDecision.Action == AbuseActionBlock {
+		return
+	}
+	if abuseDecision.Action == AbuseActionChallenge {
+		// friction for suspicious use of the card, rather than blocking a customer who may be genuine
+		ravelinAuthenticateRequest.AReqData.ThreeDSRequestorChallengeInd = threeDSRequestorChallengeIndMandated
 	}
 
-	ravelinAuthenticateRequest, err := h.createRavelinAuthenticateRequest(authenticateRequest)
+	// the transaction is only authenticated once, with the card and version it was checked out with
+	panFingerprint := h.CardVault.Fingerprint(pan)
+	tx, err := h.ThreeDSTransactionStore.StartAuthentication(authenticateRequest.ThreeDSServerTransID, panFingerprint, authenticateRequest.MessageVersion)
 	if err != nil {
-		log.Printf("failed to create Ravelin 3DS Authenticate Request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Warn("authenticate request does not match the transaction", "error", err)
+		respondRequestError(bindingError(err), w)
 		return
 	}
+	ravelinAuthenticateRequest.AReqData.MessageVersion = tx.MessageVersion
+	ravelinAuthenticateRequest.AReqData.ThreeDSCompInd = tx.MethodStatus
+	if tx.MessageVersion == messageVersion210 && ravelinAuthenticateRequest.AReqData.BrowserJavaEnabled == nil {
+		// 2.1.0 requires browserJavaEnabled even when JavaScript is disabled, unlike 2.2.0
+		javaEnabled := false
+		ravelinAuthenticateRequest.AReqData.BrowserJavaEnabled = &javaEnabled
+	}
+	h.setCustomer(w, r, &ravelinAuthenticateRequest, authenticateRequest, panFingerprint)
+	err = h.ThreeDSTransactionStore.SetCustomerID(authenticateRequest.ThreeDSServerTransID, ravelinAuthenticateRequest.CustomerID)
+	if err != nil {
+		logger.Error("failed to record customer", "error", err)
+	}
+
+	scheme := cardScheme(ravelinAuthenticateRequest.AReqData.PAN)
+	messageVersion := ravelinAuthenticateRequest.AReqData.MessageVersion
+	h.Metrics.RecordMethod(methodOutcome(ravelinAuthenticateRequest.AReqData.ThreeDSCompInd))
 
-	log.Printf("Making Ravelin /3ds/authenticate request for card ending in %s", getLastFour(ravelinAuthenticateRequest.AReqData.PAN))
-	rsp, err := h.sendToRavelin3DSServer(http.MethodPost, ravelinAuthenticateRequest, domain.RavelinThreeDSAuthenticateEndpoint)
+	logger.Info("Making Ravelin /3ds/authenticate request", "cardLastFour", getLastFour(ravelinAuthenticateRequest.AReqData.PAN))
+	h.audit(r, authenticateRequest.ThreeDSServerTransID, audit.MessageAuthenticateRequest, ravelinAuthenticateRequest)
+	rsp, err := h.sendToRavelin3DSServer(r.Context(), http.MethodPost, ravelinAuthenticateRequest, domain.RavelinThreeDSAuthenticateEndpoint)
 	if err != nil {
-		log.Printf("failed to send Ravelin 3DS Authenticate Request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Error("failed to send Ravelin 3DS Authenticate Request", "error", err)
+		h.auditFailure(r, authenticateRequest.ThreeDSServerTransID, domain.RavelinThreeDSAuthenticateEndpoint, err)
+		h.Metrics.RecordAuthentication(metrics.OutcomeError, messageVersion, scheme)
+		if requestNotSent(err) {
+			// the customer can retry, as the ACS cannot have seen the transaction. Otherwise it stays
+			// bound, as an AReq which timed out or failed may still have started an authentication.
+			h.ThreeDSTransactionStore.ReleaseAuthentication(authenticateRequest.ThreeDSServerTransID)
+		}
+		respondError(err, w)
 		return
 	}
 
 	responseBytes, err := readBody(rsp.Body)
 	if err != nil {
-		log.Printf("failed to read Ravelin 3DS Authenticate Response: %v", err)
+		logger.Error("failed to read Ravelin 3DS Authenticate Response", "error", err)
+		h.auditFailure(r, authenticateRequest.ThreeDSServerTransID, domain.RavelinThreeDSAuthenticateEndpoint, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -80,13 +149,55 @@ func (h Handler) Authenticate(w http.ResponseWriter, r *http.Request) {
 	ravelinAuthenticateResponse := &domain.RavelinAuthenticateResponse{}
 	err = json.Unmarshal(responseBytes, ravelinAuthenticateResponse)
 	if err != nil {
-		log.Printf("failed to decode Ravelin 3DS Authenticate Response: %v", err)
+		logger.Error("failed to decode Ravelin 3DS Authenticate Response", "error", err)
+		h.auditFailure(r, authenticateRequest.ThreeDSServerTransID, domain.RavelinThreeDSAuthenticateEndpoint, err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	log.Printf("Ravelin /3ds/authenticate response received. MessageVersion: %s", ravelinAuthenticateResponse.Data.MessageVersion)
+	h.audit(r, authenticateRequest.ThreeDSServerTransID, audit.MessageAuthenticateResponse, ravelinAuthenticateResponse)
 
-	merchantAuthenticateResponse := domain.MerchantAuthenticateResponse{}
+	if ravelinAuthenticateResponse.Data == nil {
+		logger.Error("no data in Ravelin 3DS Authenticate Response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if threeDSErr := newThreeDSErrorFromAuthenticateResponse(ravelinAuthenticateResponse.Data); threeDSErr != nil {
+		logger.Error("Ravelin /3ds/authenticate returned an error message", "error", threeDSErr)
+		h.Metrics.RecordAuthentication(metrics.OutcomeError, messageVersion, scheme)
+		respondError(threeDSErr, w)
+		return
+	}
+
+	logger.Info("Ravelin /3ds/authenticate response received",
+		"messageVersion", ravelinAuthenticateResponse.Data.MessageVersion,
+		"transStatus", ravelinAuthenticateResponse.Data.TransStatus,
+		"transStatusReason", ravelinAuthenticateResponse.Data.TransStatusReason)
+
+	broadInfo, err := parseBroadInfo(ravelinAuthenticateResponse.Data.BroadInfo)
+	if err != nil {
+		logger.Error("failed to parse broadInfo", "error", err)
+	}
+	if broadInfo != nil {
+		logger.Info("broadInfo received", "broadInfo", broadInfo)
+	}
+
+	err = h.ThreeDSTransactionStore.SetAuthenticateResponse(
+		authenticateRequest.ThreeDSServerTransID,
+		ravelinAuthenticateResponse.Data.TransStatus,
+		ravelinAuthenticateResponse.Data.ACSTransID,
+		ravelinAuthenticateResponse.Data.CardholderInfo,
+		broadInfo,
+	)
+	if err != nil {
+		logger.Error("failed to record authenticate response", "error", err)
+	}
+
+	merchantAuthenticateResponse := domain.MerchantAuthenticateResponse{
+		// the issuer's cardholderInfo text must be displayed to the cardholder whenever it is present
+		CardholderInfo: ravelinAuthenticateResponse.Data.CardholderInfo,
+	}
 
 	switch ravelinAuthenticateResponse.Data.MessageVersion {
 	case "2.1.0", "2.2.0":
@@ -94,14 +205,36 @@ func (h Handler) Authenticate(w http.ResponseWriter, r *http.Request) {
 		case "Y", "A":
 			// proceed to authorisation
 			merchantAuthenticateResponse.Status = "SUCCESS"
+			h.Metrics.RecordAuthentication(metrics.OutcomeFrictionless, messageVersion, scheme)
+			// only a fully authenticated card counts as a prior authentication, as with a challenge result
+			result := ThreeDSResult{TransStatus: ravelinAuthenticateResponse.Data.TransStatus, AuthenticationValue: ravelinAuthenticateResponse.Data.AuthenticationValue}
+			if result.TransStatus == "Y" && result.Successful() {
+				tx, _ := h.ThreeDSTransactionStore.Get(authenticateRequest.ThreeDSServerTransID)
+				h.recordPriorAuthentication(authenticateRequest.ThreeDSServerTransID, tx, priorAuthMethodFrictionless, time.Now())
+			}
 		case "C":
+			tx, _ := h.ThreeDSTransactionStore.Get(authenticateRequest.ThreeDSServerTransID)
+			sessionData, err := h.SessionDataSigner.Sign(authenticateRequest.ThreeDSServerTransID, tx.BrowserSessionID)
+			if err != nil {
+				logger.Error("failed to sign threeDSSessionData", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
 			merchantAuthenticateResponse.Status = "CHALLENGE_REQUIRED"
+			merchantAuthenticateResponse.ThreeDSSessionData = sessionData
 			merchantAuthenticateResponse.MessageVersion = ravelinAuthenticateResponse.Data.MessageVersion
-			merchantAuthenticateResponse.ThreeDSServerTransID = ravelinAuthenticateResponse.Data.ThreeDSServerTransID
+			merchantAuthenticateResponse.ThreeDSServerTransID = authenticateRequest.ThreeDSServerTransID
 			merchantAuthenticateResponse.ACSTransID = ravelinAuthenticateResponse.Data.ACSTransID
 			merchantAuthenticateResponse.ACSURL = ravelinAuthenticateResponse.Data.ACSURL
+			h.Metrics.RecordAuthentication(metrics.OutcomeChallenge, messageVersion, scheme)
 		case "N", "U", "R":
 			merchantAuthenticateResponse.Status = "FAILED"
+			if ravelinAuthenticateResponse.Data.TransStatus != "U" {
+				// a technical failure says nothing about whether the card is being misused
+				h.AbuseProtection.RecordFailure(panFingerprint)
+			}
+			h.Metrics.RecordAuthentication(metrics.OutcomeFailed, messageVersion, scheme)
 		}
 	}
 
@@ -113,11 +246,11 @@ func (h Handler) Authenticate(w http.ResponseWriter, r *http.Request) {
 //
 // Many of the fields in this function have been populated with example values for demonstration purposes.
 // In a live implementation these fields should be populated with real merchant and transaction values.
-func (h Handler) createRavelinAuthenticateRequest(request domain.MerchantAuthenticateRequest) (domain.RavelinAuthenticateRequest, error) {
-	validColorDepth, err := convertToValidColorDepth(request.BrowserData.BrowserColorDepth)
-	if err != nil {
-		return domain.RavelinAuthenticateRequest{}, err
-	}
+//
+// The browser data and cardholder must already have been validated by normaliseBrowserData and
+// normaliseCardholder.
+func (h Handler) createRavelinAuthenticateRequest(request domain.MerchantAuthenticateRequest, pan string, browserIP string) domain.RavelinAuthenticateRequest {
+	o := h.order()
 	areqData := domain.AReqData{
 		MessageCategory:                   "01",
 		MessageVersion:                    request.MessageVersion,
@@ -128,34 +261,36 @@ func (h Handler) createRavelinAuthenticateRequest(request domain.MerchantAuthent
 		ThreeDSRequestorURL:               "https://www.ravelin.com/example-merchant",
 		ThreeDSServerTransID:              request.ThreeDSServerTransID,
 		AcquirerBIN:                       "000000999",
-		PAN:                               request.AccountNumber,
+		PAN:                               pan,
 		CardExpiryDate:                    request.CardExpiryDate,
 		AcquirerMerchantID:                "9876543210001",
-		MerchantCountryCode:               "826",
+		MerchantCountryCode:               o.merchantCountryCode(),
 		MerchantName:                      "Example 3DS Merchant",
 		MCC:                               "7922",
-		PurchaseAmount:                    "80000",
-		PurchaseCurrency:                  "826",
-		PurchaseExponent:                  "2",
+		PurchaseAmount:                    o.purchaseAmount(),
+		PurchaseCurrency:                  o.Currency,
+		PurchaseExponent:                  o.Exponent,
 		PurchaseDate:                      time.Now().UTC().Format("20060102150405"),
 		BrowserAcceptHeader:               request.BrowserData.BrowserAcceptHeader,
-		BrowserJavaEnabled:                request.BrowserData.BrowserJavaEnabled,
+		BrowserIP:                         browserIP,
 		BrowserJavascriptEnabled:          request.BrowserData.BrowserJavascriptEnabled,
 		BrowserLanguage:                   request.BrowserData.BrowserLanguage,
-		BrowserColorDepth:                 strconv.Itoa(validColorDepth),
-		BrowserScreenHeight:               strconv.Itoa(request.BrowserData.BrowserScreenHeight),
-		BrowserScreenWidth:                strconv.Itoa(request.BrowserData.BrowserScreenWidth),
-		BrowserTZ:                         strconv.Itoa(request.BrowserData.BrowserTZ),
 		BrowserUserAgent:                  request.BrowserData.BrowserUserAgent,
 		NotificationURL:                   h.MerchantUrl + ChallengeNotificationEndpoint,
 	}
 
-	tx, ok := h.ThreeDSTransactionStore.Get(request.ThreeDSServerTransID)
-	if ok {
-		areqData.MessageVersion = tx.MessageVersion
-		areqData.ThreeDSCompInd = string(tx.MethodStatus)
-	} else {
-		areqData.ThreeDSCompInd = MethodStatusNotCompleted
+	// the remaining browser data can only be collected with JavaScript
+	if request.BrowserData.BrowserJavascriptEnabled {
+		javaEnabled := request.BrowserData.BrowserJavaEnabled
+		areqData.BrowserJavaEnabled = &javaEnabled
+		areqData.BrowserColorDepth = strconv.Itoa(request.BrowserData.BrowserColorDepth)
+		areqData.BrowserScreenHeight = strconv.Itoa(request.BrowserData.BrowserScreenHeight)
+		areqData.BrowserScreenWidth = strconv.Itoa(request.BrowserData.BrowserScreenWidth)
+		areqData.BrowserTZ = strconv.Itoa(request.BrowserData.BrowserTZ)
+	}
+
+	if request.Cardholder != nil {
+		setCardholderData(&areqData, *request.Cardholder)
 	}
 
 	r := domain.RavelinAuthenticateRequest{
@@ -165,7 +300,35 @@ func (h Handler) createRavelinAuthenticateRequest(request domain.MerchantAuthent
 		AReqData:      areqData,
 	}
 
-	return r, nil
+	return r
+}
+
+// bindingError converts an error binding an authenticate request to its transaction into the
+// error returned to the merchant front-end.
+func bindingError(err error) *RequestError {
+	switch {
+	case errors.Is(err, ErrTransactionNotFound):
+		return &RequestError{StatusCode: http.StatusNotFound, ErrorCode: merchantErrorCodeTransactionNotFound, Message: "transaction not found"}
+	case errors.Is(err, ErrTransactionAlreadyAuthenticated):
+		return &RequestError{StatusCode: http.StatusConflict, ErrorCode: merchantErrorCodeAlreadyAuthenticated, Message: err.Error()}
+	case errors.Is(err, ErrCardMismatch):
+		return &RequestError{StatusCode: http.StatusConflict, ErrorCode: merchantErrorCodeCardMismatch, Message: err.Error()}
+	case errors.Is(err, ErrMessageVersionMismatch):
+		return &RequestError{StatusCode: http.StatusConflict, ErrorCode: merchantErrorCodeMessageVersionMismatch, Message: err.Error()}
+	}
+	return invalidRequest("%s", err.Error())
+}
+
+// methodOutcome converts threeDSCompInd into the method outcome recorded in metrics. The method
+// is still not completed at the time of authentication if the browser timed out waiting for it.
+func methodOutcome(threeDSCompInd string) string {
+	switch threeDSCompInd {
+	case MethodStatusCompleted:
+		return metrics.MethodCompleted
+	case MethodStatusNotCompleted:
+		return metrics.MethodTimedOut
+	}
+	return metrics.MethodUnavailable
 }
 
 // According to the EMVCo 3DS V220 spec 1, 4, 8, 15, 16, 24, 32 and 48 are the
@@ -192,12 +355,40 @@ func convertToValidColorDepth(colorDepth int) (int, error) {
 
 func validateMerchantAuthenticateRequest(request domain.MerchantAuthenticateRequest) error {
 	if request.ProductQuantity == 0 { // Has to have quantity
-		return fmt.Errorf("product quantity is zero")
+		return invalidRequest("product quantity is zero")
 	}
 
 	if request.ProductSKU == "" { // Has to have a product
-		return fmt.Errorf("no product selected")
+		return invalidRequest("no product selected")
+	}
+
+	if request.CardToken == "" {
+		return invalidRequest("cardToken is required")
+	}
+
+	if request.BrowserData == nil {
+		return invalidRequest("browserData is required")
 	}
 
 	return nil
 }
+
+// parseBroadInfo decodes broadInfo from an ARes. Nil is returned if there is no broadInfo.
+func parseBroadInfo(raw json.RawMessage) (*domain.BroadInfo, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var description string
+	if err := json.Unmarshal(raw, &description); err == nil {
+		return &domain.BroadInfo{Description: description}, nil
+	}
+
+	broadInfo := &domain.BroadInfo{}
+	err := json.Unmarshal(raw, broadInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal broadInfo: %v", err)
+	}
+
+	return broadInfo, nil
+}
@@ -1,8 +1,15 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
 )
 
 func Test_convertToValidColorDepth(t *testing.T) {
@@ -50,3 +57,258 @@ func Test_convertToValidColorDepth(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseBroadInfo(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected *domain.BroadInfo
+		error    bool
+	}{
+		{raw: ``},
+		{raw: `null`},
+		{raw: `"Card range moving to 2.2.0"`, expected: &domain.BroadInfo{Description: "Card range moving to 2.2.0"}},
+		{
+			raw: `{"category":"01","description":"Scheduled maintenance","expirationDate":"20301231","recipients":["01","02"],"source":"DS"}`,
+			expected: &domain.BroadInfo{
+				Category:       "01",
+				Description:    "Scheduled maintenance",
+				ExpirationDate: "20301231",
+				Recipients:     []string{"01", "02"},
+				Source:         "DS",
+			},
+		},
+		{raw: `[1, 2]`, error: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("parseBroadInfo(%s)", tt.raw), func(t *testing.T) {
+			actual, err := parseBroadInfo(json.RawMessage(tt.raw))
+			if err != nil {
+				if tt.error {
+					return
+				}
+				t.Fatalf("expected nil error, actual: %v", err)
+			}
+
+			if tt.error {
+				t.Fatal("expected non nil error")
+			}
+
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected: %+v, actual: %+v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandler_Authenticate_binding(t *testing.T) {
+	const cardA, cardB = "4000000000001000", "4000000000001091"
+
+	versionRequests, authenticateRequests := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case domain.RavelinThreeDSVersionEndpoint:
+			versionRequests++
+			fmt.Fprintf(w, `{"status":200,"data":{"threeDSServerTransID":"tx-%d","versionRecommendation":"2.2.0"}}`, versionRequests)
+		case domain.RavelinThreeDSAuthenticateEndpoint:
+			authenticateRequests++
+			_, _ = w.Write([]byte(`{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":"tx-1","transStatus":"Y"}}`))
+		}
+	}))
+	defer server.Close()
+
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		CardVault:               testCardVault(t),
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	checkout := func(pan string) string {
+		w := httptest.NewRecorder()
+		h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"`+pan+`"}`)))
+		rsp := domain.MerchantCheckoutResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		return rsp.CardToken
+	}
+	tokenA := checkout(cardA) // tx-1
+	tokenB := checkout(cardB) // tx-2
+
+	// tokens issued directly by the vault stand in for an attacker who can obtain a valid token
+	// for a card of their choosing, so that the transaction's own checks are exercised
+	switchedCard, _ := h.CardVault.Tokenise(cardB, "tx-1")
+	unknownTransaction, _ := h.CardVault.Tokenise(cardA, "tx-unknown")
+
+	// the cases run in order, as authenticating a transaction changes which requests are accepted
+	tests := []struct {
+		name                 string
+		threeDSServerTransID string
+		cardToken            string
+		messageVersion       string
+		wantStatus           int
+		wantCode             string
+	}{
+		{
+			name:                 "token from another checkout",
+			threeDSServerTransID: "tx-1",
+			cardToken:            tokenB,
+			wantStatus:           http.StatusBadRequest,
+			wantCode:             merchantErrorCodeInvalidCardToken,
+		},
+		{
+			name:                 "card switched after checkout",
+			threeDSServerTransID: "tx-1",
+			cardToken:            switchedCard,
+			wantStatus:           http.StatusConflict,
+			wantCode:             merchantErrorCodeCardMismatch,
+		},
+		{
+			name:                 "message version switched after checkout",
+			threeDSServerTransID: "tx-1",
+			cardToken:            tokenA,
+			messageVersion:       "2.1.0",
+			wantStatus:           http.StatusConflict,
+			wantCode:             merchantErrorCodeMessageVersionMismatch,
+		},
+		{
+			name:                 "unknown transaction",
+			threeDSServerTransID: "tx-unknown",
+			cardToken:            unknownTransaction,
+			wantStatus:           http.StatusNotFound,
+			wantCode:             merchantErrorCodeTransactionNotFound,
+		},
+		{
+			name:                 "matching checkout",
+			threeDSServerTransID: "tx-1",
+			cardToken:            tokenA,
+			messageVersion:       "2.2.0",
+			wantStatus:           http.StatusOK,
+		},
+		{
+			name:                 "replay",
+			threeDSServerTransID: "tx-1",
+			cardToken:            tokenA,
+			wantStatus:           http.StatusConflict,
+			wantCode:             merchantErrorCodeAlreadyAuthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(domain.MerchantAuthenticateRequest{
+				ThreeDSServerTransID: tt.threeDSServerTransID,
+				CardToken:            tt.cardToken,
+				MessageVersion:       tt.messageVersion,
+				ProductSKU:           "10001",
+				ProductQuantity:      1,
+				BrowserData:          &domain.BrowserData{BrowserUserAgent: "Mozilla/5.0"},
+			})
+			w := httptest.NewRecorder()
+			h.Authenticate(w, httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(string(body))))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+
+			rsp := domain.MerchantErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.ErrorCode != tt.wantCode {
+				t.Errorf("expected: %s, actual: %s", tt.wantCode, rsp.ErrorCode)
+			}
+		})
+	}
+
+	if authenticateRequests != 1 {
+		t.Errorf("expected: %d, actual: %d", 1, authenticateRequests)
+	}
+}
+
+func TestHandler_Authenticate_retry(t *testing.T) {
+	tests := []struct {
+		name string
+		// unreachable sends the first authenticate request to an address which refuses connections
+		unreachable  bool
+		wantStatuses []int
+		wantRequests int
+	}{
+		{
+			name:         "not sent",
+			unreachable:  true,
+			wantStatuses: []int{http.StatusInternalServerError, http.StatusOK, http.StatusConflict},
+			wantRequests: 1,
+		},
+		{
+			name:         "error response",
+			wantStatuses: []int{http.StatusServiceUnavailable, http.StatusConflict},
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticateRequests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case domain.RavelinThreeDSVersionEndpoint:
+					_, _ = w.Write([]byte(`{"status":200,"data":{"threeDSServerTransID":"tx-1","versionRecommendation":"2.2.0"}}`))
+				case domain.RavelinThreeDSAuthenticateEndpoint:
+					authenticateRequests++
+					if !tt.unreachable && authenticateRequests == 1 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					_, _ = w.Write([]byte(`{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":"tx-1","transStatus":"Y"}}`))
+				}
+			}))
+			defer server.Close()
+
+			h := Handler{
+				RavelinApiUrl:           server.URL,
+				RavelinApiKeys:          testApiKeys(t),
+				CardVault:               testCardVault(t),
+				ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+			}
+
+			w := httptest.NewRecorder()
+			h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"4000000000001000"}`)))
+			checkoutResponse := domain.MerchantCheckoutResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &checkoutResponse); err != nil {
+				t.Fatal(err)
+			}
+
+			body, _ := json.Marshal(domain.MerchantAuthenticateRequest{
+				ThreeDSServerTransID: "tx-1",
+				CardToken:            checkoutResponse.CardToken,
+				ProductSKU:           "10001",
+				ProductQuantity:      1,
+				BrowserData:          &domain.BrowserData{BrowserUserAgent: "Mozilla/5.0"},
+			})
+
+			// only a request which never reached Ravelin leaves the transaction free to be authenticated
+			// by the customer's retry, as any other may have started an authentication
+			for i, wantStatus := range tt.wantStatuses {
+				attempt := h
+				if tt.unreachable && i == 0 {
+					attempt.RavelinApiUrl = "http://127.0.0.1:1"
+				}
+
+				w := httptest.NewRecorder()
+				attempt.Authenticate(w, httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(string(body))))
+				if w.Code != wantStatus {
+					t.Fatalf("expected: %d, actual: %d", wantStatus, w.Code)
+				}
+			}
+
+			if authenticateRequests != tt.wantRequests {
+				t.Errorf("expected: %d, actual: %d", tt.wantRequests, authenticateRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+// Limits on browser data elements. For more detail see the EMVCo 3DS Protocol and Core Functions
+// Specification, Table A.1.
+const (
+	maxBrowserHeaderLength = 2048
+	maxBrowserScreenSize   = 999999
+	minBrowserTZ           = -840
+	maxBrowserTZ           = 720
+)
+
+const messageVersion210 = "2.1.0"
+
+// normaliseBrowserData validates the browser data sent by the front-end, and combines it with what
+// the request itself shows about the browser. The headers of the request are preferred to values
+// reported by JavaScript, as they are exactly what the browser sends to the ACS.
+func normaliseBrowserData(r *http.Request, data domain.BrowserData) (domain.BrowserData, error) {
+	data.BrowserAcceptHeader = truncate(r.Header.Get("Accept"), maxBrowserHeaderLength)
+
+	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
+		data.BrowserUserAgent = userAgent
+	}
+	data.BrowserUserAgent = truncate(data.BrowserUserAgent, maxBrowserHeaderLength)
+	if data.BrowserUserAgent == "" {
+		return data, invalidRequest("browserData.browserUserAgent is required")
+	}
+
+	data.BrowserLanguage = normaliseBrowserLanguage(data.BrowserLanguage)
+	if data.BrowserLanguage == "" {
+		data.BrowserLanguage = normaliseBrowserLanguage(r.Header.Get("Accept-Language"))
+	}
+
+	if !data.BrowserJavascriptEnabled {
+		// nothing else can be known about a browser without JavaScript
+		data.BrowserJavaEnabled = false
+		data.BrowserColorDepth = 0
+		data.BrowserScreenHeight = 0
+		data.BrowserScreenWidth = 0
+		data.BrowserTZ = 0
+		return data, nil
+	}
+
+	if data.BrowserLanguage == "" {
+		return data, invalidRequest("browserData.browserLanguage is required")
+	}
+
+	colorDepth, err := convertToValidColorDepth(data.BrowserColorDepth)
+	if err != nil {
+		return data, invalidRequest("browserData.browserColorDepth is invalid: %v", err)
+	}
+	data.BrowserColorDepth = colorDepth
+
+	if data.BrowserScreenHeight <= 0 || data.BrowserScreenHeight > maxBrowserScreenSize {
+		return data, invalidRequest("browserData.browserScreenHeight must be between 1 and %d", maxBrowserScreenSize)
+	}
+	if data.BrowserScreenWidth <= 0 || data.BrowserScreenWidth > maxBrowserScreenSize {
+		return data, invalidRequest("browserData.browserScreenWidth must be between 1 and %d", maxBrowserScreenSize)
+	}
+	if data.BrowserTZ < minBrowserTZ || data.BrowserTZ > maxBrowserTZ {
+		return data, invalidRequest("browserData.browserTZ must be between %d and %d", minBrowserTZ, maxBrowserTZ)
+	}
+
+	return data, nil
+}
+
+// normaliseBrowserLanguage converts a language tag, as reported by navigator.language or the
+// Accept-Language header, into the form sent as browserLanguage. The tag is reduced to its
+// language and region, such as "en-GB", to fit within 8 characters. An empty string is
+// returned if the tag is not valid.
+func normaliseBrowserLanguage(language string) string {
+	// Accept-Language lists several tags with quality values, of which the first is preferred
+	if i := strings.IndexAny(language, ",;"); i >= 0 {
+		language = language[:i]
+	}
+
+	subtags := strings.Split(strings.ReplaceAll(strings.TrimSpace(language), "_", "-"), "-")
+	primary := strings.ToLower(subtags[0])
+	if len(primary) < 2 || len(primary) > 3 || !isASCIILetters(primary) {
+		return ""
+	}
+
+	for _, subtag := range subtags[1:] {
+		// the region is either two letters or a three digit UN M.49 code, such as es-419
+		if len(subtag) == 2 && isASCIILetters(subtag) {
+			return primary + "-" + strings.ToUpper(subtag)
+		}
+		if len(subtag) == 3 && strings.Trim(subtag, "0123456789") == "" {
+			return primary + "-" + subtag
+		}
+	}
+
+	return primary
+}
+
+func isASCIILetters(s string) bool {
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func truncate(s string, maxLength int) string {
+	if len(s) > maxLength {
+		return s[:maxLength]
+	}
+	return s
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestNormaliseBrowserData(t *testing.T) {
+	valid := domain.BrowserData{
+		BrowserJavascriptEnabled: true,
+		BrowserJavaEnabled:       true,
+		BrowserLanguage:          "en-GB",
+		BrowserColorDepth:        30,
+		BrowserScreenHeight:      1080,
+		BrowserScreenWidth:       1920,
+		BrowserTZ:                -60,
+		BrowserUserAgent:         "Mozilla/5.0 (reported)",
+	}
+
+	tests := []struct {
+		name           string
+		data           func(d *domain.BrowserData)
+		userAgent      string
+		acceptLanguage string
+		want           func(d *domain.BrowserData)
+		wantErr        bool
+	}{
+		{
+			name: "valid",
+			want: func(d *domain.BrowserData) { d.BrowserColorDepth = 24 },
+		},
+		{
+			name:      "user agent header preferred",
+			userAgent: "Mozilla/5.0 (header)",
+			want: func(d *domain.BrowserData) {
+				d.BrowserColorDepth = 24
+				d.BrowserUserAgent = "Mozilla/5.0 (header)"
+			},
+		},
+		{
+			name:    "no user agent",
+			data:    func(d *domain.BrowserData) { d.BrowserUserAgent = "" },
+			wantErr: true,
+		},
+		{
+			name:           "language from header",
+			data:           func(d *domain.BrowserData) { d.BrowserLanguage = "" },
+			acceptLanguage: "fr-CA,fr;q=0.9",
+			want: func(d *domain.BrowserData) {
+				d.BrowserColorDepth = 24
+				d.BrowserLanguage = "fr-CA"
+			},
+		},
+		{
+			name:    "no language",
+			data:    func(d *domain.BrowserData) { d.BrowserLanguage = "" },
+			wantErr: true,
+		},
+		{
+			name:    "invalid color depth",
+			data:    func(d *domain.BrowserData) { d.BrowserColorDepth = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "invalid screen height",
+			data:    func(d *domain.BrowserData) { d.BrowserScreenHeight = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "invalid screen width",
+			data:    func(d *domain.BrowserData) { d.BrowserScreenWidth = 1000000 },
+			wantErr: true,
+		},
+		{
+			name:    "invalid time zone",
+			data:    func(d *domain.BrowserData) { d.BrowserTZ = 900 },
+			wantErr: true,
+		},
+		{
+			name: "javascript disabled",
+			data: func(d *domain.BrowserData) {
+				d.BrowserJavascriptEnabled = false
+				d.BrowserScreenHeight = 0
+			},
+			want: func(d *domain.BrowserData) {
+				d.BrowserJavascriptEnabled = false
+				d.BrowserJavaEnabled = false
+				d.BrowserColorDepth = 0
+				d.BrowserScreenHeight = 0
+				d.BrowserScreenWidth = 0
+				d.BrowserTZ = 0
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := valid
+			if tt.data != nil {
+				tt.data(&data)
+			}
+			r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, nil)
+			r.Header.Set("Accept", "text/html")
+			if tt.userAgent != "" {
+				r.Header.Set("User-Agent", tt.userAgent)
+			}
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			actual, err := normaliseBrowserData(r, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %v, actual: %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			want := valid
+			want.BrowserAcceptHeader = "text/html"
+			tt.want(&want)
+			if actual != want {
+				t.Errorf("expected: %+v, actual: %+v", want, actual)
+			}
+		})
+	}
+}
+
+func TestNormaliseBrowserLanguage(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{language: "en", want: "en"},
+		{language: "en-gb", want: "en-GB"},
+		{language: "en_GB", want: "en-GB"},
+		{language: "zh-Hant-TW", want: "zh-TW"},
+		{language: "es-419", want: "es-419"},
+		{language: "de-DE-1996", want: "de-DE"},
+		{language: "en-US,en;q=0.9", want: "en-US"},
+		{language: "", want: ""},
+		{language: "*", want: ""},
+		{language: "english", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			actual := normaliseBrowserLanguage(tt.language)
+			if actual != tt.want {
+				t.Errorf("expected: %s, actual: %s", tt.want, actual)
+			}
+		})
+	}
+}
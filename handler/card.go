@@ -0,0 +1,36 @@
+package handler
+
+import "strconv"
+
+// cardScheme returns the card scheme of a PAN based on its IIN range. This is only used to label
+// metrics, so an approximate mapping of the common ranges is sufficient.
+func cardScheme(pan string) string {
+	prefix := func(n int) int {
+		if len(pan) < n {
+			return -1
+		}
+		v, err := strconv.Atoi(pan[:n])
+		if err != nil {
+			return -1
+		}
+		return v
+	}
+
+	switch p1, p2, p3, p4 := prefix(1), prefix(2), prefix(3), prefix(4); {
+	case p1 == 4:
+		return "visa"
+	case p2 >= 51 && p2 <= 55, p4 >= 2221 && p4 <= 2720:
+		return "mastercard"
+	case p2 == 34, p2 == 37:
+		return "amex"
+	case p4 == 6011, p2 == 65, p3 >= 644 && p3 <= 649:
+		return "discover"
+	case p4 >= 3528 && p4 <= 3589:
+		return "jcb"
+	case p2 == 36, p2 == 38, p3 >= 300 && p3 <= 305:
+		return "diners"
+	case p2 == 62:
+		return "unionpay"
+	}
+	return "unknown"
+}
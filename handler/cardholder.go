@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+// Limits on cardholder data elements. For more detail see the EMVCo 3DS Protocol and Core Functions
+// Specification, Table A.1.
+const (
+	maxCardholderNameLength  = 45
+	maxEmailLength           = 254
+	maxPhoneCCLength         = 3
+	maxPhoneNumberLength     = 15
+	maxAddressLineLength     = 50
+	maxAddressCityLength     = 50
+	maxAddressStateLength    = 3
+	maxAddressPostCodeLength = 16
+	maxActivityCount         = 999
+)
+
+// Indicators sent in acctInfo and merchantRiskIndicator.
+const (
+	accountIndGuest           = "01"
+	shipIndicatorBilling      = "01"
+	shipIndicatorOnFile       = "02"
+	shipIndicatorOther        = "03"
+	shipIndicatorDigital      = "05"
+	deliveryTimeframeDigital  = "01"
+	deliveryTimeframeTwoDays  = "04"
+	preOrderPurchaseAvailable = "01"
+	reorderItemsFirstTime     = "01"
+	reorderItemsReordered     = "02"
+)
+
+const acctInfoDateFormat = "20060102"
+
+// normaliseCardholder validates the cardholder data sent by the front-end, trimming whitespace
+// and converting the phone number into the digits sent in the AReq.
+func normaliseCardholder(c domain.Cardholder) (domain.Cardholder, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	if utf8.RuneCountInString(c.Name) > maxCardholderNameLength {
+		return c, invalidRequest("cardholder.name must be at most %d characters", maxCardholderNameLength)
+	}
+
+	c.Email = strings.TrimSpace(c.Email)
+	if c.Email != "" {
+		address, err := mail.ParseAddress(c.Email)
+		if err != nil || address.Address != c.Email || len(c.Email) > maxEmailLength {
+			return c, invalidRequest("cardholder.email is not a valid email address")
+		}
+	}
+
+	if c.MobilePhone != nil {
+		phone := domain.Phone{
+			CountryCode: strings.TrimPrefix(stripPhoneFormatting(c.MobilePhone.CountryCode), "+"),
+			Number:      stripPhoneFormatting(c.MobilePhone.Number),
+		}
+		if !isDigits(phone.CountryCode) || len(phone.CountryCode) > maxPhoneCCLength {
+			return c, invalidRequest("cardholder.mobilePhone.countryCode must be 1 to %d digits", maxPhoneCCLength)
+		}
+		if !isDigits(phone.Number) || len(phone.Number) > maxPhoneNumberLength {
+			return c, invalidRequest("cardholder.mobilePhone.number must be 1 to %d digits", maxPhoneNumberLength)
+		}
+		c.MobilePhone = &phone
+	}
+
+	if c.BillingAddress != nil {
+		address, err := normaliseAddress("cardholder.billingAddress", *c.BillingAddress)
+		if err != nil {
+			return c, err
+		}
+		c.BillingAddress = &address
+	}
+
+	if c.ShippingAddress != nil {
+		address, err := normaliseAddress("cardholder.shippingAddress", *c.ShippingAddress)
+		if err != nil {
+			return c, err
+		}
+		c.ShippingAddress = &address
+	}
+
+	return c, nil
+}
+
+// normaliseAddress validates an address. The first line, city and country are required.
+func normaliseAddress(field string, a domain.Address) (domain.Address, error) {
+	a = domain.Address{
+		Line1:    strings.TrimSpace(a.Line1),
+		Line2:    strings.TrimSpace(a.Line2),
+		Line3:    strings.TrimSpace(a.Line3),
+		City:     strings.TrimSpace(a.City),
+		State:    strings.ToUpper(strings.TrimSpace(a.State)),
+		PostCode: strings.ToUpper(strings.TrimSpace(a.PostCode)),
+		Country:  strings.ToUpper(strings.TrimSpace(a.Country)),
+	}
+
+	if a.Line1 == "" {
+		return a, invalidRequest("%s.line1 is required", field)
+	}
+	if a.City == "" {
+		return a, invalidRequest("%s.city is required", field)
+	}
+	for i, line := range []string{a.Line1, a.Line2, a.Line3} {
+		if utf8.RuneCountInString(line) > maxAddressLineLength {
+			return a, invalidRequest("%s.line%d must be at most %d characters", field, i+1, maxAddressLineLength)
+		}
+	}
+	if utf8.RuneCountInString(a.City) > maxAddressCityLength {
+		return a, invalidRequest("%s.city must be at most %d characters", field, maxAddressCityLength)
+	}
+	if len(a.State) > maxAddressStateLength || !isAlphanumeric(a.State) {
+		return a, invalidRequest("%s.state must be an ISO 3166-2 subdivision code of at most %d characters", field, maxAddressStateLength)
+	}
+	if utf8.RuneCountInString(a.PostCode) > maxAddressPostCodeLength {
+		return a, invalidRequest("%s.postCode must be at most %d characters", field, maxAddressPostCodeLength)
+	}
+	if _, ok := countryNumericCode(a.Country); !ok {
+		return a, invalidRequest("%s.country must be an ISO 3166-1 alpha-2 country code", field)
+	}
+
+	return a, nil
+}
+
+// setCardholderData adds the cardholder's details to the AReq. The cardholder must already have
+// been validated by normaliseCardholder.
+func setCardholderData(areqData *domain.AReqData, c domain.Cardholder) {
+	areqData.CardholderName = c.Name
+	areqData.Email = c.Email
+
+	if c.MobilePhone != nil {
+		areqData.MobilePhone = &domain.PhoneNumber{CC: c.MobilePhone.CountryCode, Subscriber: c.MobilePhone.Number}
+	}
+
+	if a := c.BillingAddress; a != nil {
+		areqData.BillAddrLine1 = a.Line1
+		areqData.BillAddrLine2 = a.Line2
+		areqData.BillAddrLine3 = a.Line3
+		areqData.BillAddrCity = a.City
+		areqData.BillAddrState = a.State
+		areqData.BillAddrPostCode = a.PostCode
+		areqData.BillAddrCountry, _ = countryNumericCode(a.Country)
+	}
+
+	if a := c.ShippingAddress; a != nil {
+		areqData.ShipAddrLine1 = a.Line1
+		areqData.ShipAddrLine2 = a.Line2
+		areqData.ShipAddrLine3 = a.Line3
+		areqData.ShipAddrCity = a.City
+		areqData.ShipAddrState = a.State
+		areqData.ShipAddrPostCode = a.PostCode
+		areqData.ShipAddrCountry, _ = countryNumericCode(a.Country)
+	}
+
+	if c.BillingAddress != nil && c.ShippingAddress != nil {
+		areqData.AddrMatch = "N"
+		if addressKey(c.BillingAddress) == addressKey(c.ShippingAddress) {
+			areqData.AddrMatch = "Y"
+		}
+	}
+}
+
+// accountInfo compares the visit with the customer's history before it. For more detail of each
+// indicator see the EMVCo 3DS Protocol and Core Functions Specification, Table A.1.
+func accountInfo(previous customer.Customer, visit customer.Visit, now time.Time) *domain.AcctInfo {
+	if !previous.HasAccount() {
+		// the account was created by this transaction, so everything about it is new
+		info := &domain.AcctInfo{
+			ChAccAgeInd:          "02",
+			ChAccDate:            now.Format(acctInfoDateFormat),
+			ChAccChange:          now.Format(acctInfoDateFormat),
+			ChAccChangeInd:       "01",
+			TxnActivityDay:       "0",
+			TxnActivityYear:      "0",
+			ProvisionAttemptsDay: "0",
+			PaymentAccAge:        now.Format(acctInfoDateFormat),
+			PaymentAccInd:        "02",
+		}
+		if visit.ShippingAddress != "" {
+			info.ShipAddressUsage = now.Format(acctInfoDateFormat)
+			info.ShipAddressUsageInd = "01"
+		}
+		return info
+	}
+
+	info := &domain.AcctInfo{
+		ChAccAgeInd:    ageIndicator(3, previous.CreatedAt, now),
+		ChAccDate:      previous.CreatedAt.Format(acctInfoDateFormat),
+		ChAccChange:    previous.ChangedAt.Format(acctInfoDateFormat),
+		ChAccChangeInd: ageIndicator(2, previous.ChangedAt, now),
+	}
+	if previous.Email != visit.Email || previous.Name != visit.Name || previous.BillingAddress != visit.BillingAddress {
+		info.ChAccChange = now.Format(acctInfoDateFormat)
+		info.ChAccChangeInd = "01"
+	}
+
+	if visit.ShippingAddress != "" {
+		info.ShipAddressUsage = now.Format(acctInfoDateFormat)
+		info.ShipAddressUsageInd = "01"
+		if usage, ok := previous.ShippingAddresses[visit.ShippingAddress]; ok {
+			info.ShipAddressUsage = usage.FirstUsed.Format(acctInfoDateFormat)
+			info.ShipAddressUsageInd = ageIndicator(2, usage.FirstUsed, now)
+		}
+	}
+
+	var day, year int
+	for _, t := range previous.Transactions {
+		if now.Sub(t.At) < 24*time.Hour {
+			day++
+		}
+		if now.Sub(t.At) < 365*24*time.Hour {
+			year++
+		}
+	}
+	info.TxnActivityDay = activityCount(day)
+	info.TxnActivityYear = activityCount(year)
+
+	var provisioned int
+	for _, usage := range previous.Cards {
+		if now.Sub(usage.FirstUsed) < 24*time.Hour {
+			provisioned++
+		}
+	}
+	info.ProvisionAttemptsDay = activityCount(provisioned)
+
+	info.PaymentAccAge = now.Format(acctInfoDateFormat)
+	info.PaymentAccInd = "02"
+	if usage, ok := previous.Cards[visit.CardFingerprint]; ok {
+		info.PaymentAccAge = usage.FirstUsed.Format(acctInfoDateFormat)
+		info.PaymentAccInd = ageIndicator(3, usage.FirstUsed, now)
+	}
+
+	return info
+}
+
+// merchantRiskIndicator describes the purchase, comparing the visit with the customer's history
+// before it. Purchases without a shipping address are delivered electronically.
+func merchantRiskIndicator(previous customer.Customer, visit customer.Visit) *domain.MerchantRiskIndicator {
+	indicator := &domain.MerchantRiskIndicator{
+		ShipIndicator:       shipIndicatorDigital,
+		DeliveryTimeframe:   deliveryTimeframeDigital,
+		PreOrderPurchaseInd: preOrderPurchaseAvailable,
+		ReorderItemsInd:     reorderItemsFirstTime,
+	}
+
+	if visit.ShippingAddress != "" {
+		indicator.DeliveryTimeframe = deliveryTimeframeTwoDays
+		switch _, onFile := previous.ShippingAddresses[visit.ShippingAddress]; {
+		case visit.ShippingAddress == visit.BillingAddress:
+			indicator.ShipIndicator = shipIndicatorBilling
+		case onFile:
+			indicator.ShipIndicator = shipIndicatorOnFile
+		default:
+			indicator.ShipIndicator = shipIndicatorOther
+		}
+	}
+
+	for _, t := range previous.Transactions {
+		if t.ProductSKU == visit.ProductSKU {
+			indicator.ReorderItemsInd = reorderItemsReordered
+			break
+		}
+	}
+
+	return indicator
+}
+
+// ageIndicator returns the indicator for how long ago t was, where first is the indicator for
+// less than 30 days, followed by 30 to 60 days and more than 60 days.
+func ageIndicator(first int, t time.Time, now time.Time) string {
+	days := int(now.Sub(t).Hours() / 24)
+	switch {
+	case days < 30:
+		return fmt.Sprintf("%02d", first)
+	case days <= 60:
+		return fmt.Sprintf("%02d", first+1)
+	}
+	return fmt.Sprintf("%02d", first+2)
+}
+
+func activityCount(n int) string {
+	if n > maxActivityCount {
+		n = maxActivityCount
+	}
+	return strconv.Itoa(n)
+}
+
+// addressKey identifies an address regardless of case, for comparing addresses. An empty string
+// is returned for a nil address.
+func addressKey(a *domain.Address) string {
+	if a == nil {
+		return ""
+	}
+	return strings.ToLower(strings.Join([]string{a.Line1, a.Line2, a.Line3, a.City, a.State, a.PostCode, a.Country}, "|"))
+}
+
+func stripPhoneFormatting(number string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(strings.TrimSpace(number))
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func isAlphanumeric(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestNormaliseCardholder(t *testing.T) {
+	tests := []struct {
+		name       string
+		cardholder domain.Cardholder
+		want       domain.Cardholder
+		wantErr    string
+	}{
+		{
+			name: "valid",
+			cardholder: domain.Cardholder{
+				Name:           " Jane Smith ",
+				Email:          "jane.smith@example.com",
+				MobilePhone:    &domain.Phone{CountryCode: "+44", Number: "(0)7700 900-123"},
+				BillingAddress: &domain.Address{Line1: "1 Example Street", City: "London", PostCode: "ec1a 1bb", Country: "gb"},
+			},
+			want: domain.Cardholder{
+				Name:           "Jane Smith",
+				Email:          "jane.smith@example.com",
+				MobilePhone:    &domain.Phone{CountryCode: "44", Number: "07700900123"},
+				BillingAddress: &domain.Address{Line1: "1 Example Street", City: "London", PostCode: "EC1A 1BB", Country: "GB"},
+			},
+		},
+		{
+			name:       "guest",
+			cardholder: domain.Cardholder{},
+			want:       domain.Cardholder{},
+		},
+		{
+			name:       "name too long",
+			cardholder: domain.Cardholder{Name: strings.Repeat("a", 46)},
+			wantErr:    "cardholder.name must be at most 45 characters",
+		},
+		{
+			name:       "invalid email",
+			cardholder: domain.Cardholder{Email: "Jane <jane.smith@example.com>"},
+			wantErr:    "cardholder.email is not a valid email address",
+		},
+		{
+			name:       "invalid phone number",
+			cardholder: domain.Cardholder{MobilePhone: &domain.Phone{CountryCode: "44", Number: "call me"}},
+			wantErr:    "cardholder.mobilePhone.number must be 1 to 15 digits",
+		},
+		{
+			name:       "missing city",
+			cardholder: domain.Cardholder{BillingAddress: &domain.Address{Line1: "1 Example Street", Country: "GB"}},
+			wantErr:    "cardholder.billingAddress.city is required",
+		},
+		{
+			name:       "line too long",
+			cardholder: domain.Cardholder{ShippingAddress: &domain.Address{Line1: "1 Example Street", Line2: strings.Repeat("a", 51), City: "London", Country: "GB"}},
+			wantErr:    "cardholder.shippingAddress.line2 must be at most 50 characters",
+		},
+		{
+			name:       "invalid state",
+			cardholder: domain.Cardholder{BillingAddress: &domain.Address{Line1: "1 Example Street", City: "Austin", State: "Texas", Country: "US"}},
+			wantErr:    "cardholder.billingAddress.state must be an ISO 3166-2 subdivision code of at most 3 characters",
+		},
+		{
+			name:       "unknown country",
+			cardholder: domain.Cardholder{BillingAddress: &domain.Address{Line1: "1 Example Street", City: "London", Country: "UK"}},
+			wantErr:    "cardholder.billingAddress.country must be an ISO 3166-1 alpha-2 country code",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := normaliseCardholder(tt.cardholder)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected: %s, actual: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tt.want) {
+				t.Errorf("expected: %+v, actual: %+v", tt.want, actual)
+			}
+		})
+	}
+}
+
+func TestSetCardholderData(t *testing.T) {
+	billing := &domain.Address{Line1: "1 Example Street", City: "London", PostCode: "EC1A 1BB", Country: "GB"}
+	shipping := &domain.Address{Line1: "1 Example Avenue", City: "New York", State: "NY", PostCode: "10001", Country: "US"}
+
+	areqData := domain.AReqData{}
+	setCardholderData(&areqData, domain.Cardholder{BillingAddress: billing, ShippingAddress: shipping})
+
+	if areqData.BillAddrCountry != "826" || areqData.ShipAddrCountry != "840" {
+		t.Errorf("expected: 826 and 840, actual: %s and %s", areqData.BillAddrCountry, areqData.ShipAddrCountry)
+	}
+	if areqData.ShipAddrState != "NY" {
+		t.Errorf("expected: %s, actual: %s", "NY", areqData.ShipAddrState)
+	}
+	if areqData.AddrMatch != "N" {
+		t.Errorf("expected: %s, actual: %s", "N", areqData.AddrMatch)
+	}
+
+	setCardholderData(&areqData, domain.Cardholder{BillingAddress: billing, ShippingAddress: billing})
+	if areqData.AddrMatch != "Y" {
+		t.Errorf("expected: %s, actual: %s", "Y", areqData.AddrMatch)
+	}
+}
+
+func TestAccountInfo(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+
+	previous := customer.Customer{
+		CreatedAt:         daysAgo(90),
+		ChangedAt:         daysAgo(45),
+		Email:             "jane.smith@example.com",
+		Name:              "Jane Smith",
+		BillingAddress:    "billing",
+		ShippingAddresses: map[string]customer.Usage{"billing": {FirstUsed: daysAgo(90), LastUsed: daysAgo(2)}, "work": {FirstUsed: daysAgo(10), LastUsed: daysAgo(10)}},
+		Cards:             map[string]customer.Usage{"card-1": {FirstUsed: daysAgo(90), LastUsed: daysAgo(2)}, "card-2": {FirstUsed: now.Add(-time.Hour), LastUsed: now.Add(-time.Hour)}},
+		Transactions:      []customer.Transaction{{At: daysAgo(90)}, {At: daysAgo(2)}, {At: now.Add(-time.Hour)}},
+	}
+	visit := customer.Visit{Email: "jane.smith@example.com", Name: "Jane Smith", BillingAddress: "billing", ShippingAddress: "work", CardFingerprint: "card-1"}
+
+	tests := []struct {
+		name     string
+		previous customer.Customer
+		visit    func(v *customer.Visit)
+		want     domain.AcctInfo
+	}{
+		{
+			name:     "returning customer",
+			previous: previous,
+			want: domain.AcctInfo{
+				ChAccAgeInd:          "05",
+				ChAccDate:            "20211201",
+				ChAccChange:          "20220115",
+				ChAccChangeInd:       "03",
+				ShipAddressUsage:     "20220219",
+				ShipAddressUsageInd:  "02",
+				TxnActivityDay:       "1",
+				TxnActivityYear:      "3",
+				ProvisionAttemptsDay: "1",
+				PaymentAccAge:        "20211201",
+				PaymentAccInd:        "05",
+			},
+		},
+		{
+			name:     "details changed",
+			previous: previous,
+			visit: func(v *customer.Visit) {
+				v.BillingAddress = "new"
+				v.ShippingAddress = "new"
+				v.CardFingerprint = "card-3"
+			},
+			want: domain.AcctInfo{
+				ChAccAgeInd:          "05",
+				ChAccDate:            "20211201",
+				ChAccChange:          "20220301",
+				ChAccChangeInd:       "01",
+				ShipAddressUsage:     "20220301",
+				ShipAddressUsageInd:  "01",
+				TxnActivityDay:       "1",
+				TxnActivityYear:      "3",
+				ProvisionAttemptsDay: "1",
+				PaymentAccAge:        "20220301",
+				PaymentAccInd:        "02",
+			},
+		},
+		{
+			name: "new customer",
+			want: domain.AcctInfo{
+				ChAccAgeInd:          "02",
+				ChAccDate:            "20220301",
+				ChAccChange:          "20220301",
+				ChAccChangeInd:       "01",
+				ShipAddressUsage:     "20220301",
+				ShipAddressUsageInd:  "01",
+				TxnActivityDay:       "0",
+				TxnActivityYear:      "0",
+				ProvisionAttemptsDay: "0",
+				PaymentAccAge:        "20220301",
+				PaymentAccInd:        "02",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := visit
+			if tt.visit != nil {
+				tt.visit(&v)
+			}
+
+			actual := accountInfo(tt.previous, v, now)
+			if *actual != tt.want {
+				t.Errorf("expected: %+v, actual: %+v", tt.want, *actual)
+			}
+		})
+	}
+}
+
+func TestMerchantRiskIndicator(t *testing.T) {
+	billing := &domain.Address{Line1: "1 Example Street", City: "London", Country: "GB"}
+	work := &domain.Address{Line1: "2 Example Street", City: "London", Country: "GB"}
+	other := &domain.Address{Line1: "3 Example Street", City: "London", Country: "GB"}
+	previous := customer.Customer{
+		ShippingAddresses: map[string]customer.Usage{addressKey(work): {FirstUsed: time.Now(), LastUsed: time.Now()}},
+		Transactions:      []customer.Transaction{{ProductSKU: "10001"}},
+	}
+
+	tests := []struct {
+		name  string
+		visit customer.Visit
+		want  domain.MerchantRiskIndicator
+	}{
+		{
+			name:  "digital goods",
+			visit: customer.Visit{ProductSKU: "10002"},
+			want:  domain.MerchantRiskIndicator{ShipIndicator: "05", DeliveryTimeframe: "01", PreOrderPurchaseInd: "01", ReorderItemsInd: "01"},
+		},
+		{
+			name:  "ship to billing address",
+			visit: customer.Visit{BillingAddress: addressKey(billing), ShippingAddress: addressKey(billing), ProductSKU: "10001"},
+			want:  domain.MerchantRiskIndicator{ShipIndicator: "01", DeliveryTimeframe: "04", PreOrderPurchaseInd: "01", ReorderItemsInd: "02"},
+		},
+		{
+			name:  "ship to address on file",
+			visit: customer.Visit{BillingAddress: addressKey(billing), ShippingAddress: addressKey(work), ProductSKU: "10002"},
+			want:  domain.MerchantRiskIndicator{ShipIndicator: "02", DeliveryTimeframe: "04", PreOrderPurchaseInd: "01", ReorderItemsInd: "01"},
+		},
+		{
+			name:  "ship to another address",
+			visit: customer.Visit{BillingAddress: addressKey(billing), ShippingAddress: addressKey(other), ProductSKU: "10002"},
+			want:  domain.MerchantRiskIndicator{ShipIndicator: "03", DeliveryTimeframe: "04", PreOrderPurchaseInd: "01", ReorderItemsInd: "01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := merchantRiskIndicator(previous, tt.visit)
+			if *actual != tt.want {
+				t.Errorf("expected: %+v, actual: %+v", tt.want, *actual)
+			}
+		})
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/unravelin/ravelin-3ds-demo/audit"
 	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
 )
 
 // ChallengeNotification is called by the customer's browser when the ACS has completed
@@ -26,34 +28,71 @@ func (h Handler) ChallengeNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Handling %s request", ChallengeNotificationEndpoint)
+	logger := logging.FromContext(r.Context())
+	logger.Info("Handling request", "endpoint", ChallengeNotificationEndpoint)
 
 	challengeResponse := &domain.ChallengeResponse{}
-	err := decodeFormData(r, "cres", challengeResponse)
+	err := h.decodeFormRequest(w, r, "cres", challengeResponse)
 	if err != nil {
-		log.Printf("failed to decode Challenge Response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to decode Challenge Response", "error", err)
+		respondRequestError(err, w)
+		return
+	}
+
+	logger = h.transactionLogger(logger, challengeResponse.ThreeDSServerTransID)
+
+	r, span := h.joinTransactionTrace(r, challengeResponse.ThreeDSServerTransID, "threeds.challenge_notification")
+	defer span.End()
+
+	logger.Info("Challenge response received", "transStatus", challengeResponse.TransStatus)
+	h.audit(r, challengeResponse.ThreeDSServerTransID, audit.MessageChallengeResponse, challengeResponse)
+
+	sessionData, err := getFormVar(r, "threeDSSessionData")
+	if err == nil {
+		err = h.verifySessionData(r, sessionData, challengeResponse.ThreeDSServerTransID)
+	}
+	if err != nil {
+		logger.Warn("rejecting challenge notification", "error", err)
+		w.WriteHeader(http.StatusForbidden)
+		h.writeChallengeNotificationResponse(w, r, ChallengeNotificationResult{
+			Status:    "FAILED",
+			ErrorCode: merchantErrorCodeInvalidSessionData,
+		})
 		return
 	}
 
-	log.Printf("/challenge-notification transStatus = %s", challengeResponse.TransStatus)
+	tx, ok := h.ThreeDSTransactionStore.Get(challengeResponse.ThreeDSServerTransID)
+	if ok && tx.Result != nil {
+		// the result has already been received in a Results Request, so there is no need to call /3ds/result
+		logger.Info("Result already recorded", "resultSource", tx.Result.Source)
+		h.writeChallengeNotificationResponse(w, r, newChallengeNotificationResult(*tx.Result))
+		return
+	}
 
 	resultRequest := &domain.RavelinResultRequest{
 		ThreeDSServerTransID: challengeResponse.ThreeDSServerTransID,
 	}
 
-	log.Printf("Making Ravelin /3ds/result request for threeDSServerTransID %s", challengeResponse.ThreeDSServerTransID)
+	logger.Info("Making Ravelin /3ds/result request")
+	h.audit(r, challengeResponse.ThreeDSServerTransID, audit.MessageResultRequest, resultRequest)
 
-	rsp, err := h.sendToRavelin3DSServer(http.MethodPost, resultRequest, domain.RavelinThreeDSResultEndpoint)
+	rsp, err := h.sendToRavelin3DSServer(r.Context(), http.MethodPost, resultRequest, domain.RavelinThreeDSResultEndpoint)
 	if err != nil {
-		log.Printf("failed to send Result Request to ravelin threeds server: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Error("failed to send Result Request to ravelin threeds server", "error", err)
+		h.auditFailure(r, challengeResponse.ThreeDSServerTransID, domain.RavelinThreeDSResultEndpoint, err)
+		status, errorResponse := merchantError(err)
+		w.WriteHeader(status)
+		h.writeChallengeNotificationResponse(w, r, ChallengeNotificationResult{
+			Status:    "FAILED",
+			ErrorCode: errorResponse.ErrorCode,
+		})
 		return
 	}
 
 	body, err := readBody(rsp.Body)
 	if err != nil {
-		log.Printf("failed to read 3ds server response: %v", err)
+		logger.Error("failed to read 3ds server response", "error", err)
+		h.auditFailure(r, challengeResponse.ThreeDSServerTransID, domain.RavelinThreeDSResultEndpoint, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -61,43 +100,85 @@ func (h Handler) ChallengeNotification(w http.ResponseWriter, r *http.Request) {
 	resultResponse := &domain.RavelinResultResponse{}
 	err = json.Unmarshal(body, resultResponse)
 	if err != nil {
-		log.Printf("failed to read 3ds server response: %v", err)
+		logger.Error("failed to read 3ds server response", "error", err)
+		h.auditFailure(r, challengeResponse.ThreeDSServerTransID, domain.RavelinThreeDSResultEndpoint, err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	log.Printf("Ravelin /3ds/result response received. transStatus = %s", resultResponse.Data.TransStatus)
+	h.audit(r, challengeResponse.ThreeDSServerTransID, audit.MessageResultResponse, resultResponse)
 
-	var result string
-	if resultResponse != nil && resultResponse.Data != nil &&
-		(resultResponse.Data.TransStatus == "Y" || resultResponse.Data.TransStatus == "A") &&
-		resultResponse.Data.AuthenticationValue != "" {
-		result = "SUCCESS"
-	} else {
-		result = "FAILED"
+	if resultResponse.Data == nil {
+		logger.Error("no data in 3ds server result response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	err = h.ChallengeNotificationResponseTemplate.Execute(w, result)
+	logger.Info("Ravelin /3ds/result response received",
+		"transStatus", resultResponse.Data.TransStatus,
+		"transStatusReason", resultResponse.Data.TransStatusReason,
+		"eci", resultResponse.Data.ECI)
+
+	result := ThreeDSResult{
+		TransStatus:         resultResponse.Data.TransStatus,
+		TransStatusReason:   resultResponse.Data.TransStatusReason,
+		ECI:                 resultResponse.Data.ECI,
+		AuthenticationValue: resultResponse.Data.AuthenticationValue,
+		Source:              ResultSourceChallengeNotification,
+		ReceivedAt:          time.Now().UTC(),
+	}
+
+	recorded, updated, err := h.ThreeDSTransactionStore.SetResult(challengeResponse.ThreeDSServerTransID, result)
 	if err != nil {
-		log.Printf("failed to write web challenge notification response - %s", err)
+		logger.Error("failed to set result", "error", err)
+	} else {
+		if updated {
+			h.recordChallengeResult(challengeResponse.ThreeDSServerTransID, recorded)
+		}
+		// a Results Request may have been recorded while /3ds/result was in flight
+		result = recorded
 	}
+
+	h.writeChallengeNotificationResponse(w, r, newChallengeNotificationResult(result))
 }
 
-// decodeFormData extracts a parameter from form data, and decodes it into a struct
-func decodeFormData(r *http.Request, paramName string, decodeToStruct interface{}) error {
-	paramValue, err := getFormVar(r, paramName)
+// ChallengeNotificationResult is the data passed to the challenge notification response template.
+type ChallengeNotificationResult struct {
+	Status    string
+	ErrorCode string
+	// TargetOrigin is the merchant origin the result is posted to.
+	TargetOrigin string
+	Nonce        string
+}
+
+func newChallengeNotificationResult(result ThreeDSResult) ChallengeNotificationResult {
+	if result.Successful() {
+		return ChallengeNotificationResult{Status: "SUCCESS"}
+	}
+	return ChallengeNotificationResult{Status: "FAILED"}
+}
+
+func (h Handler) writeChallengeNotificationResponse(w http.ResponseWriter, r *http.Request, result ChallengeNotificationResult) {
+	result.TargetOrigin = h.merchantOrigin()
+	result.Nonce = cspNonce(r.Context())
+	err := h.ChallengeNotificationResponseTemplate.Execute(w, result)
 	if err != nil {
-		return err
+		logging.FromContext(r.Context()).Error("failed to write web challenge notification response", "error", err)
 	}
+}
 
-	// URL decode string first
-	paramB64, err := url.QueryUnescape(paramValue)
+// decodeFormData extracts a parameter from form data, and decodes it into a struct.
+//
+// EMVCo specifies that the CRes and threeDSMethodData are base64url encoded without padding,
+// but in practice ACSs and browsers also send standard base64, with or without padding.
+// When strict is true only the EMVCo encoding is accepted.
+func decodeFormData(r *http.Request, paramName string, strict bool, decodeToStruct interface{}) error {
+	paramValue, err := getFormVar(r, paramName)
 	if err != nil {
-		return fmt.Errorf("failed to unescape url encoded %s: %v", paramName, err)
+		return err
 	}
 
-	// remove any padding
-	paramB64 = strings.ReplaceAll(paramB64, "=", "")
-	paramJSON, err := base64.RawStdEncoding.DecodeString(paramB64)
+	paramJSON, err := decodeBase64(paramValue, strict)
 	if err != nil {
 		return fmt.Errorf("failed to decode base64 %s: %v", paramName, err)
 	}
@@ -110,10 +191,40 @@ func decodeFormData(r *http.Request, paramName string, decodeToStruct interface{
 	return nil
 }
 
+// decodeBase64 decodes base64url or standard base64, with or without padding.
+// When strict is true only base64url without padding is accepted.
+func decodeBase64(value string, strict bool) ([]byte, error) {
+	if strict {
+		return base64.RawURLEncoding.Strict().DecodeString(value)
+	}
+
+	// the value may have been URL encoded twice
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unescape url encoded value: %v", err)
+	}
+
+	// map to the base64url alphabet, restoring any "+" that were unescaped to spaces,
+	// and drop padding and line breaks
+	normalised := strings.Map(func(r rune) rune {
+		switch r {
+		case '+', ' ':
+			return '-'
+		case '/':
+			return '_'
+		case '=', '\r', '\n', '\t':
+			return -1
+		}
+		return r
+	}, unescaped)
+
+	return base64.RawURLEncoding.DecodeString(normalised)
+}
+
 func getFormVar(r *http.Request, paramName string) (string, error) {
 	err := r.ParseForm()
 	if err != nil {
-		return "", fmt.Errorf("failed to parse form data - %s", err)
+		return "", fmt.Errorf("failed to parse form data - %w", err)
 	}
 
 	var paramValues []string
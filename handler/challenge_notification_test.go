@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+// cresSamples are examples of CRes and threeDSMethodData payloads. Several encode to base64
+// containing "+" and "/" (or "-" and "_" in base64url).
+var cresSamples = []string{
+	`{"threeDSServerTransID":"8a880dc0-d2d2-4067-bcb1-b08d1690b26e","acsTransID":"d7c1ee99-9478-44a6-b1f2-391e29c6b340","messageType":"CRes","messageVersion":"2.2.0","transStatus":"Y"}`,
+	`{"threeDSServerTransID":"3ac7caa7-aa42-4f22-a5c2-4b5c5c0f6b2e","acsTransID":"b1b3c2e4-1a2b-4c3d-8e9f-0a1b2c3d4e5f","challengeCompletionInd":"Y","messageType":"CRes","messageVersion":"2.1.0","transStatus":"N"}`,
+	`{"threeDSServerTransID":"f0e1d2c3-b4a5-4678-9abc-def012345678","acsTransID":"0f1e2d3c-4b5a-4697-8877-665544332211","messageExtension":{"note":"ÿ>?~"},"messageType":"CRes","messageVersion":"2.2.0","transStatus":"Y"}`,
+	`{"threeDSServerTransID":"3ac7caa7-aa42-4f22-a5c2-4b5c5c0f6b2e","threeDSMethodNotificationURL":"https://merchant.example/method-notification?a=1&b=>>>"}`,
+}
+
+func Test_decodeBase64(t *testing.T) {
+	encodings := []struct {
+		name      string
+		encoding  *base64.Encoding
+		strictOK  bool
+		urlEscape bool
+	}{
+		{name: "base64url unpadded", encoding: base64.RawURLEncoding, strictOK: true},
+		{name: "base64url padded", encoding: base64.URLEncoding},
+		{name: "standard unpadded", encoding: base64.RawStdEncoding},
+		{name: "standard padded", encoding: base64.StdEncoding},
+		{name: "standard padded url escaped", encoding: base64.StdEncoding, urlEscape: true},
+	}
+
+	sawURLAlphabet := false
+	for _, sample := range cresSamples {
+		if strings.ContainsAny(base64.RawURLEncoding.EncodeToString([]byte(sample)), "-_") {
+			sawURLAlphabet = true
+		}
+
+		for _, enc := range encodings {
+			encoded := enc.encoding.EncodeToString([]byte(sample))
+			if enc.urlEscape {
+				encoded = url.QueryEscape(encoded)
+			}
+
+			t.Run(enc.name, func(t *testing.T) {
+				decoded, err := decodeBase64(encoded, false)
+				if err != nil {
+					t.Fatalf("expected nil error, actual: %v", err)
+				}
+				if string(decoded) != sample {
+					t.Fatalf("expected: %s, actual: %s", sample, decoded)
+				}
+
+				_, err = decodeBase64(encoded, true)
+				if enc.strictOK && err != nil {
+					t.Fatalf("expected nil error in strict mode, actual: %v", err)
+				}
+				if !enc.strictOK && err == nil && encoded != base64.RawURLEncoding.EncodeToString([]byte(sample)) {
+					t.Fatal("expected non nil error in strict mode")
+				}
+			})
+		}
+	}
+
+	if !sawURLAlphabet {
+		t.Fatal("expected at least one sample to encode using the base64url alphabet")
+	}
+
+	// the "+" in standard base64 becomes a space if the value is URL decoded after form parsing
+	encoded := strings.ReplaceAll(base64.StdEncoding.EncodeToString([]byte(cresSamples[3])), "+", " ")
+	if decoded, err := decodeBase64(encoded, false); err != nil || string(decoded) != cresSamples[3] {
+		t.Fatalf("expected spaces to be decoded as \"+\", actual: %s, %v", decoded, err)
+	}
+
+	for _, invalid := range []string{"not base64!", "eyJ0aHJlZURT*", "%zz"} {
+		if _, err := decodeBase64(invalid, false); err == nil {
+			t.Errorf("expected non nil error for %q", invalid)
+		}
+	}
+}
+
+func Test_decodeFormData(t *testing.T) {
+	form := url.Values{"cres": {base64.RawURLEncoding.EncodeToString([]byte(cresSamples[2]))}}
+	r := httptest.NewRequest(http.MethodPost, ChallengeNotificationEndpoint, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	cres := domain.ChallengeResponse{}
+	err := decodeFormData(r, "cres", true, &cres)
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+
+	if cres.ThreeDSServerTransID != "f0e1d2c3-b4a5-4678-9abc-def012345678" || cres.TransStatus != "Y" {
+		t.Fatalf("unexpected CRes: %+v", cres)
+	}
+}
+
+func Fuzz_decodeBase64(f *testing.F) {
+	for _, sample := range cresSamples {
+		f.Add([]byte(sample))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+			decoded, err := decodeBase64(enc.EncodeToString(data), false)
+			if err != nil {
+				t.Fatalf("expected nil error, actual: %v", err)
+			}
+			if string(decoded) != string(data) {
+				t.Fatalf("expected: %x, actual: %x", data, decoded)
+			}
+		}
+
+		strict, err := decodeBase64(base64.RawURLEncoding.EncodeToString(data), true)
+		if err != nil || string(strict) != string(data) {
+			t.Fatalf("expected strict round trip, actual: %x, %v", strict, err)
+		}
+
+		// arbitrary input must never panic
+		_, _ = decodeBase64(string(data), false)
+		_, _ = decodeBase64(string(data), true)
+	})
+}
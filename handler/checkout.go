@@ -3,17 +3,16 @@ package handler
 import (
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/unravelin/ravelin-3ds-demo/audit"
 	"github.com/unravelin/ravelin-3ds-demo/domain"
-)
-
-var (
-	ErrCardRangeNotFound = errors.New("card range not found")
-	ErrUnauthorised      = errors.New("authorization token not valid")
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/tracing"
 )
 
 // Checkout is an example of the handler which is called when the customer click the "pay" button.
@@ -27,26 +26,24 @@ func (h Handler) Checkout(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Handling %s request", CheckoutEndpoint)
+	logger := logging.FromContext(r.Context())
+	logger.Info("Handling request", "endpoint", CheckoutEndpoint)
 
-	checkoutReqBytes, err := readBody(r.Body)
+	checkoutRequest := domain.MerchantCheckoutRequest{}
+	err := h.decodeJSONRequest(rw, r, true, &checkoutRequest)
 	if err != nil {
-		log.Printf("failed to read checkout request body :%v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to decode checkout request", "error", err)
+		respondRequestError(err, rw)
 		return
 	}
 
-	checkoutRequest := domain.MerchantCheckoutRequest{}
-	err = json.Unmarshal(checkoutReqBytes, &checkoutRequest)
-	if err != nil {
-		log.Printf("failed to unmarshal checkout request json: %v", err)
-		rw.WriteHeader(http.StatusBadRequest)
+	if checkoutRequest.AccountNumber == "" {
+		logger.Warn("invalid checkout request: no account number")
+		respondRequestError(invalidRequest("accountNumber is required"), rw)
 		return
 	}
 
-	if checkoutRequest.AccountNumber == "" {
-		log.Printf("invalid checkout request: %v", err)
-		rw.WriteHeader(http.StatusBadRequest)
+	if h.checkAbuse(rw, r, CheckoutEndpoint, checkoutRequest.AccountNumber).Action == AbuseActionBlock {
 		return
 	}
 
@@ -55,31 +52,30 @@ func (h Handler) Checkout(rw http.ResponseWriter, r *http.Request) {
 		PAN:           checkoutRequest.AccountNumber,
 	}
 
-	log.Printf("Making Ravelin /3ds/version request for card ending in %s", getLastFour(versionRequest.PAN))
-	rsp, err := h.sendToRavelin3DSServer(http.MethodPost, versionRequest, domain.RavelinThreeDSVersionEndpoint)
-	if err != nil {
-		if err == ErrCardRangeNotFound {
-			// card range not found
-			log.Printf("Card range not found for current pan: %v", err)
-			rw.WriteHeader(http.StatusNotFound)
-			return
+	// the threeDSServerTransID is not known when the version request fails
+	auditFailure := func(err error) {
+		h.audit(r, "", audit.MessageVersionRequest, versionRequest)
+		h.auditFailure(r, "", domain.RavelinThreeDSVersionEndpoint, err)
+	}
 
-		}
-		if err == ErrUnauthorised {
-			// token not authorised
-			log.Printf("API token not valid: %v", err)
-			rw.WriteHeader(http.StatusUnauthorized)
+	logger.Info("Making Ravelin /3ds/version request", "cardLastFour", getLastFour(versionRequest.PAN))
+	rsp, err := h.sendToRavelin3DSServer(r.Context(), http.MethodPost, versionRequest, domain.RavelinThreeDSVersionEndpoint)
+	if err != nil {
+		logger.Error("failed to send version request to threeds server", "error", err)
+		auditFailure(err)
+		if errors.Is(err, ErrApiKeyNotConfigured) {
+			// a misconfigured server says nothing about the payment, so no fallback decision is made
+			respondError(err, rw)
 			return
-
 		}
-		log.Printf("failed to send version request to threeds server: %v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		h.respondFallback(r, err, rw)
 		return
 	}
 
 	rspBytes, err := readBody(rsp.Body)
 	if err != nil {
-		log.Printf("failed to read version response body: %v", err)
+		logger.Error("failed to read version response body", "error", err)
+		auditFailure(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -87,18 +83,46 @@ func (h Handler) Checkout(rw http.ResponseWriter, r *http.Request) {
 	versionResponse := domain.RavelinVersionResponse{}
 	err = json.Unmarshal(rspBytes, &versionResponse)
 	if err != nil {
-		log.Printf("failed to decode version response: %v", err)
+		logger.Error("failed to decode version response", "error", err)
+		auditFailure(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	if versionResponse.Data == nil {
-		log.Printf("no version information in version response: %v", err)
+		logger.Error("no version information in version response")
+		auditFailure(errors.New("no version information in version response"))
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Ravelin /3ds/version response received")
+	logger = logger.With("threeDSServerTransID", versionResponse.Data.ThreeDSServerTransID, "correlationID", requestIDFromContext(r.Context()))
+	// the version request is recorded once the threeDSServerTransID is known
+	h.audit(r, versionResponse.Data.ThreeDSServerTransID, audit.MessageVersionRequest, versionRequest)
+	h.audit(r, versionResponse.Data.ThreeDSServerTransID, audit.MessageVersionResponse, versionResponse)
+
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String(threeDSServerTransIDAttribute, versionResponse.Data.ThreeDSServerTransID))
+	logger.Info("Ravelin /3ds/version response received", "messageVersion", versionResponse.Data.VersionRecommendation)
+
+	sessionID, err := h.browserSessionID(rw, r)
+	if err != nil {
+		logger.Error("failed to get browser session", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the browser sends the token to authenticate, so the card cannot change part way through the transaction.
+	// The card is tokenised first, so a transaction is never stored which could not be authenticated.
+	cardToken, err := h.CardVault.Tokenise(checkoutRequest.AccountNumber, versionResponse.Data.ThreeDSServerTransID)
+	if err != nil {
+		logger.Error("failed to tokenise card", "error", err)
+		respondRequestError(&RequestError{
+			StatusCode: http.StatusInternalServerError,
+			ErrorCode:  merchantErrorCodeInternal,
+			Message:    "failed to tokenise card",
+		}, rw)
+		return
+	}
 
 	methodStatus := MethodStatusNotCompleted // set to completed in method notification
 	if versionResponse.Data.ThreeDSMethodURL == "" {
@@ -106,8 +130,13 @@ func (h Handler) Checkout(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	tx := ThreeDSTransaction{
-		MessageVersion: versionResponse.Data.VersionRecommendation,
-		MethodStatus:   methodStatus,
+		MessageVersion:   versionResponse.Data.VersionRecommendation,
+		MethodStatus:     methodStatus,
+		BrowserSessionID: sessionID,
+		CorrelationID:    requestIDFromContext(r.Context()),
+		CardScheme:       cardScheme(checkoutRequest.AccountNumber),
+		PANFingerprint:   h.CardVault.Fingerprint(checkoutRequest.AccountNumber),
+		TraceContext:     tracing.Inject(r.Context()),
 	}
 	h.ThreeDSTransactionStore.Add(versionResponse.Data.ThreeDSServerTransID, tx)
 
@@ -117,6 +146,25 @@ func (h Handler) Checkout(rw http.ResponseWriter, r *http.Request) {
 		TransactionID:         versionResponse.Data.TransactionID,
 		ThreeDSMethodURL:      versionResponse.Data.ThreeDSMethodURL,
 		MethodNotificationURL: h.MerchantUrl + MethodNotificationEndpoint,
+		CardToken:             cardToken,
 	}
 	respond(checkoutResp, rw)
 }
+
+// respondFallback responds with the fallback policy's decision for a checkout which could not start 3DS.
+// The decision is made for the order held by the merchant backend, never for details sent by the browser.
+func (h Handler) respondFallback(r *http.Request, err error, rw http.ResponseWriter) {
+	o := h.order()
+	decision := h.FallbackPolicy.Decide(err, o.Amount, o.CurrencyCode, o.MerchantCountry)
+	logging.FromContext(r.Context()).Warn("3DS unavailable for checkout, applying fallback policy",
+		"decision", decision.Decision,
+		"errorType", decision.ErrorType,
+		"errorCode", decision.ErrorCode,
+		"scaRequired", decision.SCARequired,
+		"amount", o.Amount,
+		"currency", o.CurrencyCode,
+	)
+	h.Metrics.RecordFallback(decision.Decision, decision.ErrorType)
+
+	respond(domain.MerchantCheckoutResponse{Fallback: &decision}, rw)
+}
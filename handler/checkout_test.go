@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/vault"
+)
+
+func TestHandler_cardToken(t *testing.T) {
+	var authenticatedPAN string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case domain.RavelinThreeDSVersionEndpoint:
+			_, _ = w.Write([]byte(`{"status":200,"data":{"threeDSServerTransID":"tx-1","versionRecommendation":"2.2.0"}}`))
+		case domain.RavelinThreeDSAuthenticateEndpoint:
+			authenticateRequest := domain.RavelinAuthenticateRequest{}
+			_ = json.NewDecoder(r.Body).Decode(&authenticateRequest)
+			authenticatedPAN = authenticateRequest.AReqData.PAN
+			_, _ = w.Write([]byte(`{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":"tx-1","transStatus":"Y"}}`))
+		}
+	}))
+	defer server.Close()
+
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		CardVault:               testCardVault(t),
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	w := httptest.NewRecorder()
+	h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"4000000000001000"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %d, actual: %d", http.StatusOK, w.Code)
+	}
+
+	checkoutResponse := domain.MerchantCheckoutResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &checkoutResponse); err != nil {
+		t.Fatal(err)
+	}
+	if checkoutResponse.CardToken == "" || strings.Contains(checkoutResponse.CardToken, "4000000000001000") {
+		t.Fatalf("expected a card token, actual: %q", checkoutResponse.CardToken)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantPAN    string
+	}{
+		{
+			name:       "card number",
+			body:       `{"threeDSServerTransID":"tx-1","accountNumber":"4000000000001091","productSKU":"10001","productQuantity":1,"browserData":{"browserUserAgent":"Mozilla/5.0"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   merchantErrorCodeInvalidRequest,
+		},
+		{
+			name:       "unknown token",
+			body:       `{"threeDSServerTransID":"tx-1","cardToken":"ctok_unknown","productSKU":"10001","productQuantity":1,"browserData":{"browserUserAgent":"Mozilla/5.0"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   merchantErrorCodeInvalidCardToken,
+		},
+		{
+			name:       "token for another transaction",
+			body:       `{"threeDSServerTransID":"tx-2","cardToken":"` + checkoutResponse.CardToken + `","productSKU":"10001","productQuantity":1,"browserData":{"browserUserAgent":"Mozilla/5.0"}}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   merchantErrorCodeInvalidCardToken,
+		},
+		{
+			name:       "token",
+			body:       `{"threeDSServerTransID":"tx-1","cardToken":"` + checkoutResponse.CardToken + `","productSKU":"10001","productQuantity":1,"browserData":{"browserUserAgent":"Mozilla/5.0"}}`,
+			wantStatus: http.StatusOK,
+			wantPAN:    "4000000000001000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticatedPAN = ""
+			w := httptest.NewRecorder()
+			h.Authenticate(w, httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+			if authenticatedPAN != tt.wantPAN {
+				t.Errorf("expected: %q, actual: %q", tt.wantPAN, authenticatedPAN)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+
+			rsp := domain.MerchantErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.ErrorCode != tt.wantCode {
+				t.Errorf("expected: %s, actual: %s", tt.wantCode, rsp.ErrorCode)
+			}
+		})
+	}
+}
+
+func testCardVault(t *testing.T) *vault.Vault {
+	v, err := vault.New(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,335 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/tracing"
+)
+
+const (
+	defaultRavelinTimeout = 10 * time.Second
+	retryBaseDelay        = 100 * time.Millisecond
+	retryMaxDelay         = 2 * time.Second
+)
+
+// DefaultRavelinTimeouts are the per-attempt timeouts for each of Ravelin's 3DS API endpoints.
+// Authentication involves the DS and ACS, so it is given longer than the other endpoints.
+var DefaultRavelinTimeouts = map[string]time.Duration{
+	domain.RavelinThreeDSVersionEndpoint:      5 * time.Second,
+	domain.RavelinThreeDSAuthenticateEndpoint: 30 * time.Second,
+	domain.RavelinThreeDSResultEndpoint:       10 * time.Second,
+	domain.RavelinThreeDSTestCardsEndpoint:    5 * time.Second,
+}
+
+// retrySafeEndpoints can be retried without risk of creating a duplicate authentication.
+var retrySafeEndpoints = map[string]bool{
+	domain.RavelinThreeDSVersionEndpoint:   true,
+	domain.RavelinThreeDSResultEndpoint:    true,
+	domain.RavelinThreeDSTestCardsEndpoint: true,
+}
+
+// sendToRavelin3DSServer sends a request to Ravelin's 3DS API. Each attempt is bounded by the
+// endpoint's timeout, retry-safe endpoints are retried with jittered backoff on transient failures,
+// and requests fail fast with ErrCircuitOpen while the circuit breaker is open.
+//
+// The response body has already been read when it is returned, so it remains readable after ctx is done.
+func (h Handler) sendToRavelin3DSServer(ctx context.Context, method string, body interface{}, endpoint string) (*http.Response, error) {
+	var bodyBytes []byte
+	if body != nil && method != http.MethodGet {
+		var err error
+		bodyBytes, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal threeds request: %v", err)
+		}
+	}
+
+	// the keys are read once, so every attempt uses the same keys even if they are rotated meanwhile
+	apiKey := h.RavelinApiKeys.Get()
+	if apiKey.Primary == "" {
+		return nil, ErrApiKeyNotConfigured
+	}
+
+	attempts := 1
+	if retrySafeEndpoints[endpoint] {
+		attempts += h.RavelinMaxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(attempt)
+			logging.FromContext(ctx).Warn("retrying 3ds server request", "endpoint", endpoint, "attempt", attempt+1, "delayMs", delay.Milliseconds(), "error", err)
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		permit, ok := h.CircuitBreaker.Allow()
+		if !ok {
+			return nil, ErrCircuitOpen
+		}
+
+		var rsp *http.Response
+		rsp, err = h.sendRavelinRequest(ctx, method, bodyBytes, endpoint, apiKey.Primary)
+		if err == nil || errors.Is(err, ErrUnauthorised) {
+			h.RavelinApiKeys.recordPrimary(apiKey.Primary, err != nil)
+		}
+		if errors.Is(err, ErrUnauthorised) && apiKey.Secondary != "" {
+			// an unauthorised request is rejected before it is processed, so is safe to send again
+			logging.FromContext(ctx).Warn("primary ravelin api key unauthorised, using secondary key", "endpoint", endpoint)
+			rsp, err = h.sendRavelinRequest(ctx, method, bodyBytes, endpoint, apiKey.Secondary)
+		}
+		if err != nil && ctx.Err() != nil {
+			// the caller gave up, which says nothing about the health of the 3DS server
+			h.CircuitBreaker.Abandon(permit)
+			return nil, err
+		}
+		h.CircuitBreaker.Record(permit, !isServerFailure(err))
+		if err == nil {
+			return rsp, nil
+		}
+
+		if !isRetryable(err) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// sendRavelinRequest makes a single attempt at a request to Ravelin's 3DS API.
+func (h Handler) sendRavelinRequest(ctx context.Context, method string, bodyBytes []byte, endpoint string, apiKey string) (*http.Response, error) {
+	timeout, ok := h.RavelinTimeouts[endpoint]
+	if !ok {
+		timeout, ok = DefaultRavelinTimeouts[endpoint]
+	}
+	if !ok {
+		timeout = defaultRavelinTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var requestBody io.Reader = http.NoBody
+	if bodyBytes != nil {
+		requestBody = bytes.NewReader(bodyBytes)
+	}
+
+	apiURL := h.RavelinApiUrl + endpoint
+
+	ctx, span := tracing.Tracer().Start(ctx, "ravelin "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(method),
+			semconv.HTTPURLKey.String(apiURL),
+		))
+	defer span.End()
+
+	request, err := http.NewRequestWithContext(ctx, method, apiURL, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	request.Header.Set("Authorization", "token "+apiKey)
+	request.Header.Set("Content-Type", jsonContentType)
+	tracing.InjectHTTP(ctx, request.Header)
+
+	client := h.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	rsp, err := client.Do(request)
+	if err != nil {
+		h.Metrics.ObserveRavelinRequest(endpoint, 0, time.Since(start))
+		tracing.RecordError(ctx, err)
+		return nil, fmt.Errorf("http request fail: %w", err)
+	}
+	h.Metrics.ObserveRavelinRequest(endpoint, rsp.StatusCode, time.Since(start))
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(rsp.StatusCode))
+
+	// read the body before the attempt's timeout is cancelled
+	responseBody, err := readBody(rsp.Body)
+	if err != nil {
+		tracing.RecordError(ctx, err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	rsp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	if rsp.StatusCode == http.StatusNotFound && endpoint == domain.RavelinThreeDSVersionEndpoint {
+		return nil, ErrCardRangeNotFound
+	}
+
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorised
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		errorResponse := domain.RavelinErrorResponse{}
+		// the body is not guaranteed to be JSON, so a failure to decode is not an error here
+		if json.Unmarshal(responseBody, &errorResponse) == nil {
+			logging.FromContext(ctx).Warn("3ds server error response", "endpoint", endpoint, "status", rsp.StatusCode, "responseBody", json.RawMessage(responseBody))
+		} else {
+			logging.FromContext(ctx).Warn("3ds server error response", "endpoint", endpoint, "status", rsp.StatusCode, "responseBody", string(responseBody))
+		}
+		threeDSErr := newThreeDSErrorFromResponse(rsp.StatusCode, errorResponse)
+		tracing.RecordError(ctx, threeDSErr)
+		return nil, threeDSErr
+	}
+
+	return rsp, nil
+}
+
+// isRetryable reports whether a failed request may succeed if it is sent again.
+func isRetryable(err error) bool {
+	var threeDSErr *ThreeDSError
+	if errors.As(err, &threeDSErr) {
+		return threeDSErr.Retryable()
+	}
+	return isServerFailure(err)
+}
+
+// isServerFailure reports whether err indicates that the 3DS server is degraded, as opposed to
+// a successful response or a rejection of the request itself.
+func isServerFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrCardRangeNotFound) || errors.Is(err, ErrUnauthorised) {
+		return false
+	}
+
+	var threeDSErr *ThreeDSError
+	if errors.As(err, &threeDSErr) {
+		return !threeDSErr.ClientError()
+	}
+
+	// transport failures and timeouts
+	return true
+}
+
+// requestNotSent reports whether a failed request certainly never reached Ravelin's 3DS API,
+// because the circuit breaker was open, no API key is configured or the connection could not be made.
+func requestNotSent(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrApiKeyNotConfigured) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryDelay returns the delay before a retry, using exponential backoff with full jitter.
+func retryDelay(attempt int) time.Duration {
+	ceiling := retryBaseDelay << uint(attempt-1)
+	if ceiling > retryMaxDelay || ceiling <= 0 {
+		ceiling = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// CircuitBreaker stops requests being sent to the 3DS server after consecutive failures,
+// so that checkouts fail fast while it is degraded. After the cooldown a single trial request
+// is allowed through; the circuit closes again if it succeeds. A nil *CircuitBreaker allows every request.
+type CircuitBreaker struct {
+	mu        *sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// NewCircuitBreaker creates a CircuitBreaker which opens after threshold consecutive failures.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		mu:        &sync.Mutex{},
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// CircuitPermit is returned by Allow for a request which may be sent, and is passed back with
+// its outcome. It identifies whether the request is the trial request while the circuit is open.
+type CircuitPermit struct {
+	trial bool
+}
+
+// Allow reports whether a request may be sent.
+func (b *CircuitBreaker) Allow() (CircuitPermit, bool) {
+	if b == nil {
+		return CircuitPermit{}, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return CircuitPermit{}, true
+	}
+
+	// open: allow a single trial request once the cooldown has passed
+	if b.now().Before(b.openUntil) || b.trial {
+		return CircuitPermit{}, false
+	}
+	b.trial = true
+	return CircuitPermit{trial: true}, true
+}
+
+// Record records the outcome of a request allowed by Allow. While the circuit is open only the
+// trial request's outcome is recorded, so requests which were already in flight when it opened
+// cannot close it.
+func (b *CircuitBreaker) Record(p CircuitPermit, success bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p.trial {
+		b.trial = false
+	} else if b.failures >= b.threshold {
+		return
+	}
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// Abandon releases a request allowed by Allow without recording an outcome, such as when the caller cancelled it.
+func (b *CircuitBreaker) Abandon(p CircuitPermit) {
+	if b == nil || !p.trial {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		proxies      TrustedProxies
+		remoteAddr   string
+		forwardedFor []string
+		wantIP       string
+	}{
+		{
+			name:       "no proxies",
+			remoteAddr: "203.0.113.7:1234",
+			wantIP:     "203.0.113.7",
+		},
+		{
+			name:         "forwarded for ignored from untrusted address",
+			proxies:      proxies,
+			remoteAddr:   "203.0.113.7:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			wantIP:       "203.0.113.7",
+		},
+		{
+			name:         "forwarded for from trusted proxy",
+			proxies:      proxies,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			wantIP:       "198.51.100.1",
+		},
+		{
+			name:         "spoofed address left of the client",
+			proxies:      proxies,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"1.2.3.4, 198.51.100.1, 192.0.2.1"},
+			wantIP:       "198.51.100.1",
+		},
+		{
+			name:         "multiple headers",
+			proxies:      proxies,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"1.2.3.4", "198.51.100.1"},
+			wantIP:       "198.51.100.1",
+		},
+		{
+			name:         "invalid hop",
+			proxies:      proxies,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"198.51.100.1, unknown"},
+			wantIP:       "10.1.2.3",
+		},
+		{
+			name:         "only trusted proxies",
+			proxies:      proxies,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"10.4.5.6"},
+			wantIP:       "10.4.5.6",
+		},
+		{
+			name:         "ipv6",
+			proxies:      proxies,
+			remoteAddr:   "[2001:db8::1]:1234",
+			forwardedFor: []string{"2001:db9::5"},
+			wantIP:       "2001:db9::5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, forwardedFor := range tt.forwardedFor {
+				r.Header.Add(forwardedForHeader, forwardedFor)
+			}
+
+			ip := tt.proxies.ClientIP(r)
+			if ip != tt.wantIP {
+				t.Errorf("expected: %s, actual: %s", tt.wantIP, ip)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, proxy := range []string{"10.0.0", "10.0.0.0/33", "proxy"} {
+		if _, err := ParseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("expected error parsing %q", proxy)
+		}
+	}
+}
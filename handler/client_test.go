@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func Test_sendToRavelin3DSServer_retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		endpoint     string
+		status       int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{
+			name:         "retry-safe endpoint recovers",
+			endpoint:     domain.RavelinThreeDSVersionEndpoint,
+			status:       http.StatusServiceUnavailable,
+			wantRequests: 2,
+		},
+		{
+			name:         "authenticate is never retried",
+			endpoint:     domain.RavelinThreeDSAuthenticateEndpoint,
+			status:       http.StatusServiceUnavailable,
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "client errors are not retried",
+			endpoint:     domain.RavelinThreeDSResultEndpoint,
+			status:       http.StatusBadRequest,
+			wantRequests: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// only the first request fails
+				if atomic.AddInt32(&requests, 1) == 1 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t), RavelinMaxRetries: 2}
+			rsp, err := h.sendToRavelin3DSServer(context.Background(), http.MethodPost, struct{}{}, tt.endpoint)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error: %v, actual: %v", tt.wantErr, err)
+			}
+
+			if err == nil {
+				body, err := readBody(rsp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != `{}` {
+					t.Errorf("expected: %s, actual: %s", `{}`, body)
+				}
+			}
+
+			if actual := atomic.LoadInt32(&requests); actual != tt.wantRequests {
+				t.Errorf("expected requests: %d, actual: %d", tt.wantRequests, actual)
+			}
+		})
+	}
+}
+
+func Test_sendToRavelin3DSServer_timeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	h := Handler{
+		RavelinApiUrl:   server.URL,
+		RavelinApiKeys:  testApiKeys(t),
+		RavelinTimeouts: map[string]time.Duration{domain.RavelinThreeDSAuthenticateEndpoint: 50 * time.Millisecond},
+	}
+
+	_, err := h.sendToRavelin3DSServer(context.Background(), http.MethodPost, struct{}{}, domain.RavelinThreeDSAuthenticateEndpoint)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected: %v, actual: %v", context.DeadlineExceeded, err)
+	}
+
+	status, rsp := merchantError(err)
+	if status != http.StatusGatewayTimeout || rsp.ErrorCode != merchantErrorCodeTimeout {
+		t.Errorf("expected: %d %s, actual: %d %s", http.StatusGatewayTimeout, merchantErrorCodeTimeout, status, rsp.ErrorCode)
+	}
+}
+
+func Test_sendToRavelin3DSServer_cancelled(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	// a cancelled browser request cancels the upstream request, rather than waiting for it to time out
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t), RavelinMaxRetries: 2}
+	start := time.Now()
+	_, err := h.sendToRavelin3DSServer(ctx, http.MethodPost, struct{}{}, domain.RavelinThreeDSVersionEndpoint)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected: %v, actual: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected request to be cancelled promptly, actual: %v", elapsed)
+	}
+}
+
+func Test_sendToRavelin3DSServer_cancelledAfterResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the browser disconnects just after Ravelin responds
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		cancel()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{}`))}, nil
+	})}
+
+	h := Handler{RavelinApiUrl: "http://ravelin.test", RavelinApiKeys: testApiKeys(t), HTTPClient: client}
+	rsp, err := h.sendToRavelin3DSServer(ctx, http.MethodPost, struct{}{}, domain.RavelinThreeDSAuthenticateEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp == nil {
+		t.Fatal("expected the response to be returned")
+	}
+	if body, _ := readBody(rsp.Body); string(body) != `{}` {
+		t.Errorf("expected: %s, actual: %s", `{}`, body)
+	}
+}
+
+func Test_sendToRavelin3DSServer_circuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t), CircuitBreaker: breaker}
+	send := func() error {
+		_, err := h.sendToRavelin3DSServer(context.Background(), http.MethodPost, struct{}{}, domain.RavelinThreeDSAuthenticateEndpoint)
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := send(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected server error, actual: %v", err)
+		}
+	}
+
+	// the circuit is open, so requests fail fast without reaching the server
+	if err := send(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected: %v, actual: %v", ErrCircuitOpen, err)
+	}
+	if actual := atomic.LoadInt32(&requests); actual != 2 {
+		t.Errorf("expected requests: %d, actual: %d", 2, actual)
+	}
+
+	status, rsp := merchantError(ErrCircuitOpen)
+	if status != http.StatusServiceUnavailable || rsp.ErrorCode != merchantErrorCodeUnavailable || !rsp.Retryable {
+		t.Errorf("expected: %d %s retryable, actual: %d %s %v", http.StatusServiceUnavailable, merchantErrorCodeUnavailable, status, rsp.ErrorCode, rsp.Retryable)
+	}
+
+	// after the cooldown a trial request is sent, and its success closes the circuit
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 2; i++ {
+		if err := send(); err != nil {
+			t.Fatalf("expected nil error, actual: %v", err)
+		}
+	}
+	if actual := atomic.LoadInt32(&requests); actual != 4 {
+		t.Errorf("expected requests: %d, actual: %d", 4, actual)
+	}
+}
+
+func TestCircuitBreaker_halfOpen(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(1, time.Second)
+	breaker.now = func() time.Time { return now }
+
+	inFlight, _ := breaker.Allow()
+	breaker.Record(CircuitPermit{}, false)
+	if _, ok := breaker.Allow(); ok {
+		t.Fatal("expected circuit to be open")
+	}
+
+	now = now.Add(time.Second)
+	trial, ok := breaker.Allow()
+	if !ok {
+		t.Fatal("expected a trial request to be allowed")
+	}
+	if _, ok := breaker.Allow(); ok {
+		t.Fatal("expected only a single trial request")
+	}
+
+	// a request which was in flight when the circuit opened does not resolve the trial
+	breaker.Record(inFlight, true)
+	if _, ok := breaker.Allow(); ok {
+		t.Fatal("expected only a single trial request")
+	}
+
+	// a failed trial reopens the circuit for another cooldown
+	breaker.Record(trial, false)
+	if _, ok := breaker.Allow(); ok {
+		t.Fatal("expected circuit to be open")
+	}
+
+	now = now.Add(time.Second)
+	trial, _ = breaker.Allow()
+	breaker.Record(trial, true)
+	for i := 0; i < 2; i++ {
+		if _, ok := breaker.Allow(); !ok {
+			t.Fatal("expected a successful trial to close the circuit")
+		}
+	}
+}
+
+func testApiKeys(t *testing.T) *ApiKeys {
+	keys, err := NewApiKeys(ApiKey{Primary: "test-key"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
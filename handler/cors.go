@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+const merchantErrorCodeOriginNotAllowed = "ORIGIN_NOT_ALLOWED"
+
+// CORS only allows browsers to call next from the allowed origins, such as the merchant's own
+// front-end. Requests from any other origin are rejected before reaching next, so a page on
+// another site cannot submit card details. Requests without an Origin header, which browsers
+// only omit for same origin GET requests, are allowed.
+//
+// This must not be used for the method and challenge notification endpoints, which receive
+// form posts from the ACS's origin.
+func CORS(allowedOrigins []string, next http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[normaliseOrigin(origin)] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+
+		if !allowed[normaliseOrigin(origin)] {
+			logging.FromContext(r.Context()).Warn("rejected cross-origin request", "origin", origin, "path", r.URL.Path)
+			respondRequestError(&RequestError{
+				StatusCode: http.StatusForbidden,
+				ErrorCode:  merchantErrorCodeOriginNotAllowed,
+				Message:    "origin not allowed",
+			}, w)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		// preflight requests are answered here rather than by next
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// normaliseOrigin lower cases an origin and removes any trailing slash, so that configured
+// origins match the Origin header sent by browsers.
+func normaliseOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// merchantOrigin returns the origin of the merchant's front-end, which the notification templates
+// post their messages to.
+func (h Handler) merchantOrigin() string {
+	u, err := url.Parse(h.MerchantUrl)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return normaliseOrigin(h.MerchantUrl)
+	}
+	return normaliseOrigin(u.Scheme + "://" + u.Host)
+}
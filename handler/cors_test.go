@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	const card = `{"accountNumber":"4000000000001000","cardExpiryDate":"2205"}`
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		preflight     bool
+		wantStatus    int
+		wantNextCalls int
+		wantAllowed   string
+	}{
+		{
+			name:          "cross-origin card submission",
+			method:        http.MethodPost,
+			origin:        "https://evil.example",
+			wantStatus:    http.StatusForbidden,
+			wantNextCalls: 0,
+		},
+		{
+			name:          "cross-origin preflight",
+			method:        http.MethodOptions,
+			origin:        "https://evil.example",
+			preflight:     true,
+			wantStatus:    http.StatusForbidden,
+			wantNextCalls: 0,
+		},
+		{
+			name:          "origin differing only by scheme",
+			method:        http.MethodPost,
+			origin:        "http://shop.example",
+			wantStatus:    http.StatusForbidden,
+			wantNextCalls: 0,
+		},
+		{
+			name:          "merchant origin",
+			method:        http.MethodPost,
+			origin:        "https://shop.example",
+			wantStatus:    http.StatusOK,
+			wantNextCalls: 1,
+			wantAllowed:   "https://shop.example",
+		},
+		{
+			name:          "allowed origin preflight",
+			method:        http.MethodOptions,
+			origin:        "https://Checkout.Example",
+			preflight:     true,
+			wantStatus:    http.StatusNoContent,
+			wantNextCalls: 0,
+			wantAllowed:   "https://Checkout.Example",
+		},
+		{
+			name:          "no origin",
+			method:        http.MethodPost,
+			wantStatus:    http.StatusOK,
+			wantNextCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nextCalls := 0
+			cors := CORS([]string{"https://shop.example", "https://checkout.example/"}, func(w http.ResponseWriter, r *http.Request) {
+				nextCalls++
+			})
+
+			r := httptest.NewRequest(tt.method, AuthenticateEndpoint, bytes.NewBufferString(card))
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			w := httptest.NewRecorder()
+			cors(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+			if nextCalls != tt.wantNextCalls {
+				t.Errorf("expected next calls: %d, actual: %d", tt.wantNextCalls, nextCalls)
+			}
+			if actual := w.Header().Get("Access-Control-Allow-Origin"); actual != tt.wantAllowed {
+				t.Errorf("expected: %q, actual: %q", tt.wantAllowed, actual)
+			}
+		})
+	}
+}
+
+func TestHandler_MethodNotification_targetOrigin(t *testing.T) {
+	h := Handler{
+		MerchantUrl:                        "https://shop.example:8443/checkout",
+		MethodNotificationResponseTemplate: template.Must(template.ParseFiles("../templates/method-notification-response.html")),
+		ThreeDSTransactionStore:            NewThreeDSTransactionStore(),
+	}
+	h.ThreeDSTransactionStore.Add("tx-1", ThreeDSTransaction{})
+
+	form := url.Values{"threeDSMethodData": {base64.RawURLEncoding.EncodeToString([]byte(`{"threeDSServerTransID":"tx-1"}`))}}
+	r := httptest.NewRequest(http.MethodPost, MethodNotificationEndpoint, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.MethodNotification(w, r)
+
+	body := w.Body.String()
+	if !strings.Contains(body, `postMessage(data, "https:\/\/shop.example:8443")`) {
+		t.Errorf("expected message to be posted to the merchant origin, actual: %s", body)
+	}
+	if strings.Contains(body, `"*"`) {
+		t.Errorf("expected no wildcard target origin, actual: %s", body)
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+const (
+	customerCookieName   = "threeds-customer"
+	customerCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// Methods of a prior authentication, as sent in threeDSReqPriorAuthMethod.
+const (
+	priorAuthMethodFrictionless = "01"
+	priorAuthMethodChallenge    = "02"
+)
+
+const priorAuthTimestampFormat = "200601021504"
+
+// customerID returns the stable ID of the customer, from the customer cookie in their browser.
+// A new customer ID is issued, and the cookie set, if there is not a valid cookie.
+func (h Handler) customerID(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(customerCookieName); err == nil {
+		if id, ok := h.Customers.Identify(cookie.Value); ok {
+			return id
+		}
+	}
+
+	id, value := h.Customers.NewIdentity()
+
+	// unlike the browser session cookie, this is only sent with authenticate requests
+	cookie := &http.Cookie{
+		Name:     customerCookieName,
+		Value:    value,
+		Path:     AuthenticateEndpoint,
+		MaxAge:   int(customerCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.MerchantUrl, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+
+	return id
+}
+
+// setCustomer identifies the customer to Ravelin by their stable customer ID, adds their account
+// information and the merchant's assessment of the purchase to the AReq, and records the purchase
+// in the customer's history. A cardholder without an email address checks out as a guest.
+func (h Handler) setCustomer(w http.ResponseWriter, r *http.Request, ravelinRequest *domain.RavelinAuthenticateRequest, request domain.MerchantAuthenticateRequest, cardFingerprint string) {
+	cardholder := domain.Cardholder{}
+	if request.Cardholder != nil {
+		cardholder = *request.Cardholder
+	}
+
+	// the customer store only holds digests of the cardholder's details
+	digest := func(value string) string { return value }
+	if h.Customers != nil {
+		digest = h.Customers.Digest
+	}
+	visit := customer.Visit{
+		ThreeDSServerTransID: request.ThreeDSServerTransID,
+		Email:                digest(strings.ToLower(cardholder.Email)),
+		Name:                 digest(cardholder.Name),
+		BillingAddress:       digest(addressKey(cardholder.BillingAddress)),
+		ShippingAddress:      digest(addressKey(cardholder.ShippingAddress)),
+		CardFingerprint:      cardFingerprint,
+		ProductSKU:           request.ProductSKU,
+	}
+
+	guest := &domain.AcctInfo{ChAccAgeInd: accountIndGuest, PaymentAccInd: accountIndGuest}
+	if h.Customers == nil {
+		ravelinRequest.AReqData.AcctInfo = guest
+		ravelinRequest.AReqData.MerchantRiskIndicator = merchantRiskIndicator(customer.Customer{}, visit)
+		return
+	}
+
+	customerID := h.customerID(w, r)
+	previous := h.Customers.Record(customerID, visit)
+
+	ravelinRequest.CustomerID = customerID
+	ravelinRequest.AReqData.AcctInfo = guest
+	if visit.Email != "" {
+		ravelinRequest.AReqData.AcctInfo = accountInfo(previous, visit, time.Now())
+	}
+	ravelinRequest.AReqData.MerchantRiskIndicator = merchantRiskIndicator(previous, visit)
+
+	// a previous authentication of the same card makes a challenge less likely
+	if prior, ok := previous.Authentications[cardFingerprint]; ok {
+		ravelinRequest.AReqData.ThreeDSRequestorPriorAuthenticationInfo = &domain.PriorAuthenticationInfo{
+			ThreeDSReqPriorAuthMethod:    prior.Method,
+			ThreeDSReqPriorAuthTimestamp: prior.At.UTC().Format(priorAuthTimestampFormat),
+			ThreeDSReqPriorRef:           prior.ACSTransID,
+		}
+	}
+}
+
+// recordPriorAuthentication remembers a successful authentication of the transaction's card by
+// the customer who authenticated it, which is sent as threeDSRequestorPriorAuthenticationInfo the
+// next time they use the card.
+func (h Handler) recordPriorAuthentication(threeDSServerTransID string, tx ThreeDSTransaction, method string, at time.Time) {
+	if h.Customers == nil || tx.CustomerID == "" || tx.PANFingerprint == "" {
+		return
+	}
+
+	h.Customers.RecordAuthentication(tx.CustomerID, tx.PANFingerprint, customer.Authentication{
+		Method:               method,
+		At:                   at,
+		ThreeDSServerTransID: threeDSServerTransID,
+		ACSTransID:           tx.ACSTransID,
+	})
+}
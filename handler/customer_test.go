@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestHandler_customerID(t *testing.T) {
+	h := Handler{MerchantUrl: "https://merchant.example.com", Customers: testCustomers(t)}
+
+	w := httptest.NewRecorder()
+	id := h.customerID(w, httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != customerCookieName {
+		t.Fatalf("expected a %s cookie, actual: %v", customerCookieName, cookies)
+	}
+	if !cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].MaxAge <= 0 || cookies[0].Path != AuthenticateEndpoint {
+		t.Errorf("expected a long lived, secure, http only cookie for authenticate requests, actual: %+v", cookies[0])
+	}
+
+	tests := []struct {
+		name       string
+		cookie     string
+		wantSameID bool
+		wantCookie bool
+	}{
+		{name: "returning customer", cookie: cookies[0].Value, wantSameID: true},
+		{name: "tampered cookie", cookie: "other-customer" + cookies[0].Value[len(id):], wantCookie: true},
+		{name: "no cookie", wantCookie: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: customerCookieName, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+
+			actual := h.customerID(w, r)
+			if (actual == id) != tt.wantSameID {
+				t.Errorf("expected same customer ID: %v, actual: %s", tt.wantSameID, actual)
+			}
+			if (len(w.Result().Cookies()) > 0) != tt.wantCookie {
+				t.Errorf("expected cookie to be set: %v, actual: %v", tt.wantCookie, w.Result().Cookies())
+			}
+		})
+	}
+}
+
+func TestHandler_priorAuthentication(t *testing.T) {
+	const card = "4000000000001000"
+
+	versionRequests := 0
+	var areqData domain.AReqData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case domain.RavelinThreeDSVersionEndpoint:
+			versionRequests++
+			fmt.Fprintf(w, `{"status":200,"data":{"threeDSServerTransID":"tx-%d","versionRecommendation":"2.2.0"}}`, versionRequests)
+		case domain.RavelinThreeDSAuthenticateEndpoint:
+			authenticateRequest := domain.RavelinAuthenticateRequest{}
+			_ = json.NewDecoder(r.Body).Decode(&authenticateRequest)
+			areqData = authenticateRequest.AReqData
+			transStatus := "Y"
+			if authenticateRequest.AReqData.ThreeDSServerTransID == "tx-2" {
+				transStatus = "C"
+			}
+			fmt.Fprintf(w, `{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":%q,"acsTransID":"acs-%s","transStatus":%q,"authenticationValue":"value"}}`,
+				authenticateRequest.AReqData.ThreeDSServerTransID, authenticateRequest.AReqData.ThreeDSServerTransID, transStatus)
+		}
+	}))
+	defer server.Close()
+
+	signer, err := NewSessionDataSigner(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		CardVault:               testCardVault(t),
+		Customers:               testCustomers(t),
+		SessionDataSigner:       signer,
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	var customerCookie *http.Cookie
+	authenticate := func() *domain.PriorAuthenticationInfo {
+		w := httptest.NewRecorder()
+		h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"`+card+`"}`)))
+		checkoutResponse := domain.MerchantCheckoutResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &checkoutResponse); err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(domain.MerchantAuthenticateRequest{
+			ThreeDSServerTransID: checkoutResponse.ThreeDSServerTransID,
+			CardToken:            checkoutResponse.CardToken,
+			ProductSKU:           "10001",
+			ProductQuantity:      1,
+			BrowserData:          &domain.BrowserData{BrowserUserAgent: "Mozilla/5.0"},
+			// a customer is only remembered once they give an email address
+			Cardholder: &domain.Cardholder{Email: "jane.smith@example.com"},
+		})
+		r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(string(body)))
+		if customerCookie != nil {
+			r.AddCookie(customerCookie)
+		}
+		w = httptest.NewRecorder()
+		h.Authenticate(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected: %d, actual: %d", http.StatusOK, w.Code)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == customerCookieName {
+				customerCookie = cookie
+			}
+		}
+		return areqData.ThreeDSRequestorPriorAuthenticationInfo
+	}
+
+	// tx-1 is authenticated frictionlessly
+	if prior := authenticate(); prior != nil {
+		t.Fatalf("expected no prior authentication for a new customer, actual: %+v", prior)
+	}
+
+	// tx-2 is challenged, after the frictionless authentication of tx-1
+	prior := authenticate()
+	if prior == nil || prior.ThreeDSReqPriorAuthMethod != priorAuthMethodFrictionless || prior.ThreeDSReqPriorRef != "acs-tx-1" {
+		t.Fatalf("expected the frictionless authentication of tx-1, actual: %+v", prior)
+	}
+	if len(prior.ThreeDSReqPriorAuthTimestamp) != len(priorAuthTimestampFormat) {
+		t.Errorf("expected a timestamp formatted YYYYMMDDHHMM, actual: %s", prior.ThreeDSReqPriorAuthTimestamp)
+	}
+
+	result, _, err := h.ThreeDSTransactionStore.SetResult("tx-2", ThreeDSResult{TransStatus: "Y", AuthenticationValue: "value", ReceivedAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.recordChallengeResult("tx-2", result)
+
+	prior = authenticate()
+	if prior == nil || prior.ThreeDSReqPriorAuthMethod != priorAuthMethodChallenge || prior.ThreeDSReqPriorRef != "acs-tx-2" {
+		t.Fatalf("expected the challenge of tx-2, actual: %+v", prior)
+	}
+
+	// another customer using the same card has not authenticated it
+	customerCookie = nil
+	if prior := authenticate(); prior != nil {
+		t.Errorf("expected no prior authentication for another customer, actual: %+v", prior)
+	}
+}
+
+func TestHandler_priorAuthentication_frictionless(t *testing.T) {
+	versionRequests := 0
+	var areqData domain.AReqData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case domain.RavelinThreeDSVersionEndpoint:
+			versionRequests++
+			fmt.Fprintf(w, `{"status":200,"data":{"threeDSServerTransID":"tx-%d","versionRecommendation":"2.2.0"}}`, versionRequests)
+		case domain.RavelinThreeDSAuthenticateEndpoint:
+			authenticateRequest := domain.RavelinAuthenticateRequest{}
+			_ = json.NewDecoder(r.Body).Decode(&authenticateRequest)
+			areqData = authenticateRequest.AReqData
+			id := authenticateRequest.AReqData.ThreeDSServerTransID
+			switch id {
+			case "tx-1":
+				// a Y without an authentication value is not a successful authentication
+				fmt.Fprintf(w, `{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":%q,"acsTransID":"acs-%s","transStatus":"Y"}}`, id, id)
+			default:
+				// the ARes names another transaction, which must not be used in place of the bound one
+				fmt.Fprintf(w, `{"status":200,"data":{"messageVersion":"2.2.0","threeDSServerTransID":"tx-other","acsTransID":"acs-%s","transStatus":"Y","authenticationValue":"value"}}`, id)
+			}
+		}
+	}))
+	defer server.Close()
+
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		CardVault:               testCardVault(t),
+		Customers:               testCustomers(t),
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	var customerCookie *http.Cookie
+	authenticate := func() *domain.PriorAuthenticationInfo {
+		w := httptest.NewRecorder()
+		h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"4000000000001000"}`)))
+		checkoutResponse := domain.MerchantCheckoutResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &checkoutResponse); err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := json.Marshal(domain.MerchantAuthenticateRequest{
+			ThreeDSServerTransID: checkoutResponse.ThreeDSServerTransID,
+			CardToken:            checkoutResponse.CardToken,
+			ProductSKU:           "10001",
+			ProductQuantity:      1,
+			BrowserData:          &domain.BrowserData{BrowserUserAgent: "Mozilla/5.0"},
+			// a customer is only remembered once they give an email address
+			Cardholder: &domain.Cardholder{Email: "jane.smith@example.com"},
+		})
+		r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(string(body)))
+		if customerCookie != nil {
+			r.AddCookie(customerCookie)
+		}
+		w = httptest.NewRecorder()
+		h.Authenticate(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected: %d, actual: %d", http.StatusOK, w.Code)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == customerCookieName {
+				customerCookie = cookie
+			}
+		}
+		return areqData.ThreeDSRequestorPriorAuthenticationInfo
+	}
+
+	authenticate()
+	if prior := authenticate(); prior != nil {
+		t.Fatalf("expected no prior authentication without an authentication value, actual: %+v", prior)
+	}
+
+	prior := authenticate()
+	if prior == nil || prior.ThreeDSReqPriorRef != "acs-tx-2" {
+		t.Errorf("expected the frictionless authentication of tx-2, actual: %+v", prior)
+	}
+}
+
+func testCustomers(t *testing.T) *customer.Store {
+	customers, err := customer.NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return customers
+}
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+var (
+	ErrCardRangeNotFound = errors.New("card range not found")
+	ErrUnauthorised      = errors.New("authorization token not valid")
+	ErrCircuitOpen       = errors.New("3ds server unavailable: circuit breaker open")
+)
+
+// EMVCo error codes which may be returned in an Error message (Erro).
+// For more detail see the EMVCo 3DS Protocol and Core Functions Specification, Table A.4.
+const (
+	EMVCoErrorMessageReceivedInvalid     = "101"
+	EMVCoErrorMessageVersionNotSupported = "102"
+	EMVCoErrorSentMessagesLimitExceeded  = "103"
+	EMVCoErrorRequiredDataElementMissing = "201"
+	EMVCoErrorCriticalExtensionUnknown   = "202"
+	EMVCoErrorInvalidDataElementFormat   = "203"
+	EMVCoErrorDuplicateDataElement       = "204"
+	EMVCoErrorTransactionIDNotRecognised = "301"
+	EMVCoErrorDataDecryptionFailure      = "302"
+	EMVCoErrorAccessDenied               = "303"
+	EMVCoErrorISOCodeInvalid             = "304"
+	EMVCoErrorTransactionDataNotValid    = "305"
+	EMVCoErrorMCCNotValid                = "306"
+	EMVCoErrorSerialNumberNotValid       = "307"
+	EMVCoErrorTransactionTimedOut        = "402"
+	EMVCoErrorTransientSystemFailure     = "403"
+	EMVCoErrorPermanentSystemFailure     = "404"
+	EMVCoErrorSystemConnectionFailure    = "405"
+)
+
+// Error codes returned to the merchant front-end which do not originate from an EMVCo Error message.
+const (
+	merchantErrorCodeUnauthorised       = "THREEDS_UNAUTHORISED"
+	merchantErrorCodeCardRangeNotFound  = "CARD_RANGE_NOT_FOUND"
+	merchantErrorCodeInternal           = "INTERNAL_ERROR"
+	merchantErrorCodeInvalidSessionData = "INVALID_SESSION_DATA"
+	merchantErrorCodeUnavailable        = "THREEDS_UNAVAILABLE"
+	merchantErrorCodeTimeout            = "THREEDS_TIMEOUT"
+	merchantErrorCodeNotConfigured      = "THREEDS_NOT_CONFIGURED"
+	merchantErrorCodeRateLimited        = "RATE_LIMITED"
+	merchantErrorCodeVelocityBlocked    = "VELOCITY_BLOCKED"
+	ravelinErrorCodePrefix              = "RAVELIN_"
+)
+
+// ThreeDSError is returned when Ravelin's 3DS API responds with an error, either as a
+// non 200 HTTP response or as an EMVCo Error message (Erro) in the response data.
+type ThreeDSError struct {
+	// StatusCode is the HTTP status code returned by Ravelin's 3DS API.
+	StatusCode int
+	// Message is the Ravelin error message, if any.
+	Message string
+
+	// The following fields are populated from an EMVCo Error message.
+	ErrorCode        string
+	ErrorComponent   string
+	ErrorDescription string
+	ErrorDetail      string
+	ErrorMessageType string
+}
+
+// newThreeDSErrorFromResponse creates a ThreeDSError from a non 200 response from Ravelin's 3DS API.
+func newThreeDSErrorFromResponse(statusCode int, rsp domain.RavelinErrorResponse) *ThreeDSError {
+	e := &ThreeDSError{
+		StatusCode: statusCode,
+		Message:    rsp.Message,
+	}
+
+	if rsp.Data != nil {
+		e.ErrorCode = rsp.Data.ErrorCode
+		e.ErrorComponent = rsp.Data.ErrorComponent
+		e.ErrorDescription = rsp.Data.ErrorDescription
+		e.ErrorDetail = rsp.Data.ErrorDetail
+		e.ErrorMessageType = rsp.Data.ErrorMessageType
+	}
+
+	return e
+}
+
+// newThreeDSErrorFromAuthenticateResponse returns a ThreeDSError if the authenticate response
+// data contains an EMVCo Error message, otherwise nil.
+func newThreeDSErrorFromAuthenticateResponse(data *domain.RavelinAuthenticateResponseData) *ThreeDSError {
+	if data == nil || data.ErrorCode == "" {
+		return nil
+	}
+
+	return &ThreeDSError{
+		StatusCode:       http.StatusOK,
+		ErrorCode:        data.ErrorCode,
+		ErrorComponent:   data.ErrorComponent,
+		ErrorDescription: data.ErrorDescription,
+		ErrorDetail:      data.ErrorDetail,
+		ErrorMessageType: data.ErrorMessageType,
+	}
+}
+
+func (e *ThreeDSError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "3ds server error: status %d", e.StatusCode)
+	if e.Message != "" {
+		fmt.Fprintf(&sb, ", message %q", e.Message)
+	}
+	if e.ErrorCode != "" {
+		fmt.Fprintf(&sb, ", errorCode %s (%s)", e.ErrorCode, e.ErrorDescription)
+	}
+	if e.ErrorComponent != "" {
+		fmt.Fprintf(&sb, ", errorComponent %s", e.ErrorComponent)
+	}
+	if e.ErrorDetail != "" {
+		fmt.Fprintf(&sb, ", errorDetail %q", e.ErrorDetail)
+	}
+	return sb.String()
+}
+
+// Retryable reports whether the same request may succeed if it is sent again later.
+func (e *ThreeDSError) Retryable() bool {
+	switch e.ErrorCode {
+	case EMVCoErrorTransactionTimedOut, EMVCoErrorTransientSystemFailure, EMVCoErrorSystemConnectionFailure:
+		return true
+	case "":
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+	return false
+}
+
+// ClientError reports whether the error was caused by the data sent by the merchant,
+// rather than a failure of the 3DS server, DS or ACS.
+func (e *ThreeDSError) ClientError() bool {
+	if e.ErrorCode != "" {
+		// 1xx message, 2xx data element and 3xx transaction errors are all caused by the request
+		return len(e.ErrorCode) == 3 && e.ErrorCode[0] >= '1' && e.ErrorCode[0] <= '3'
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests
+}
+
+// Code returns an error code which can be displayed by the merchant front-end.
+func (e *ThreeDSError) Code() string {
+	if e.ErrorCode != "" {
+		return "EMVCO_" + e.ErrorCode
+	}
+	return fmt.Sprintf("%s%d", ravelinErrorCodePrefix, e.StatusCode)
+}
+
+// merchantError converts an error returned when calling Ravelin's 3DS API into the HTTP status
+// code and error response returned to the merchant front-end.
+func merchantError(err error) (int, domain.MerchantErrorResponse) {
+	var threeDSErr *ThreeDSError
+	switch {
+	case errors.Is(err, ErrCardRangeNotFound):
+		return http.StatusNotFound, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeCardRangeNotFound,
+		}
+	case errors.Is(err, ErrUnauthorised):
+		return http.StatusUnauthorized, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeUnauthorised,
+		}
+	case errors.Is(err, ErrCircuitOpen):
+		return http.StatusServiceUnavailable, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeUnavailable,
+			Retryable: true,
+		}
+	case errors.Is(err, ErrApiKeyNotConfigured):
+		// a deployment error, which retrying will not fix
+		return http.StatusInternalServerError, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeNotConfigured,
+		}
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeRateLimited,
+			Retryable: true,
+		}
+	case errors.Is(err, ErrVelocityBlocked):
+		return http.StatusTooManyRequests, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     err.Error(),
+			ErrorCode: merchantErrorCodeVelocityBlocked,
+		}
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     "3ds server timed out",
+			ErrorCode: merchantErrorCodeTimeout,
+			Retryable: true,
+		}
+	case errors.As(err, &threeDSErr):
+		rsp := domain.MerchantErrorResponse{
+			Status:    "ERROR",
+			Error:     threeDSErr.ErrorDescription,
+			ErrorCode: threeDSErr.Code(),
+			Retryable: threeDSErr.Retryable(),
+		}
+		if rsp.Error == "" {
+			rsp.Error = threeDSErr.Message
+		}
+
+		switch {
+		case threeDSErr.Retryable():
+			return http.StatusServiceUnavailable, rsp
+		case threeDSErr.ClientError():
+			return http.StatusUnprocessableEntity, rsp
+		default:
+			return http.StatusBadGateway, rsp
+		}
+	}
+
+	return http.StatusInternalServerError, domain.MerchantErrorResponse{
+		Status:    "ERROR",
+		Error:     "internal error",
+		ErrorCode: merchantErrorCodeInternal,
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func Test_sendToRavelin3DSServer_errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		endpoint   string
+		status     int
+		body       string
+		wantErr    error
+		wantCode   string
+		wantStatus int
+	}{
+		{
+			name:       "card range not found",
+			endpoint:   domain.RavelinThreeDSVersionEndpoint,
+			status:     http.StatusNotFound,
+			wantErr:    ErrCardRangeNotFound,
+			wantCode:   merchantErrorCodeCardRangeNotFound,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unauthorised",
+			endpoint:   domain.RavelinThreeDSAuthenticateEndpoint,
+			status:     http.StatusUnauthorized,
+			wantErr:    ErrUnauthorised,
+			wantCode:   merchantErrorCodeUnauthorised,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "emvco data element error",
+			endpoint:   domain.RavelinThreeDSAuthenticateEndpoint,
+			status:     http.StatusBadRequest,
+			body:       `{"status":400,"message":"invalid request","data":{"errorCode":"203","errorComponent":"S","errorDescription":"Format of one or more data elements is invalid","errorDetail":"browserColorDepth","errorMessageType":"AReq"}}`,
+			wantCode:   "EMVCO_203",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "emvco transient failure",
+			endpoint:   domain.RavelinThreeDSAuthenticateEndpoint,
+			status:     http.StatusBadGateway,
+			body:       `{"status":502,"data":{"errorCode":"403","errorComponent":"D","errorDescription":"Transient system failure"}}`,
+			wantCode:   "EMVCO_403",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "ravelin server error without body",
+			endpoint:   domain.RavelinThreeDSResultEndpoint,
+			status:     http.StatusInternalServerError,
+			body:       `not json`,
+			wantCode:   "RAVELIN_500",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "ravelin bad request",
+			endpoint:   domain.RavelinThreeDSResultEndpoint,
+			status:     http.StatusBadRequest,
+			body:       `{"status":400,"message":"unknown threeDSServerTransID"}`,
+			wantCode:   "RAVELIN_400",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t)}
+			_, err := h.sendToRavelin3DSServer(context.Background(), http.MethodPost, struct{}{}, tt.endpoint)
+			if err == nil {
+				t.Fatal("expected non nil error")
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, actual: %v", tt.wantErr, err)
+			}
+
+			status, rsp := merchantError(err)
+			if status != tt.wantStatus {
+				t.Errorf("expected status %d, actual: %d", tt.wantStatus, status)
+			}
+			if rsp.ErrorCode != tt.wantCode {
+				t.Errorf("expected error code %s, actual: %s", tt.wantCode, rsp.ErrorCode)
+			}
+		})
+	}
+}
+
+func Test_newThreeDSErrorFromAuthenticateResponse(t *testing.T) {
+	if err := newThreeDSErrorFromAuthenticateResponse(&domain.RavelinAuthenticateResponseData{TransStatus: "Y"}); err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+
+	err := newThreeDSErrorFromAuthenticateResponse(&domain.RavelinAuthenticateResponseData{
+		ErrorCode:        EMVCoErrorRequiredDataElementMissing,
+		ErrorComponent:   "A",
+		ErrorDescription: "Required data element missing",
+		ErrorDetail:      "browserIP",
+		ErrorMessageType: "AReq",
+	})
+	if err == nil {
+		t.Fatal("expected non nil error")
+	}
+	if !err.ClientError() || err.Retryable() {
+		t.Errorf("expected permanent client error, actual: client %t, retryable %t", err.ClientError(), err.Retryable())
+	}
+}
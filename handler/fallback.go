@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+// Fallback decisions made when a payment cannot be authenticated with 3DS.
+const (
+	// FallbackProceedWithout3DS sends the payment for authorisation without authentication.
+	// No liability shift applies, so the merchant bears the risk of fraud chargebacks.
+	FallbackProceedWithout3DS = "PROCEED_WITHOUT_3DS"
+	// FallbackRetryLater asks the customer to try the payment again later.
+	FallbackRetryLater = "RETRY_LATER"
+	// FallbackDecline declines the payment.
+	FallbackDecline = "DECLINE"
+)
+
+// Types of 3DS failure which a fallback rule can match.
+const (
+	// FallbackErrorCardNotEnrolled is used when the card range is not found, so the card cannot be authenticated.
+	FallbackErrorCardNotEnrolled = "CARD_NOT_ENROLLED"
+	// FallbackErrorUnavailable is used when the 3DS server is unavailable, timed out or returned a transient error.
+	FallbackErrorUnavailable = "UNAVAILABLE"
+	// FallbackErrorRejected is used for any other error, such as the request being rejected.
+	FallbackErrorRejected = "REJECTED"
+)
+
+// defaultSCACountries are the ISO 3166-1 alpha-2 codes of the EEA countries and the UK, where
+// Strong Customer Authentication is required under PSD2.
+var defaultSCACountries = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GB", "GR", "HR", "HU", "IE", "IS",
+	"IT", "LI", "LT", "LU", "LV", "MT", "NL", "NO", "PL", "PT", "RO", "SE", "SI", "SK",
+}
+
+// FallbackRule matches a 3DS failure by its error type, whether SCA applies and the payment amount.
+// Empty conditions match any payment.
+type FallbackRule struct {
+	ErrorType   string `json:"errorType,omitempty"`
+	SCARequired *bool  `json:"scaRequired,omitempty"`
+	// MaxAmount is the largest amount, in minor units of Currency, the rule applies to. A rule with a
+	// MaxAmount only matches payments in its Currency, as amounts are never converted. Zero matches
+	// any amount in any currency.
+	MaxAmount int64  `json:"maxAmount,omitempty"`
+	Currency  string `json:"currency,omitempty"`
+	Decision  string `json:"decision"`
+}
+
+// FallbackPolicy decides what happens to a payment when it cannot be authenticated with 3DS.
+// Rules are evaluated in order and the first matching rule's decision is used. The default decision
+// is used if no rule matches.
+type FallbackPolicy struct {
+	SCACountries    []string       `json:"scaCountries"`
+	Rules           []FallbackRule `json:"rules"`
+	DefaultDecision string         `json:"defaultDecision"`
+}
+
+// DefaultFallbackPolicy proceeds without 3DS for cards which are not enrolled where SCA does not
+// apply, or for low value payments in euros exempt from SCA, and for payments of up to 100.00 when the
+// 3DS server is unavailable where SCA does not apply. It asks the customer to retry when the 3DS
+// server is otherwise unavailable, and declines everything else.
+func DefaultFallbackPolicy() *FallbackPolicy {
+	scaRequired, scaNotRequired := true, false
+	return &FallbackPolicy{
+		SCACountries: defaultSCACountries,
+		Rules: []FallbackRule{
+			{ErrorType: FallbackErrorCardNotEnrolled, SCARequired: &scaNotRequired, Decision: FallbackProceedWithout3DS},
+			// the low value exemption applies to payments of up to €30
+			{ErrorType: FallbackErrorCardNotEnrolled, SCARequired: &scaRequired, MaxAmount: 3000, Currency: "EUR", Decision: FallbackProceedWithout3DS},
+			{ErrorType: FallbackErrorUnavailable, SCARequired: &scaNotRequired, MaxAmount: 10000, Currency: "GBP", Decision: FallbackProceedWithout3DS},
+			{ErrorType: FallbackErrorUnavailable, SCARequired: &scaNotRequired, MaxAmount: 10000, Currency: "EUR", Decision: FallbackProceedWithout3DS},
+			{ErrorType: FallbackErrorUnavailable, SCARequired: &scaNotRequired, MaxAmount: 10000, Currency: "USD", Decision: FallbackProceedWithout3DS},
+			{ErrorType: FallbackErrorUnavailable, Decision: FallbackRetryLater},
+		},
+		DefaultDecision: FallbackDecline,
+	}
+}
+
+// LoadFallbackPolicy reads a FallbackPolicy from a JSON file.
+func LoadFallbackPolicy(path string) (*FallbackPolicy, error) {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fallback policy: %v", err)
+	}
+
+	policy := &FallbackPolicy{}
+	err = json.Unmarshal(bb, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fallback policy: %v", err)
+	}
+
+	err = policy.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func (p *FallbackPolicy) validate() error {
+	if !validFallbackDecision(p.DefaultDecision) {
+		return fmt.Errorf("invalid fallback policy: unknown default decision %q", p.DefaultDecision)
+	}
+
+	for i, rule := range p.Rules {
+		if !validFallbackDecision(rule.Decision) {
+			return fmt.Errorf("invalid fallback policy: rule %d has unknown decision %q", i, rule.Decision)
+		}
+
+		if rule.MaxAmount > 0 && rule.Currency == "" {
+			return fmt.Errorf("invalid fallback policy: rule %d has a maxAmount without a currency", i)
+		}
+
+		switch rule.ErrorType {
+		case "", FallbackErrorCardNotEnrolled, FallbackErrorUnavailable, FallbackErrorRejected:
+		default:
+			return fmt.Errorf("invalid fallback policy: rule %d has unknown error type %q", i, rule.ErrorType)
+		}
+	}
+
+	return nil
+}
+
+func validFallbackDecision(decision string) bool {
+	switch decision {
+	case FallbackProceedWithout3DS, FallbackRetryLater, FallbackDecline:
+		return true
+	}
+	return false
+}
+
+// Decide returns the fallback decision for a payment which could not be authenticated because of err.
+// The amount is in minor units of currency, an ISO 4217 alphabetic code. A nil *FallbackPolicy always
+// declines.
+func (p *FallbackPolicy) Decide(err error, amount int64, currency string, country string) domain.FallbackDecision {
+	errorType := fallbackErrorType(err)
+	_, errorResponse := merchantError(err)
+
+	decision := domain.FallbackDecision{
+		Decision:  FallbackDecline,
+		ErrorType: errorType,
+		ErrorCode: errorResponse.ErrorCode,
+	}
+	if p == nil {
+		return decision
+	}
+
+	scaRequired := p.scaRequired(country)
+	decision.SCARequired = scaRequired
+	decision.Decision = p.DefaultDecision
+
+	for _, rule := range p.Rules {
+		if rule.ErrorType != "" && rule.ErrorType != errorType {
+			continue
+		}
+		if rule.SCARequired != nil && *rule.SCARequired != scaRequired {
+			continue
+		}
+		if rule.MaxAmount > 0 && (!strings.EqualFold(rule.Currency, currency) || amount > rule.MaxAmount) {
+			continue
+		}
+
+		decision.Decision = rule.Decision
+		break
+	}
+
+	return decision
+}
+
+// scaRequired reports whether SCA applies to a payment from the given country. Payments from an
+// unknown country are treated as requiring SCA.
+func (p *FallbackPolicy) scaRequired(country string) bool {
+	if country == "" {
+		return true
+	}
+
+	for _, c := range p.SCACountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackErrorType classifies an error returned when calling Ravelin's 3DS API.
+func fallbackErrorType(err error) string {
+	if errors.Is(err, ErrCardRangeNotFound) {
+		return FallbackErrorCardNotEnrolled
+	}
+
+	if isRetryable(err) {
+		return FallbackErrorUnavailable
+	}
+
+	return FallbackErrorRejected
+}
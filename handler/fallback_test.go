@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestFallbackPolicy_Decide(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		amount        int64
+		currency      string
+		country       string
+		wantDecision  string
+		wantErrorType string
+	}{
+		{
+			name:          "card not enrolled outside SCA region",
+			err:           ErrCardRangeNotFound,
+			amount:        8000,
+			currency:      "USD",
+			country:       "US",
+			wantDecision:  FallbackProceedWithout3DS,
+			wantErrorType: FallbackErrorCardNotEnrolled,
+		},
+		{
+			name:          "card not enrolled low value in SCA region",
+			err:           ErrCardRangeNotFound,
+			amount:        3000,
+			currency:      "eur",
+			country:       "fr",
+			wantDecision:  FallbackProceedWithout3DS,
+			wantErrorType: FallbackErrorCardNotEnrolled,
+		},
+		{
+			name:          "card not enrolled low value in another currency",
+			err:           ErrCardRangeNotFound,
+			amount:        3000,
+			currency:      "GBP",
+			country:       "GB",
+			wantDecision:  FallbackDecline,
+			wantErrorType: FallbackErrorCardNotEnrolled,
+		},
+		{
+			name:          "card not enrolled in SCA region",
+			err:           ErrCardRangeNotFound,
+			amount:        8000,
+			currency:      "EUR",
+			country:       "FR",
+			wantDecision:  FallbackDecline,
+			wantErrorType: FallbackErrorCardNotEnrolled,
+		},
+		{
+			name:          "unknown country requires SCA",
+			err:           ErrCardRangeNotFound,
+			amount:        8000,
+			currency:      "EUR",
+			wantDecision:  FallbackDecline,
+			wantErrorType: FallbackErrorCardNotEnrolled,
+		},
+		{
+			name:          "circuit open in SCA region",
+			err:           ErrCircuitOpen,
+			amount:        8000,
+			currency:      "GBP",
+			country:       "GB",
+			wantDecision:  FallbackRetryLater,
+			wantErrorType: FallbackErrorUnavailable,
+		},
+		{
+			name:          "server error outside SCA region",
+			err:           &ThreeDSError{StatusCode: http.StatusInternalServerError},
+			amount:        8000,
+			currency:      "USD",
+			country:       "US",
+			wantDecision:  FallbackProceedWithout3DS,
+			wantErrorType: FallbackErrorUnavailable,
+		},
+		{
+			name:          "server error high value outside SCA region",
+			err:           &ThreeDSError{StatusCode: http.StatusInternalServerError},
+			amount:        20000,
+			currency:      "USD",
+			country:       "US",
+			wantDecision:  FallbackRetryLater,
+			wantErrorType: FallbackErrorUnavailable,
+		},
+		{
+			name:          "rejected",
+			err:           ErrUnauthorised,
+			amount:        100,
+			currency:      "USD",
+			country:       "US",
+			wantDecision:  FallbackDecline,
+			wantErrorType: FallbackErrorRejected,
+		},
+	}
+
+	policy := DefaultFallbackPolicy()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := policy.Decide(tt.err, tt.amount, tt.currency, tt.country)
+			if decision.Decision != tt.wantDecision {
+				t.Errorf("expected: %v, actual: %v", tt.wantDecision, decision.Decision)
+			}
+			if decision.ErrorType != tt.wantErrorType {
+				t.Errorf("expected: %v, actual: %v", tt.wantErrorType, decision.ErrorType)
+			}
+		})
+	}
+}
+
+func TestLoadFallbackPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			policy: `{"scaCountries":["GB"],"rules":[{"errorType":"UNAVAILABLE","decision":"RETRY_LATER"}],"defaultDecision":"DECLINE"}`,
+		},
+		{
+			name:    "unknown decision",
+			policy:  `{"rules":[{"decision":"ALLOW"}],"defaultDecision":"DECLINE"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown error type",
+			policy:  `{"rules":[{"errorType":"TIMEOUT","decision":"DECLINE"}],"defaultDecision":"DECLINE"}`,
+			wantErr: true,
+		},
+		{
+			name:    "max amount without currency",
+			policy:  `{"rules":[{"maxAmount":3000,"decision":"PROCEED_WITHOUT_3DS"}],"defaultDecision":"DECLINE"}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing default decision",
+			policy:  `{"rules":[]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(tt.policy), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadFallbackPolicy(path)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("expected error: %v, actual: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHandler_Checkout_fallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	scaRequired := true
+	policy := &FallbackPolicy{
+		SCACountries:    []string{exampleOrder.MerchantCountry},
+		Rules:           []FallbackRule{{ErrorType: FallbackErrorCardNotEnrolled, SCARequired: &scaRequired, MaxAmount: exampleOrder.Amount, Currency: exampleOrder.CurrencyCode, Decision: FallbackProceedWithout3DS}},
+		DefaultDecision: FallbackDecline,
+	}
+	h := Handler{
+		RavelinApiUrl:           server.URL,
+		RavelinApiKeys:          testApiKeys(t),
+		FallbackPolicy:          policy,
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+
+	// the decision is made for the order held by the merchant backend
+	body, _ := json.Marshal(domain.MerchantCheckoutRequest{AccountNumber: "4000000000001000"})
+	w := httptest.NewRecorder()
+	h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %d, actual: %d", http.StatusOK, w.Code)
+	}
+
+	rsp := domain.MerchantCheckoutResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Fallback == nil || rsp.Fallback.Decision != FallbackProceedWithout3DS {
+		t.Fatalf("expected: %s, actual: %+v", FallbackProceedWithout3DS, rsp.Fallback)
+	}
+	if rsp.Fallback.ErrorCode != merchantErrorCodeCardRangeNotFound {
+		t.Errorf("expected: %s, actual: %s", merchantErrorCodeCardRangeNotFound, rsp.Fallback.ErrorCode)
+	}
+}
+
+func TestHandler_Checkout_fallbackMerchantCountry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		merchantCountry string
+		wantDecision    string
+	}{
+		{merchantCountry: "", wantDecision: FallbackDecline},
+		{merchantCountry: "us", wantDecision: FallbackProceedWithout3DS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.merchantCountry, func(t *testing.T) {
+			h := Handler{
+				RavelinApiUrl:           server.URL,
+				RavelinApiKeys:          testApiKeys(t),
+				MerchantCountry:         tt.merchantCountry,
+				FallbackPolicy:          DefaultFallbackPolicy(),
+				ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+			}
+
+			// the default policy only proceeds for a card which is not enrolled where SCA does not apply
+			w := httptest.NewRecorder()
+			h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader([]byte(`{"accountNumber":"4000000000001000"}`))))
+			rsp := domain.MerchantCheckoutResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Fallback == nil || rsp.Fallback.Decision != tt.wantDecision {
+				t.Errorf("expected: %s, actual: %+v", tt.wantDecision, rsp.Fallback)
+			}
+		})
+	}
+}
+
+func TestHandler_Checkout_apiKeyNotConfigured(t *testing.T) {
+	h := Handler{FallbackPolicy: DefaultFallbackPolicy(), ThreeDSTransactionStore: NewThreeDSTransactionStore()}
+
+	// a missing api key is a deployment error, so the payment is not declined by the fallback policy
+	w := httptest.NewRecorder()
+	h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader([]byte(`{"accountNumber":"4000000000001000"}`))))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected: %d, actual: %d", http.StatusInternalServerError, w.Code)
+	}
+
+	rsp := domain.MerchantErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.ErrorCode != merchantErrorCodeNotConfigured || rsp.Retryable {
+		t.Errorf("expected: %s not retryable, actual: %+v", merchantErrorCodeNotConfigured, rsp)
+	}
+}
+
+func TestHandler_Checkout_fallbackAmountFromBrowser(t *testing.T) {
+	h := Handler{FallbackPolicy: DefaultFallbackPolicy(), ThreeDSTransactionStore: NewThreeDSTransactionStore()}
+
+	// the amount is not taken from the browser, so a lower amount cannot be used to avoid 3DS
+	w := httptest.NewRecorder()
+	h.Checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, bytes.NewReader([]byte(`{"accountNumber":"4000000000001000","amount":1}`))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected: %d, actual: %d", http.StatusBadRequest, w.Code)
+	}
+}
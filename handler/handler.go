@@ -1,100 +1,94 @@
 package handler
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
+	"time"
 
-	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/unravelin/ravelin-3ds-demo/audit"
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/metrics"
+	"github.com/unravelin/ravelin-3ds-demo/tracing"
+	"github.com/unravelin/ravelin-3ds-demo/vault"
 )
 
 const (
 	jsonContentType = "application/json;charset=UTF-8"
 
+	threeDSServerTransIDAttribute = "threeds.server_trans_id"
+
 	CheckoutEndpoint              = "/checkout"
 	AuthenticateEndpoint          = "/authenticate"
 	MethodNotificationEndpoint    = "/method-notification"
 	ChallengeNotificationEndpoint = "/challenge-notification"
 	TestCardsEndpoint             = "/test-cards"
+	ResultsEndpoint               = "/results"
+	OperatorTransactionsEndpoint  = "/operator/transactions"
+	MetricsEndpoint               = "/metrics"
+	HealthzEndpoint               = "/healthz"
+	ReadyzEndpoint                = "/readyz"
 )
 
 type Handler struct {
 	RavelinApiUrl                         string
-	RavelinApiKey                         string
+	RavelinApiKeys                        *ApiKeys
 	MerchantUrl                           string
+	MerchantCountry                       string
+	ResultsToken                          string
+	OperatorToken                         string
+	StrictBase64Decoding                  bool
+	SessionDataSigner                     *SessionDataSigner
+	Metrics                               *metrics.Metrics
+	AuditLog                              *audit.Log
+	HTTPClient                            *http.Client
+	RavelinTimeouts                       map[string]time.Duration
+	RavelinMaxRetries                     int
+	CircuitBreaker                        *CircuitBreaker
+	FallbackPolicy                        *FallbackPolicy
+	APIKeyCheck                           *APIKeyCheck
+	AbuseProtection                       *AbuseProtection
+	CardVault                             *vault.Vault
+	Customers                             *customer.Store
+	MaxRequestBytes                       int64
+	TrustedProxies                        TrustedProxies
+	Version                               string
+	Config                                map[string]string
 	ThreeDSTransactionStore               ThreeDSTransactionStore
 	MethodNotificationResponseTemplate    *template.Template
 	ChallengeNotificationResponseTemplate *template.Template
-}
-
-func (h Handler) sendToRavelin3DSServer(method string, body interface{}, endpoint string) (*http.Response, error) {
-	var requestBody io.Reader
-
-	if body == nil || method == http.MethodGet {
-		requestBody = http.NoBody
-	} else {
-		bodyBytes, err := json.Marshal(body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal threeds request: %v", err)
-		}
-
-		requestBody = bytes.NewBuffer(bodyBytes)
-	}
-
-	apiURL := h.RavelinApiUrl + endpoint
-
-	request, err := http.NewRequest(method, apiURL, requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	request.Header.Set("Authorization", "token "+h.RavelinApiKey)
-	request.Header.Set("Content-Type", jsonContentType)
-
-	rsp, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return nil, fmt.Errorf("http request fail: %v", err)
-	}
-
-	if rsp.StatusCode == http.StatusNotFound && endpoint == domain.RavelinThreeDSVersionEndpoint {
-		return nil, ErrCardRangeNotFound
-	}
-
-	if rsp.StatusCode == http.StatusUnauthorized {
-		return nil, ErrUnauthorised
-	}
-
-	if rsp.StatusCode != 200 {
-		body, err := readBody(rsp.Body)
-		if err == nil {
-			log.Default().Printf("response body: %s\n", string(body))
-		}
-		return nil, fmt.Errorf("received bad status code %s ", rsp.Status)
-	}
-
-	return rsp, nil
+	IndexTemplate                         *template.Template
 }
 
 func respond(data interface{}, rw http.ResponseWriter) {
 	bb, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("failed to encode data for response: %v", err)
+		logging.Default().Error("failed to encode data for response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	_, err = rw.Write(bb)
 	if err != nil {
-		log.Printf("failed to write response: %v", err)
+		logging.Default().Error("failed to write response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// respondError writes the merchant error response for an error returned when calling Ravelin's 3DS API.
+func respondError(err error, rw http.ResponseWriter) {
+	status, errorResponse := merchantError(err)
+	rw.WriteHeader(status)
+	respond(errorResponse, rw)
+}
+
 func readBody(rc io.ReadCloser) ([]byte, error) {
 	defer rc.Close()
 
@@ -107,12 +101,52 @@ func readBody(rc io.ReadCloser) ([]byte, error) {
 }
 
 func addCommonHeaders(rw http.ResponseWriter, contentType string) {
-	rw.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
-	rw.Header().Set("X-Content-Type-Options", "nosniff")
 	rw.Header().Set("Content-Type", contentType)
-	rw.Header().Set("Access-Control-Allow-Origin", "*")
-	rw.Header().Set("Access-Control-Allow-Methods", "POST")
-	rw.Header().Set("Access-Control-Allow-Headers", "*")
+}
+
+// joinTransactionTrace starts a span in the trace started by the checkout which created the
+// transaction, so that every request in the 3DS journey appears in a single trace.
+// The returned request carries the new span in its context.
+func (h Handler) joinTransactionTrace(r *http.Request, threeDSServerTransID string, name string) (*http.Request, trace.Span) {
+	tx, _ := h.ThreeDSTransactionStore.Get(threeDSServerTransID)
+	ctx, span := tracing.JoinTrace(r.Context(), tx.TraceContext, name, attribute.String(threeDSServerTransIDAttribute, threeDSServerTransID))
+	return r.WithContext(ctx), span
+}
+
+// audit records a message exchanged for the transaction in the audit log.
+func (h Handler) audit(r *http.Request, threeDSServerTransID string, messageType string, payload interface{}) {
+	err := h.AuditLog.Record(threeDSServerTransID, messageType, payload)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to record audit entry", "messageType", messageType, "error", err)
+	}
+}
+
+// auditedFailure is the payload recorded when a request to Ravelin's 3DS API fails.
+type auditedFailure struct {
+	Endpoint   string `json:"endpoint"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error"`
+}
+
+// auditFailure records that a request to endpoint for the transaction received no usable response,
+// because it could not be sent, was answered with an error status or could not be decoded.
+func (h Handler) auditFailure(r *http.Request, threeDSServerTransID string, endpoint string, err error) {
+	failure := auditedFailure{Endpoint: endpoint, Error: err.Error()}
+	var threeDSErr *ThreeDSError
+	if errors.As(err, &threeDSErr) {
+		failure.StatusCode = threeDSErr.StatusCode
+	}
+	h.audit(r, threeDSServerTransID, audit.MessageFailure, failure)
+}
+
+// transactionLogger adds the transaction and the correlation ID recorded when it was created
+// to the logger, so log entries across the whole 3DS journey can be tied together.
+func (h Handler) transactionLogger(logger *logging.Logger, threeDSServerTransID string) *logging.Logger {
+	logger = logger.With("threeDSServerTransID", threeDSServerTransID)
+	if tx, ok := h.ThreeDSTransactionStore.Get(threeDSServerTransID); ok && tx.CorrelationID != "" {
+		logger = logger.With("correlationID", tx.CorrelationID)
+	}
+	return logger
 }
 
 func getLastFour(pan string) string {
@@ -1,6 +1,18 @@
 package handler
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/audit"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
 
 func Test_getLastFour(t *testing.T) {
 	tests := []struct {
@@ -21,3 +33,91 @@ func Test_getLastFour(t *testing.T) {
 		})
 	}
 }
+
+func Test_cardScheme(t *testing.T) {
+	tests := []struct {
+		pan  string
+		want string
+	}{
+		{pan: "4000000000001000", want: "visa"},
+		{pan: "5200000000001005", want: "mastercard"},
+		{pan: "2221000000000009", want: "mastercard"},
+		{pan: "340000000001007", want: "amex"},
+		{pan: "6011000000001003", want: "discover"},
+		{pan: "3528000000001002", want: "jcb"},
+		{pan: "36000000001008", want: "diners"},
+		{pan: "6200000000001005", want: "unionpay"},
+		{pan: "9999999999999999", want: "unknown"},
+		{pan: "", want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pan, func(t *testing.T) {
+			if got := cardScheme(tt.pan); got != tt.want {
+				t.Errorf("cardScheme() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_Checkout_auditFailure(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		body           string
+		wantStatusCode int
+	}{
+		{name: "error status", status: http.StatusInternalServerError, body: `{"message":"internal error"}`, wantStatusCode: http.StatusInternalServerError},
+		{name: "invalid body", status: http.StatusOK, body: `{`},
+		{name: "no data", status: http.StatusOK, body: `{"status":200}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			path := filepath.Join(t.TempDir(), "audit.log")
+			auditLog, err := audit.Open(path, []byte("test-audit-key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer auditLog.Close()
+
+			h := Handler{
+				RavelinApiUrl:           server.URL,
+				RavelinApiKeys:          testApiKeys(t),
+				FallbackPolicy:          DefaultFallbackPolicy(),
+				AuditLog:                auditLog,
+				ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+			}
+			h.Checkout(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"4000000000001000"}`)))
+
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := bytes.Split(bytes.TrimSpace(contents), []byte("\n"))
+			if len(lines) != 2 {
+				t.Fatalf("expected: %d entries, actual: %d", 2, len(lines))
+			}
+
+			entry := audit.Entry{}
+			if err := json.Unmarshal(lines[1], &entry); err != nil {
+				t.Fatal(err)
+			}
+			failure := auditedFailure{}
+			if err := json.Unmarshal(entry.Payload, &failure); err != nil {
+				t.Fatal(err)
+			}
+			if entry.MessageType != audit.MessageFailure || failure.Endpoint != domain.RavelinThreeDSVersionEndpoint {
+				t.Errorf("expected: %v, actual: %v", audit.MessageFailure+" "+domain.RavelinThreeDSVersionEndpoint, entry.MessageType+" "+failure.Endpoint)
+			}
+			if failure.StatusCode != tt.wantStatusCode {
+				t.Errorf("expected: %d, actual: %d", tt.wantStatusCode, failure.StatusCode)
+			}
+		})
+	}
+}
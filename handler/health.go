@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+// Readiness check statuses.
+const (
+	CheckStatusOK       = "ok"
+	CheckStatusDegraded = "degraded"
+	CheckStatusFailed   = "failed"
+	CheckStatusUnknown  = "unknown"
+)
+
+const defaultAPIKeyCheckTTL = time.Minute
+
+// Healthz reports that the process is alive. It does not check any dependencies.
+func (h Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	addCommonHeaders(w, jsonContentType)
+	respond(domain.HealthResponse{Status: CheckStatusOK}, w)
+}
+
+// Readyz reports whether the server is ready to handle checkouts: the templates have loaded, the
+// transaction store is reachable and the Ravelin API key is valid. It also reports the build version
+// and configuration, which must have had any secrets redacted.
+//
+// The API key is checked with a /3ds/testcards request, which is cached so probes do not hammer
+// Ravelin's API. If the API cannot be reached the key is reported as unknown without failing readiness,
+// as there is nothing restarting or removing this server would fix. If the primary key is rejected but
+// the secondary key is accepted the server stays ready, but is reported as degraded so the primary key
+// can be rotated before the secondary expires too.
+func (h Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	addCommonHeaders(w, jsonContentType)
+
+	rsp := domain.ReadinessResponse{
+		Status:  CheckStatusOK,
+		Version: h.Version,
+		Config:  h.Config,
+		Checks: map[string]domain.CheckResult{
+			"templates": checkResult(h.checkTemplates()),
+			"store":     checkResult(h.ThreeDSTransactionStore.Ping()),
+			"apiKey":    h.APIKeyCheck.Check(r.Context(), h.checkAPIKey),
+		},
+	}
+
+	status := http.StatusOK
+	for _, check := range rsp.Checks {
+		switch {
+		case check.Status == CheckStatusFailed:
+			rsp.Status = CheckStatusFailed
+			status = http.StatusServiceUnavailable
+		case check.Status == CheckStatusDegraded && rsp.Status == CheckStatusOK:
+			rsp.Status = CheckStatusDegraded
+		}
+	}
+
+	if rsp.Status != CheckStatusOK {
+		logging.FromContext(r.Context()).Warn("not ready", "checks", rsp.Checks)
+	}
+
+	w.WriteHeader(status)
+	respond(rsp, w)
+}
+
+func (h Handler) checkTemplates() error {
+	if h.MethodNotificationResponseTemplate == nil || h.ChallengeNotificationResponseTemplate == nil || h.IndexTemplate == nil {
+		return errors.New("templates not loaded")
+	}
+	return nil
+}
+
+func (h Handler) checkAPIKey(ctx context.Context) domain.CheckResult {
+	_, err := h.sendToRavelin3DSServer(ctx, http.MethodGet, nil, domain.RavelinThreeDSTestCardsEndpoint)
+	switch {
+	case err == nil && h.RavelinApiKeys.PrimaryRejected():
+		return domain.CheckResult{Status: CheckStatusDegraded, Error: "primary ravelin api key unauthorised, using the secondary key"}
+	case err == nil:
+		return domain.CheckResult{Status: CheckStatusOK}
+	case errors.Is(err, ErrUnauthorised), errors.Is(err, ErrApiKeyNotConfigured):
+		return domain.CheckResult{Status: CheckStatusFailed, Error: err.Error()}
+	default:
+		return domain.CheckResult{Status: CheckStatusUnknown, Error: err.Error()}
+	}
+}
+
+func checkResult(err error) domain.CheckResult {
+	if err != nil {
+		return domain.CheckResult{Status: CheckStatusFailed, Error: err.Error()}
+	}
+	return domain.CheckResult{Status: CheckStatusOK}
+}
+
+// APIKeyCheck caches the result of checking the Ravelin API key. A nil *APIKeyCheck does not cache.
+type APIKeyCheck struct {
+	mu        *sync.Mutex
+	ttl       time.Duration
+	now       func() time.Time
+	result    domain.CheckResult
+	checkedAt time.Time
+}
+
+// NewAPIKeyCheck creates an APIKeyCheck which caches the result for ttl.
+func NewAPIKeyCheck(ttl time.Duration) *APIKeyCheck {
+	if ttl <= 0 {
+		ttl = defaultAPIKeyCheckTTL
+	}
+
+	return &APIKeyCheck{
+		mu:  &sync.Mutex{},
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// Check returns the cached result, calling check if it has expired. Concurrent callers wait for
+// a single call to check rather than each calling Ravelin's API. A result is not cached if ctx
+// was cancelled or timed out during the check, as it says nothing about the API key.
+func (c *APIKeyCheck) Check(ctx context.Context, check func(context.Context) domain.CheckResult) domain.CheckResult {
+	if c == nil {
+		return check(ctx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && c.now().Sub(c.checkedAt) < c.ttl {
+		return c.result
+	}
+
+	result := check(ctx)
+	if ctx.Err() != nil {
+		return result
+	}
+
+	c.result = result
+	c.checkedAt = c.now()
+	return c.result
+}
+
+// Reset clears the cached result, so the next check calls Ravelin's API.
+func (c *APIKeyCheck) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkedAt = time.Time{}
+}
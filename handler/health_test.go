@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestHandler_Readyz(t *testing.T) {
+	tmpl := template.Must(template.New("template").Parse(""))
+
+	tests := []struct {
+		name          string
+		ravelinStatus int
+		templates     bool
+		wantStatus    int
+		wantAPIKey    string
+	}{
+		{
+			name:          "ready",
+			ravelinStatus: http.StatusOK,
+			templates:     true,
+			wantStatus:    http.StatusOK,
+			wantAPIKey:    CheckStatusOK,
+		},
+		{
+			name:          "invalid api key",
+			ravelinStatus: http.StatusUnauthorized,
+			templates:     true,
+			wantStatus:    http.StatusServiceUnavailable,
+			wantAPIKey:    CheckStatusFailed,
+		},
+		{
+			name:          "ravelin unavailable",
+			ravelinStatus: http.StatusServiceUnavailable,
+			templates:     true,
+			wantStatus:    http.StatusOK,
+			wantAPIKey:    CheckStatusUnknown,
+		},
+		{
+			name:          "templates not loaded",
+			ravelinStatus: http.StatusOK,
+			wantStatus:    http.StatusServiceUnavailable,
+			wantAPIKey:    CheckStatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.ravelinStatus)
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			h := Handler{
+				RavelinApiUrl:           server.URL,
+				RavelinApiKeys:          testApiKeys(t),
+				Version:                 "test",
+				Config:                  map[string]string{"ravelin-api-key": "[REDACTED]"},
+				ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+			}
+			if tt.templates {
+				h.MethodNotificationResponseTemplate = tmpl
+				h.ChallengeNotificationResponseTemplate = tmpl
+				h.IndexTemplate = tmpl
+			}
+
+			w := httptest.NewRecorder()
+			h.Readyz(w, httptest.NewRequest(http.MethodGet, ReadyzEndpoint, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+
+			rsp := domain.ReadinessResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Checks["apiKey"].Status != tt.wantAPIKey {
+				t.Errorf("expected: %s, actual: %s", tt.wantAPIKey, rsp.Checks["apiKey"].Status)
+			}
+			if rsp.Version != "test" || rsp.Config["ravelin-api-key"] != "[REDACTED]" {
+				t.Errorf("expected version and config to be reported, actual: %+v", rsp)
+			}
+		})
+	}
+}
+
+func TestAPIKeyCheck_Check(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	check := NewAPIKeyCheck(time.Minute)
+	check.now = func() time.Time { return now }
+
+	h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t), APIKeyCheck: check}
+	for i := 0; i < 3; i++ {
+		h.APIKeyCheck.Check(httptest.NewRequest(http.MethodGet, ReadyzEndpoint, nil).Context(), h.checkAPIKey)
+	}
+	if actual := atomic.LoadInt32(&requests); actual != 1 {
+		t.Errorf("expected requests: %d, actual: %d", 1, actual)
+	}
+
+	now = now.Add(time.Minute)
+	h.APIKeyCheck.Check(httptest.NewRequest(http.MethodGet, ReadyzEndpoint, nil).Context(), h.checkAPIKey)
+	if actual := atomic.LoadInt32(&requests); actual != 2 {
+		t.Errorf("expected requests: %d, actual: %d", 2, actual)
+	}
+}
+
+func TestAPIKeyCheck_Check_cancelled(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	h := Handler{RavelinApiUrl: server.URL, RavelinApiKeys: testApiKeys(t), APIKeyCheck: NewAPIKeyCheck(time.Minute)}
+
+	// the probe gave up before the check completed, so its result is not cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.APIKeyCheck.Check(ctx, h.checkAPIKey)
+
+	result := h.APIKeyCheck.Check(context.Background(), h.checkAPIKey)
+	if result.Status != CheckStatusOK {
+		t.Errorf("expected: %v, actual: %v", CheckStatusOK, result.Status)
+	}
+	if actual := atomic.LoadInt32(&requests); actual != 1 {
+		t.Errorf("expected requests: %d, actual: %d", 1, actual)
+	}
+}
+
+func TestHandler_Readyz_primaryKeyRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secondary" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	keys, err := NewApiKeys(ApiKey{Primary: "primary", Secondary: "secondary"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template.Must(template.New("template").Parse(""))
+	h := Handler{
+		RavelinApiUrl:                         server.URL,
+		RavelinApiKeys:                        keys,
+		MethodNotificationResponseTemplate:    tmpl,
+		ChallengeNotificationResponseTemplate: tmpl,
+		IndexTemplate:                         tmpl,
+		ThreeDSTransactionStore:               NewThreeDSTransactionStore(),
+	}
+
+	// the server keeps working with the secondary key, but the primary key needs rotating
+	w := httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest(http.MethodGet, ReadyzEndpoint, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected: %d, actual: %d", http.StatusOK, w.Code)
+	}
+
+	rsp := domain.ReadinessResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != CheckStatusDegraded || rsp.Checks["apiKey"].Status != CheckStatusDegraded {
+		t.Errorf("expected: %s, actual: %+v", CheckStatusDegraded, rsp)
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+// IndexPage is the data passed to the checkout page template.
+type IndexPage struct {
+	Nonce string
+}
+
+// FrontEnd serves the checkout page, rendered with the request's CSP nonce on its scripts,
+// and serves the front-end's static files from static.
+func (h Handler) FrontEnd(static http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			static.ServeHTTP(w, r)
+			return
+		}
+
+		addCommonHeaders(w, "text/html;charset=UTF-8")
+		err := h.IndexTemplate.Execute(w, IndexPage{Nonce: cspNonce(r.Context())})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to write checkout page", "error", err)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package handler
 
 import (
-	"log"
 	"net/http"
 
+	"github.com/unravelin/ravelin-3ds-demo/audit"
 	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
 )
 
 // MethodNotification is called by the customer's browser when the ACS has completed collecting
@@ -18,25 +19,46 @@ func (h Handler) MethodNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Handling %s request", MethodNotificationEndpoint)
+	logger := logging.FromContext(r.Context())
+	logger.Info("Handling request", "endpoint", MethodNotificationEndpoint)
 
 	methodNotificationResponse := &domain.MethodNotificationResponse{}
-	err := decodeFormData(r, "threeDSMethodData", methodNotificationResponse)
+	err := h.decodeFormRequest(w, r, "threeDSMethodData", methodNotificationResponse)
 	if err != nil {
-		log.Printf("failed to decode Method Notification Response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Warn("failed to decode Method Notification Response", "error", err)
+		respondRequestError(err, w)
 		return
 	}
 
+	logger = h.transactionLogger(logger, methodNotificationResponse.ThreeDSServerTransID)
+
+	r, span := h.joinTransactionTrace(r, methodNotificationResponse.ThreeDSServerTransID, "threeds.method_notification")
+	defer span.End()
+
+	logger.Info("Method notification received")
+	h.audit(r, methodNotificationResponse.ThreeDSServerTransID, audit.MessageMethodNotification, methodNotificationResponse)
+
 	err = h.ThreeDSTransactionStore.SetMethodStatus(methodNotificationResponse.ThreeDSServerTransID, MethodStatusCompleted)
 	if err != nil {
-		log.Printf("failed to set method status for threeDSServerID %s: %v", methodNotificationResponse.ThreeDSServerTransID, err)
+		logger.Error("failed to set method status", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	err = h.MethodNotificationResponseTemplate.Execute(w, methodNotificationResponse.ThreeDSServerTransID)
+	err = h.MethodNotificationResponseTemplate.Execute(w, MethodNotificationResult{
+		ThreeDSServerTransID: methodNotificationResponse.ThreeDSServerTransID,
+		TargetOrigin:         h.merchantOrigin(),
+		Nonce:                cspNonce(r.Context()),
+	})
 	if err != nil {
-		log.Printf("failed to write method notification response - %s", err)
+		logger.Error("failed to write method notification response", "error", err)
 	}
 }
+
+// MethodNotificationResult is the data passed to the method notification response template.
+type MethodNotificationResult struct {
+	ThreeDSServerTransID string
+	// TargetOrigin is the merchant origin the notification is posted to.
+	TargetOrigin string
+	Nonce        string
+}
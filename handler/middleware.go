@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/statuswriter"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9\-_.]{1,64}$`)
+
+type requestIDContextKey struct{}
+
+// RequestLogging assigns each request an ID, taken from the X-Request-ID header if present,
+// and adds a logger carrying that ID to the request context. A summary of every request
+// is logged once it has been handled.
+func RequestLogging(logger *logging.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		requestLogger := logger.With("requestID", requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, requestID)
+		ctx = logging.NewContext(ctx, requestLogger)
+
+		start := time.Now()
+		sw := statuswriter.Wrap(w)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		requestLogger.Debug("Request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.Status(),
+			"durationMs", time.Since(start).Milliseconds())
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
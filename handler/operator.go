@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+)
+
+// OperatorTransactions lists the transactions in the store for operators, including the
+// cardholderInfo and broadInfo received from the issuer and DS.
+func (h Handler) OperatorTransactions(w http.ResponseWriter, r *http.Request) {
+	addCommonHeaders(w, jsonContentType)
+
+	if r.Method != http.MethodGet {
+		respondRequestError(errMethodNotAllowed, w)
+		return
+	}
+
+	if !tokenAuthorised(r, h.OperatorToken) {
+		logging.FromContext(r.Context()).Warn("unauthorised request", "endpoint", OperatorTransactionsEndpoint)
+		respondRequestError(errRequestUnauthorised, w)
+		return
+	}
+
+	all := h.ThreeDSTransactionStore.All()
+	transactions := make([]domain.OperatorTransaction, 0, len(all))
+	for id, tx := range all {
+		transaction := domain.OperatorTransaction{
+			ThreeDSServerTransID:    id,
+			MessageVersion:          tx.MessageVersion,
+			MethodStatus:            tx.MethodStatus,
+			AuthenticateTransStatus: tx.AuthenticateTransStatus,
+			CardholderInfo:          tx.CardholderInfo,
+			BroadInfo:               tx.BroadInfo,
+		}
+		if tx.Result != nil {
+			transaction.ResultTransStatus = tx.Result.TransStatus
+			transaction.ResultSource = tx.Result.Source
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].ThreeDSServerTransID < transactions[j].ThreeDSServerTransID
+	})
+
+	respond(transactions, w)
+}
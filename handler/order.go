@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+)
+
+// exampleOrder is the order paid for by the demo checkout. A live implementation would look up the
+// customer's order on the merchant backend, so that neither the amount authenticated nor the
+// fallback policy's decision can be changed by the browser. The amount is the £80 basket shown on
+// the checkout page.
+var exampleOrder = order{
+	Amount:          8000,
+	Currency:        "826",
+	CurrencyCode:    "GBP",
+	Exponent:        "2",
+	MerchantCountry: "GB",
+}
+
+type order struct {
+	// Amount is in the minor units of Currency.
+	Amount int64
+	// Currency is the ISO 4217 numeric currency code, CurrencyCode its alphabetic code and
+	// Exponent its number of minor units.
+	Currency     string
+	CurrencyCode string
+	Exponent     string
+	// MerchantCountry is the ISO 3166-1 alpha-2 code of the country the merchant trades from, which
+	// decides whether SCA applies.
+	MerchantCountry string
+}
+
+// order returns the order paid for by the checkout, traded from the configured merchant country.
+func (h Handler) order() order {
+	o := exampleOrder
+	if h.MerchantCountry != "" {
+		o.MerchantCountry = strings.ToUpper(h.MerchantCountry)
+	}
+	return o
+}
+
+// purchaseAmount returns the amount as sent in the AReq's purchaseAmount.
+func (o order) purchaseAmount() string {
+	return strconv.FormatInt(o.Amount, 10)
+}
+
+// merchantCountryCode returns the merchant's country as sent in the AReq's merchantCountryCode.
+func (o order) merchantCountryCode() string {
+	code, _ := countryNumericCode(o.MerchantCountry)
+	return code
+}
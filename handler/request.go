@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+// DefaultMaxRequestBytes is the largest request body accepted when Handler.MaxRequestBytes is not set.
+// It is far larger than any checkout, authenticate or notification request.
+const DefaultMaxRequestBytes = 64 << 10
+
+// Error codes returned to the merchant front-end for requests which are rejected before 3DS is started.
+const (
+	merchantErrorCodeInvalidRequest         = "INVALID_REQUEST"
+	merchantErrorCodeRequestTooLarge        = "REQUEST_TOO_LARGE"
+	merchantErrorCodeMethodNotAllowed       = "METHOD_NOT_ALLOWED"
+	merchantErrorCodeRequestUnauthorised    = "UNAUTHORISED"
+	merchantErrorCodeTransactionNotFound    = "TRANSACTION_NOT_FOUND"
+	merchantErrorCodeInvalidCardToken       = "INVALID_CARD_TOKEN"
+	merchantErrorCodeAlreadyAuthenticated   = "TRANSACTION_ALREADY_AUTHENTICATED"
+	merchantErrorCodeCardMismatch           = "CARD_MISMATCH"
+	merchantErrorCodeMessageVersionMismatch = "MESSAGE_VERSION_MISMATCH"
+	merchantErrorCodeNotChallenged          = "TRANSACTION_NOT_CHALLENGED"
+)
+
+var (
+	errMethodNotAllowed = &RequestError{
+		StatusCode: http.StatusMethodNotAllowed,
+		ErrorCode:  merchantErrorCodeMethodNotAllowed,
+		Message:    "method not allowed",
+	}
+	errRequestUnauthorised = &RequestError{
+		StatusCode: http.StatusUnauthorized,
+		ErrorCode:  merchantErrorCodeRequestUnauthorised,
+		Message:    "authorization token not valid",
+	}
+)
+
+// RequestError is returned when a request to the merchant back-end is not valid. Message is safe
+// to return to the caller, so it never contains card details.
+type RequestError struct {
+	StatusCode int
+	ErrorCode  string
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// invalidRequest returns a RequestError for a request which is well-formed but not valid.
+func invalidRequest(format string, args ...interface{}) *RequestError {
+	return &RequestError{
+		StatusCode: http.StatusBadRequest,
+		ErrorCode:  merchantErrorCodeInvalidRequest,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+// maxRequestBytes returns the largest request body the handler accepts.
+func (h Handler) maxRequestBytes() int64 {
+	if h.MaxRequestBytes > 0 {
+		return h.MaxRequestBytes
+	}
+	return DefaultMaxRequestBytes
+}
+
+// limitRequestBody stops the request body being read beyond the handler's limit.
+func (h Handler) limitRequestBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxRequestBytes())
+}
+
+// decodeJSONRequest decodes a request body containing a single JSON object into v. The body is
+// limited to the handler's maximum size, and if strict is set fields which v does not define
+// are rejected, so that mistakes in the caller's requests are not silently ignored.
+// A *RequestError describing the problem is returned if the body cannot be decoded.
+func (h Handler) decodeJSONRequest(w http.ResponseWriter, r *http.Request, strict bool, v interface{}) error {
+	h.limitRequestBody(w, r)
+	defer r.Body.Close()
+
+	dec := json.NewDecoder(r.Body)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err == nil {
+		// anything after the object is either a mistake or an attempt to smuggle data
+		if _, err := dec.Token(); err != io.EOF {
+			return invalidRequest("request body must only contain a single JSON object")
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return requestTooLarge(maxBytesErr)
+	case errors.Is(err, io.EOF):
+		return invalidRequest("request body must not be empty")
+	case errors.As(err, &syntaxErr):
+		return invalidRequest("request body contains badly-formed JSON at position %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return invalidRequest("request body contains badly-formed JSON")
+	case errors.As(err, &typeErr):
+		return invalidRequest("request body contains an invalid value for the %q field, expected %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return invalidRequest("request body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+
+	return invalidRequest("request body could not be decoded")
+}
+
+// decodeFormRequest decodes the base64 encoded JSON in the form parameter paramName into v. The
+// body is limited to the handler's maximum size, and a *RequestError describing the problem is
+// returned if it cannot be decoded.
+func (h Handler) decodeFormRequest(w http.ResponseWriter, r *http.Request, paramName string, v interface{}) error {
+	h.limitRequestBody(w, r)
+
+	err := decodeFormData(r, paramName, h.StrictBase64Decoding, v)
+	if err == nil {
+		return nil
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return requestTooLarge(maxBytesErr)
+	}
+	return invalidRequest("%s", err.Error())
+}
+
+// requestTooLarge returns a RequestError for a request body which exceeded the handler's limit.
+func requestTooLarge(err *http.MaxBytesError) *RequestError {
+	return &RequestError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		ErrorCode:  merchantErrorCodeRequestTooLarge,
+		Message:    fmt.Sprintf("request body must not be larger than %d bytes", err.Limit),
+	}
+}
+
+// respondRequestError writes the merchant error response for a request which was rejected.
+// Errors other than a *RequestError are treated as the request being invalid.
+func respondRequestError(err error, rw http.ResponseWriter) {
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) {
+		requestErr = invalidRequest("%s", err.Error())
+	}
+
+	rw.Header().Set("Content-Type", jsonContentType)
+	rw.WriteHeader(requestErr.StatusCode)
+	respond(domain.MerchantErrorResponse{
+		Status:    "ERROR",
+		Error:     requestErr.Message,
+		ErrorCode: requestErr.ErrorCode,
+	}, rw)
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+)
+
+func TestHandler_decodeJSONRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		strict      bool
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:   "valid",
+			body:   `{"threeDSServerTransID":"tx-1","productQuantity":1}`,
+			strict: true,
+		},
+		{
+			name:        "unknown field",
+			body:        `{"productQty":1}`,
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: `request body contains unknown field "productQty"`,
+		},
+		{
+			name:   "unknown field allowed when not strict",
+			body:   `{"productQty":1}`,
+			strict: false,
+		},
+		{
+			name:        "wrong type",
+			body:        `{"productQuantity":"1"}`,
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: `request body contains an invalid value for the "productQuantity" field, expected int`,
+		},
+		{
+			name:        "malformed",
+			body:        `{"productQuantity":1,}`,
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: "request body contains badly-formed JSON at position 22",
+		},
+		{
+			name:        "truncated",
+			body:        `{"productQuantity":1`,
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: "request body contains badly-formed JSON",
+		},
+		{
+			name:        "empty",
+			body:        "",
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: "request body must not be empty",
+		},
+		{
+			name:        "trailing data",
+			body:        `{"productQuantity":1}{"productQuantity":2}`,
+			strict:      true,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    merchantErrorCodeInvalidRequest,
+			wantMessage: "request body must only contain a single JSON object",
+		},
+		{
+			name:        "too large",
+			body:        `{"productSKU":"` + strings.Repeat("A", 100) + `"}`,
+			strict:      true,
+			wantStatus:  http.StatusRequestEntityTooLarge,
+			wantCode:    merchantErrorCodeRequestTooLarge,
+			wantMessage: "request body must not be larger than 64 bytes",
+		},
+	}
+
+	h := Handler{MaxRequestBytes: 64}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(tt.body))
+
+			err := h.decodeJSONRequest(w, r, tt.strict, &domain.MerchantAuthenticateRequest{})
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("expected: %v, actual: %v", nil, err)
+				}
+				return
+			}
+
+			respondRequestError(err, w)
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+
+			rsp := domain.MerchantErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.ErrorCode != tt.wantCode {
+				t.Errorf("expected: %s, actual: %s", tt.wantCode, rsp.ErrorCode)
+			}
+			if rsp.Error != tt.wantMessage {
+				t.Errorf("expected: %s, actual: %s", tt.wantMessage, rsp.Error)
+			}
+		})
+	}
+}
+
+func TestHandler_Authenticate_invalidRequest(t *testing.T) {
+	h := Handler{ThreeDSTransactionStore: NewThreeDSTransactionStore()}
+
+	w := httptest.NewRecorder()
+	body := `{"productSKU":"10001","productQuantity":1,"cardToken":"ctok_test"}`
+	h.Authenticate(w, httptest.NewRequest(http.MethodPost, AuthenticateEndpoint, strings.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %d, actual: %d", http.StatusBadRequest, w.Code)
+	}
+
+	rsp := domain.MerchantErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Error != "browserData is required" {
+		t.Errorf("expected: %s, actual: %s", "browserData is required", rsp.Error)
+	}
+}
+
+func TestHandler_notifications_invalidForm(t *testing.T) {
+	h := Handler{MaxRequestBytes: 64, ThreeDSTransactionStore: NewThreeDSTransactionStore()}
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "method notification malformed",
+			handler:    h.MethodNotification,
+			body:       "threeDSMethodData=not%20base64!",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   merchantErrorCodeInvalidRequest,
+		},
+		{
+			name:       "method notification too large",
+			handler:    h.MethodNotification,
+			body:       "threeDSMethodData=" + strings.Repeat("a", 64),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   merchantErrorCodeRequestTooLarge,
+		},
+		{
+			name:       "challenge notification missing cres",
+			handler:    h.ChallengeNotification,
+			body:       "threeDSSessionData=abc",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   merchantErrorCodeInvalidRequest,
+		},
+		{
+			name:       "challenge notification too large",
+			handler:    h.ChallengeNotification,
+			body:       "cres=" + strings.Repeat("a", 64),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   merchantErrorCodeRequestTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected: %d, actual: %d", tt.wantStatus, w.Code)
+			}
+
+			rsp := domain.MerchantErrorResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if rsp.ErrorCode != tt.wantCode {
+				t.Errorf("expected: %s, actual: %s", tt.wantCode, rsp.ErrorCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/audit"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/metrics"
+)
+
+// resultsStatusReceived is the RRes resultsStatus indicating the RReq was received for further processing.
+const resultsStatusReceived = "01"
+
+// Results receives the outcome of a challenge server to server, either as a Results Request (RReq)
+// or as /3ds/result response data. This allows the transaction to be finalised even if the customer's
+// browser never posts the CRes to the challenge notification endpoint.
+//
+// Requests must present the configured results token as "Authorization: token <results-token>".
+// Results are only recorded once, so it is safe for both this endpoint and the challenge notification
+// to be called for the same transaction.
+func (h Handler) Results(w http.ResponseWriter, r *http.Request) {
+	addCommonHeaders(w, jsonContentType)
+
+	if r.Method != http.MethodPost {
+		respondRequestError(errMethodNotAllowed, w)
+		return
+	}
+
+	logger := logging.FromContext(r.Context())
+	logger.Info("Handling request", "endpoint", ResultsEndpoint)
+
+	if !tokenAuthorised(r, h.ResultsToken) {
+		logger.Warn("unauthorised request", "endpoint", ResultsEndpoint)
+		respondRequestError(errRequestUnauthorised, w)
+		return
+	}
+
+	// the RReq is not decoded strictly, as the DS may send fields this example does not use
+	resultsRequest := domain.ResultsRequest{}
+	err := h.decodeJSONRequest(w, r, false, &resultsRequest)
+	if err != nil {
+		logger.Warn("failed to decode results request", "error", err)
+		respondRequestError(err, w)
+		return
+	}
+
+	if resultsRequest.ThreeDSServerTransID == "" || resultsRequest.TransStatus == "" {
+		logger.Warn("invalid results request: threeDSServerTransID and transStatus are required")
+		respondRequestError(invalidRequest("threeDSServerTransID and transStatus are required"), w)
+		return
+	}
+
+	logger = h.transactionLogger(logger, resultsRequest.ThreeDSServerTransID)
+
+	r, span := h.joinTransactionTrace(r, resultsRequest.ThreeDSServerTransID, "threeds.results")
+	defer span.End()
+
+	h.audit(r, resultsRequest.ThreeDSServerTransID, audit.MessageResultsRequest, resultsRequest)
+
+	result, updated, err := h.ThreeDSTransactionStore.SetResult(resultsRequest.ThreeDSServerTransID, ThreeDSResult{
+		TransStatus:         resultsRequest.TransStatus,
+		TransStatusReason:   resultsRequest.TransStatusReason,
+		ECI:                 resultsRequest.ECI,
+		AuthenticationValue: resultsRequest.AuthenticationValue,
+		Source:              ResultSourceResultsRequest,
+		ReceivedAt:          time.Now().UTC(),
+	})
+	if errors.Is(err, ErrTransactionNotChallenged) {
+		// a result cannot be attached to a transaction which was authenticated without a challenge
+		logger.Warn("failed to set result", "error", err)
+		respondRequestError(&RequestError{
+			StatusCode: http.StatusConflict,
+			ErrorCode:  merchantErrorCodeNotChallenged,
+			Message:    err.Error(),
+		}, w)
+		return
+	}
+	if err != nil {
+		logger.Warn("failed to set result", "error", err)
+		respondRequestError(&RequestError{
+			StatusCode: http.StatusNotFound,
+			ErrorCode:  merchantErrorCodeTransactionNotFound,
+			Message:    "transaction not found",
+		}, w)
+		return
+	}
+
+	if updated {
+		h.recordChallengeResult(resultsRequest.ThreeDSServerTransID, result)
+		logger.Info("Results request recorded", "transStatus", result.TransStatus, "eci", result.ECI)
+	} else {
+		logger.Info("Result already recorded", "resultSource", result.Source)
+	}
+
+	respond(domain.ResultsResponse{
+		ThreeDSServerTransID: resultsRequest.ThreeDSServerTransID,
+		ACSTransID:           resultsRequest.ACSTransID,
+		DSTransID:            resultsRequest.DSTransID,
+		MessageType:          "RRes",
+		MessageVersion:       resultsRequest.MessageVersion,
+		ResultsStatus:        resultsStatusReceived,
+	}, w)
+}
+
+// tokenAuthorised reports whether the request presents the expected token as "Authorization: token <token>".
+// Requests are never authorised if the expected token is empty.
+func tokenAuthorised(r *http.Request, expected string) bool {
+	if expected == "" {
+		return false
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "token ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(authorization, "token ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// recordChallengeResult counts the outcome of a challenge the first time its result is recorded,
+// and remembers a successful challenge for the customer's next authentication.
+func (h Handler) recordChallengeResult(threeDSServerTransID string, result ThreeDSResult) {
+	outcome := metrics.OutcomeFailed
+	if result.Successful() {
+		outcome = metrics.OutcomeSuccess
+	}
+
+	tx, _ := h.ThreeDSTransactionStore.Get(threeDSServerTransID)
+	if !result.Successful() {
+		h.AbuseProtection.RecordFailure(tx.PANFingerprint)
+	}
+	if result.Successful() && result.TransStatus == "Y" {
+		h.recordPriorAuthentication(threeDSServerTransID, tx, priorAuthMethodChallenge, result.ReceivedAt)
+	}
+	h.Metrics.RecordChallengeResult(outcome, result.Source, tx.MessageVersion, tx.CardScheme)
+}
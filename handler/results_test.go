@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler_Results(t *testing.T) {
+	h := Handler{
+		ResultsToken:            "secret",
+		ThreeDSTransactionStore: NewThreeDSTransactionStore(),
+	}
+	h.ThreeDSTransactionStore.Add("tx-1", ThreeDSTransaction{MessageVersion: "2.2.0", AuthenticateTransStatus: "C"})
+	h.ThreeDSTransactionStore.Add("tx-2", ThreeDSTransaction{MessageVersion: "2.2.0", AuthenticateTransStatus: "N"})
+	h.ThreeDSTransactionStore.Add("tx-3", ThreeDSTransaction{MessageVersion: "2.2.0"})
+
+	send := func(authorization, body string) int {
+		r := httptest.NewRequest(http.MethodPost, ResultsEndpoint, strings.NewReader(body))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.Results(w, r)
+		return w.Code
+	}
+
+	rreq := `{"messageType":"RReq","threeDSServerTransID":"tx-1","transStatus":"Y","eci":"05","authenticationValue":"AAABBBCCC="}`
+
+	if code := send("", rreq); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d without token, actual: %d", http.StatusUnauthorized, code)
+	}
+	if code := send("token wrong", rreq); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d with wrong token, actual: %d", http.StatusUnauthorized, code)
+	}
+	if code := send("secret", rreq); code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d with bare token, actual: %d", http.StatusUnauthorized, code)
+	}
+	if code := send("token secret", `{"threeDSServerTransID":"unknown","transStatus":"Y"}`); code != http.StatusNotFound {
+		t.Fatalf("expected status %d for unknown transaction, actual: %d", http.StatusNotFound, code)
+	}
+
+	// only a challenged transaction can have a result attached
+	for _, id := range []string{"tx-2", "tx-3"} {
+		if code := send("token secret", `{"threeDSServerTransID":"`+id+`","transStatus":"Y","authenticationValue":"AAABBBCCC="}`); code != http.StatusConflict {
+			t.Fatalf("expected status %d for transaction which was not challenged, actual: %d", http.StatusConflict, code)
+		}
+	}
+
+	if code := send("token secret", rreq); code != http.StatusOK {
+		t.Fatalf("expected status %d, actual: %d", http.StatusOK, code)
+	}
+
+	// a second, conflicting result must not overwrite the first
+	if code := send("token secret", `{"threeDSServerTransID":"tx-1","transStatus":"N"}`); code != http.StatusOK {
+		t.Fatalf("expected status %d for repeated results request, actual: %d", http.StatusOK, code)
+	}
+
+	tx, _ := h.ThreeDSTransactionStore.Get("tx-1")
+	if tx.Result == nil || !tx.Result.Successful() || tx.Result.Source != ResultSourceResultsRequest {
+		t.Fatalf("expected successful result from results request, actual: %+v", tx.Result)
+	}
+}
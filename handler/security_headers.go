@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+type cspNonceContextKey struct{}
+
+// SecurityHeaders sets the security headers for every response, including a Content Security Policy
+// which only allows scripts carrying the request's nonce, and only allows the checkout to frame and
+// post forms to the merchant's own origin and frameOrigins, the ACS and 3DS Method domains.
+//
+// Strict-Transport-Security is only sent when the request was made over TLS, or when hsts is true
+// because TLS is terminated in front of the server.
+func SecurityHeaders(frameOrigins []string, hsts bool, next http.Handler) http.Handler {
+	sources := strings.Join(append([]string{"'self'"}, frameOrigins...), " ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newCSPNonce()
+
+		w.Header().Set("Content-Security-Policy", strings.Join([]string{
+			"default-src 'self'",
+			"script-src 'nonce-" + nonce + "' 'strict-dynamic'",
+			"style-src 'self' https://cdn.jsdelivr.net",
+			"img-src 'self' data:",
+			"connect-src 'self'",
+			"frame-src " + sources,
+			"form-action " + sources,
+			"frame-ancestors 'self'",
+			"base-uri 'none'",
+			"object-src 'none'",
+		}, "; "))
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), usb=(), payment=(self)")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if hsts || r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		ctx := context.WithValue(r.Context(), cspNonceContextKey{}, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// cspNonce returns the nonce which scripts rendered for the request must carry.
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceContextKey{}).(string)
+	return nonce
+}
+
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
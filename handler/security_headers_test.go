@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"crypto/tls"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders_hsts(t *testing.T) {
+	tests := []struct {
+		name     string
+		hsts     bool
+		tls      bool
+		wantHSTS bool
+	}{
+		{name: "plain http", wantHSTS: false},
+		{name: "tls", tls: true, wantHSTS: true},
+		{name: "tls terminated in front of the server", hsts: true, wantHSTS: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := SecurityHeaders(nil, tt.hsts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if actual := w.Header().Get("Strict-Transport-Security") != ""; actual != tt.wantHSTS {
+				t.Errorf("expected: %v, actual: %v", tt.wantHSTS, actual)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders_nonce(t *testing.T) {
+	h := Handler{IndexTemplate: template.Must(template.ParseFiles("../templates/index.html"))}
+	handler := SecurityHeaders([]string{"https://acs.example"}, false, h.FrontEnd(http.NotFoundHandler()))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	csp := w.Header().Get("Content-Security-Policy")
+	match := regexp.MustCompile(`script-src 'nonce-([^']+)'`).FindStringSubmatch(csp)
+	if match == nil {
+		t.Fatalf("expected a script nonce, actual: %s", csp)
+	}
+
+	for _, directive := range []string{"frame-src 'self' https://acs.example", "form-action 'self' https://acs.example", "frame-ancestors 'self'"} {
+		if !strings.Contains(csp, directive) {
+			t.Errorf("expected %q, actual: %s", directive, csp)
+		}
+	}
+
+	body := w.Body.String()
+	scripts := strings.Count(body, "<script")
+	if scripts == 0 || strings.Count(body, `nonce="`+match[1]+`"`) != scripts {
+		t.Errorf("expected every script to carry nonce %s, actual: %s", match[1], body)
+	}
+	if strings.Contains(body, "onclick=") {
+		t.Error("expected no inline event handlers")
+	}
+
+	// every request gets a new nonce
+	w2 := httptest.NewRecorder()
+	handler.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w2.Header().Get("Content-Security-Policy") == csp {
+		t.Error("expected nonce to differ between requests")
+	}
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	browserSessionCookieName = "threeds-session"
+	defaultSessionDataTTL    = 10 * time.Minute
+)
+
+var (
+	ErrSessionDataInvalid  = errors.New("threeDSSessionData is invalid")
+	ErrSessionDataExpired  = errors.New("threeDSSessionData has expired")
+	ErrSessionDataMismatch = errors.New("threeDSSessionData does not match the transaction")
+	ErrSessionDataReplayed = errors.New("threeDSSessionData has already been used")
+)
+
+// SessionData is sent to the ACS as threeDSSessionData in the challenge request, and posted back
+// unchanged with the CRes. It ties the challenge notification to the transaction and to the
+// browser session which started the checkout.
+type SessionData struct {
+	ThreeDSServerTransID string `json:"tid"`
+	BrowserSessionID     string `json:"sid"`
+	ExpiresAt            int64  `json:"exp"`
+}
+
+// SessionDataSigner issues and verifies HMAC-SHA256 signed threeDSSessionData tokens.
+// Tokens are of the form base64url(JSON payload) + "." + base64url(signature), which keeps
+// them within the base64url alphabet required by EMVCo.
+type SessionDataSigner struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewSessionDataSigner creates a SessionDataSigner. If key is empty a random key is generated,
+// in which case tokens will not survive a restart.
+func NewSessionDataSigner(key []byte, ttl time.Duration) (*SessionDataSigner, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate session data key: %v", err)
+		}
+	}
+
+	if ttl <= 0 {
+		ttl = defaultSessionDataTTL
+	}
+
+	return &SessionDataSigner{key: key, ttl: ttl, now: time.Now}, nil
+}
+
+// Sign returns a signed token for the transaction and browser session, which expires after the signer's TTL.
+func (s *SessionDataSigner) Sign(threeDSServerTransID, browserSessionID string) (string, error) {
+	payload, err := json.Marshal(SessionData{
+		ThreeDSServerTransID: threeDSServerTransID,
+		BrowserSessionID:     browserSessionID,
+		ExpiresAt:            s.now().Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal session data: %v", err)
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	return encodedPayload + "." + base64.RawURLEncoding.EncodeToString(s.sign(encodedPayload)), nil
+}
+
+// Verify checks the token signature and expiry, and returns the session data it contains.
+func (s *SessionDataSigner) Verify(token string) (SessionData, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return SessionData{}, ErrSessionDataInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.sign(parts[0])) {
+		return SessionData{}, ErrSessionDataInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return SessionData{}, ErrSessionDataInvalid
+	}
+
+	sessionData := SessionData{}
+	err = json.Unmarshal(payload, &sessionData)
+	if err != nil {
+		return SessionData{}, ErrSessionDataInvalid
+	}
+
+	if s.now().Unix() > sessionData.ExpiresAt {
+		return SessionData{}, ErrSessionDataExpired
+	}
+
+	return sessionData, nil
+}
+
+func (s *SessionDataSigner) sign(encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encodedPayload))
+	return mac.Sum(nil)
+}
+
+// browserSessionID returns the ID of the customer's browser session, setting a session cookie if there is not one.
+func (h Handler) browserSessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(browserSessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate browser session id: %v", err)
+	}
+	sessionID := hex.EncodeToString(b)
+
+	// the challenge notification is posted to us from the ACS iframe, so the cookie
+	// is only sent with it when SameSite=None, which in turn requires Secure
+	cookie := &http.Cookie{
+		Name:     browserSessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if strings.HasPrefix(h.MerchantUrl, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+
+	return sessionID, nil
+}
+
+// verifySessionData checks the threeDSSessionData posted with a CRes, and marks it as used so it
+// cannot be replayed once the challenge result has been recorded.
+func (h Handler) verifySessionData(r *http.Request, token string, threeDSServerTransID string) error {
+	if h.SessionDataSigner == nil {
+		return errors.New("session data signer not configured")
+	}
+
+	sessionData, err := h.SessionDataSigner.Verify(token)
+	if err != nil {
+		return err
+	}
+
+	if sessionData.ThreeDSServerTransID != threeDSServerTransID {
+		return ErrSessionDataMismatch
+	}
+
+	tx, ok := h.ThreeDSTransactionStore.Get(threeDSServerTransID)
+	if !ok || tx.BrowserSessionID != sessionData.BrowserSessionID {
+		return ErrSessionDataMismatch
+	}
+
+	// browsers may not send the cookie with the cross-site notification, but if they do it must match
+	if cookie, err := r.Cookie(browserSessionCookieName); err == nil && cookie.Value != sessionData.BrowserSessionID {
+		return ErrSessionDataMismatch
+	}
+
+	return h.ThreeDSTransactionStore.SetChallengeNotified(threeDSServerTransID)
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionDataSigner(t *testing.T) {
+	signer, err := NewSessionDataSigner([]byte("key"), time.Minute)
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+
+	token, err := signer.Sign("tx-1", "session-1")
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+
+	sessionData, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("expected nil error, actual: %v", err)
+	}
+	if sessionData.ThreeDSServerTransID != "tx-1" || sessionData.BrowserSessionID != "session-1" {
+		t.Fatalf("unexpected session data: %+v", sessionData)
+	}
+
+	otherSigner, _ := NewSessionDataSigner([]byte("other key"), time.Minute)
+	if _, err := otherSigner.Verify(token); err != ErrSessionDataInvalid {
+		t.Errorf("expected %v for token signed with another key, actual: %v", ErrSessionDataInvalid, err)
+	}
+
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"tid":"tx-2","sid":"session-1","exp":9999999999}`))
+	forged := forgedPayload + token[strings.Index(token, "."):]
+	if _, err := signer.Verify(forged); err != ErrSessionDataInvalid {
+		t.Errorf("expected %v for forged token, actual: %v", ErrSessionDataInvalid, err)
+	}
+
+	for _, invalid := range []string{"", "e30", "e30.!!!", "!!!.e30"} {
+		if _, err := signer.Verify(invalid); err != ErrSessionDataInvalid {
+			t.Errorf("expected %v for %q, actual: %v", ErrSessionDataInvalid, invalid, err)
+		}
+	}
+
+	signer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := signer.Verify(token); err != ErrSessionDataExpired {
+		t.Errorf("expected %v for expired token, actual: %v", ErrSessionDataExpired, err)
+	}
+}
+
+func TestHandler_ChallengeNotification_sessionData(t *testing.T) {
+	ravelin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":200,"data":{"transStatus":"Y","authenticationValue":"AAABBBCCC="}}`))
+	}))
+	defer ravelin.Close()
+
+	signer, _ := NewSessionDataSigner([]byte("key"), time.Minute)
+	h := Handler{
+		RavelinApiUrl:                         ravelin.URL,
+		RavelinApiKeys:                        testApiKeys(t),
+		ThreeDSTransactionStore:               NewThreeDSTransactionStore(),
+		SessionDataSigner:                     signer,
+		ChallengeNotificationResponseTemplate: template.Must(template.New("").Parse("{{.Status}} {{.ErrorCode}}")),
+	}
+	h.ThreeDSTransactionStore.Add("tx-1", ThreeDSTransaction{BrowserSessionID: "session-1", AuthenticateTransStatus: "C"})
+	h.ThreeDSTransactionStore.Add("tx-2", ThreeDSTransaction{BrowserSessionID: "session-2", AuthenticateTransStatus: "C"})
+
+	notify := func(threeDSServerTransID, sessionData string) (int, string) {
+		cres := `{"threeDSServerTransID":"` + threeDSServerTransID + `","messageType":"CRes","transStatus":"Y"}`
+		form := url.Values{"cres": {base64.RawURLEncoding.EncodeToString([]byte(cres))}}
+		if sessionData != "" {
+			form.Set("threeDSSessionData", sessionData)
+		}
+		r := httptest.NewRequest(http.MethodPost, ChallengeNotificationEndpoint, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ChallengeNotification(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	tx1Token, _ := signer.Sign("tx-1", "session-1")
+	wrongSessionToken, _ := signer.Sign("tx-2", "session-1")
+
+	tests := []struct {
+		name                 string
+		threeDSServerTransID string
+		sessionData          string
+		wantStatus           int
+		wantBody             string
+	}{
+		{name: "missing session data", threeDSServerTransID: "tx-1", wantStatus: http.StatusForbidden, wantBody: "FAILED " + merchantErrorCodeInvalidSessionData},
+		{name: "forged session data", threeDSServerTransID: "tx-1", sessionData: "e30.e30", wantStatus: http.StatusForbidden, wantBody: "FAILED " + merchantErrorCodeInvalidSessionData},
+		{name: "session data for another transaction", threeDSServerTransID: "tx-2", sessionData: tx1Token, wantStatus: http.StatusForbidden, wantBody: "FAILED " + merchantErrorCodeInvalidSessionData},
+		{name: "session data for another browser session", threeDSServerTransID: "tx-2", sessionData: wrongSessionToken, wantStatus: http.StatusForbidden, wantBody: "FAILED " + merchantErrorCodeInvalidSessionData},
+		{name: "valid session data", threeDSServerTransID: "tx-1", sessionData: tx1Token, wantStatus: http.StatusOK, wantBody: "SUCCESS "},
+		{name: "replayed session data", threeDSServerTransID: "tx-1", sessionData: tx1Token, wantStatus: http.StatusForbidden, wantBody: "FAILED " + merchantErrorCodeInvalidSessionData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := notify(tt.threeDSServerTransID, tt.sessionData)
+			if status != tt.wantStatus {
+				t.Errorf("expected status %d, actual: %d", tt.wantStatus, status)
+			}
+			if body != tt.wantBody {
+				t.Errorf("expected body %q, actual: %q", tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestHandler_ChallengeNotification_repost(t *testing.T) {
+	resultRequests := 0
+	ravelin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resultRequests++
+		if resultRequests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":200,"data":{"transStatus":"Y","authenticationValue":"AAABBBCCC="}}`))
+	}))
+	defer ravelin.Close()
+
+	signer, _ := NewSessionDataSigner([]byte("key"), time.Minute)
+	h := Handler{
+		RavelinApiUrl:                         ravelin.URL,
+		RavelinApiKeys:                        testApiKeys(t),
+		ThreeDSTransactionStore:               NewThreeDSTransactionStore(),
+		SessionDataSigner:                     signer,
+		ChallengeNotificationResponseTemplate: template.Must(template.New("").Parse("{{.Status}} {{.ErrorCode}}")),
+	}
+	h.ThreeDSTransactionStore.Add("tx-1", ThreeDSTransaction{BrowserSessionID: "session-1", AuthenticateTransStatus: "C"})
+	sessionData, _ := signer.Sign("tx-1", "session-1")
+
+	cres := base64.RawURLEncoding.EncodeToString([]byte(`{"threeDSServerTransID":"tx-1","messageType":"CRes","transStatus":"Y"}`))
+	form := url.Values{"cres": {cres}, "threeDSSessionData": {sessionData}}
+
+	// the notification can be posted again after a transient failure, until a result is recorded
+	for _, wantStatus := range []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodPost, ChallengeNotificationEndpoint, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ChallengeNotification(w, r)
+		if w.Code != wantStatus {
+			t.Fatalf("expected: %d, actual: %d", wantStatus, w.Code)
+		}
+	}
+}
@@ -1,8 +1,17 @@
 package handler
 
 import (
+	"crypto/hmac"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/internal/atomicfile"
 )
 
 const (
@@ -11,30 +20,197 @@ const (
 	MethodStatusUnavailable  = "U"
 )
 
+const (
+	ResultSourceChallengeNotification = "challenge-notification"
+	ResultSourceResultsRequest        = "results-request"
+)
+
+// DefaultTransactionTTL is how long transactions are kept for by default. It allows for the card
+// token and threeDSSessionData to be used until they expire with the default TTLs, and for a
+// Results Request to arrive after the challenge.
+const DefaultTransactionTTL = time.Hour
+
+var (
+	ErrTransactionNotFound             = errors.New("not found")
+	ErrTransactionAlreadyAuthenticated = errors.New("transaction has already been authenticated")
+	ErrCardMismatch                    = errors.New("card does not match the card used at checkout")
+	ErrMessageVersionMismatch          = errors.New("message version does not match the version used at checkout")
+	ErrTransactionNotChallenged        = errors.New("transaction was not challenged")
+)
+
 type ThreeDSTransaction struct {
-	MessageVersion string
-	MethodStatus   string
+	// CreatedAt is when the transaction was added to the store at checkout.
+	CreatedAt        time.Time
+	MessageVersion   string
+	MethodStatus     string
+	BrowserSessionID string
+	CorrelationID    string
+	CardScheme       string
+	// PANFingerprint identifies the card used at checkout, to the transaction store, the customer
+	// store and the abuse protection, see vault.Vault.Fingerprint.
+	PANFingerprint string
+	// CustomerID is the customer who authenticated the transaction.
+	CustomerID string
+	// TraceContext is the trace context of the checkout which created the transaction.
+	TraceContext      map[string]string
+	ChallengeNotified bool
+	Result            *ThreeDSResult
+
+	// AuthenticationStartedAt is set while an authenticate request is in progress, and kept once an
+	// ARes is received. A transaction is only authenticated once.
+	AuthenticationStartedAt time.Time
+
+	// The following fields are populated from the authenticate response (ARes).
+	AuthenticateTransStatus string
+	AuthenticatedAt         time.Time
+	ACSTransID              string
+	CardholderInfo          string
+	BroadInfo               *domain.BroadInfo
 }
 
+// ThreeDSResult is the final outcome of a challenge. It is recorded by whichever of the
+// challenge notification or the Results Request (RReq) arrives first.
+type ThreeDSResult struct {
+	TransStatus         string
+	TransStatusReason   string
+	ECI                 string
+	AuthenticationValue string
+	Source              string
+	ReceivedAt          time.Time
+}
+
+// Successful reports whether the customer was authenticated and the merchant can proceed to authorisation.
+func (r ThreeDSResult) Successful() bool {
+	return (r.TransStatus == "Y" || r.TransStatus == "A") && r.AuthenticationValue != ""
+}
+
+// ThreeDSTransactionStore holds transactions by threeDSServerTransID. Transactions are evicted
+// once they are older than the store's TTL, so the store does not grow without bound.
 type ThreeDSTransactionStore struct {
 	mu    *sync.RWMutex
 	store map[string]ThreeDSTransaction
+	ttl   time.Duration
+	now   func() time.Time
+	// path is the file the store is persisted to by Flush. The store is only held in memory if empty.
+	path string
 }
 
 func NewThreeDSTransactionStore() ThreeDSTransactionStore {
 	return ThreeDSTransactionStore{
 		mu:    &sync.RWMutex{},
 		store: make(map[string]ThreeDSTransaction),
+		ttl:   DefaultTransactionTTL,
+		now:   time.Now,
+	}
+}
+
+// SetTTL sets how long after checkout transactions are evicted. It must be longer than the card
+// token and threeDSSessionData can be used for, or challenges in progress will be lost.
+func (s *ThreeDSTransactionStore) SetTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
+
+// NewPersistentThreeDSTransactionStore creates a store which is persisted to the file at path,
+// loading any transactions flushed to it previously. This allows challenges in progress to be
+// completed after the server restarts.
+func NewPersistentThreeDSTransactionStore(path string) (ThreeDSTransactionStore, error) {
+	s := NewThreeDSTransactionStore()
+	s.path = path
+
+	bb, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read transaction store: %v", err)
+	}
+
+	err = json.Unmarshal(bb, &s.store)
+	if err != nil {
+		return s, fmt.Errorf("failed to decode transaction store: %v", err)
 	}
+
+	// transactions flushed before they had a creation time are kept for a full TTL from now
+	now := s.now()
+	for id, tx := range s.store {
+		if tx.CreatedAt.IsZero() {
+			tx.CreatedAt = now
+			s.store[id] = tx
+		}
+	}
+
+	return s, nil
 }
 
+// Flush atomically replaces the store's file with every transaction. Flush does nothing for an in
+// memory store.
+func (s *ThreeDSTransactionStore) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.evict(s.now())
+	bb, err := json.Marshal(s.store)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction store: %v", err)
+	}
+
+	err = atomicfile.WriteFile(s.path, bb)
+	if err != nil {
+		return fmt.Errorf("failed to write transaction store: %v", err)
+	}
+
+	return nil
+}
+
+// Ping reports whether the store can be used, including whether the directory of a persistent
+// store exists so that it can be flushed.
+func (s *ThreeDSTransactionStore) Ping() error {
+	if s.mu == nil || s.store == nil {
+		return errors.New("transaction store not initialised")
+	}
+
+	if s.path != "" {
+		info, err := os.Stat(filepath.Dir(s.path))
+		if err != nil {
+			return fmt.Errorf("transaction store directory not accessible: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("transaction store directory %s is not a directory", filepath.Dir(s.path))
+		}
+	}
+
+	return nil
+}
+
+// Add adds a transaction to the store, and evicts any transactions older than the store's TTL.
 func (s *ThreeDSTransactionStore) Add(threeDSServerTransID string, tx ThreeDSTransaction) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := s.now()
+	s.evict(now)
+	if tx.CreatedAt.IsZero() {
+		tx.CreatedAt = now
+	}
 	s.store[threeDSServerTransID] = tx
 }
 
+// evict removes transactions older than the store's TTL. The caller must hold s.mu for writing.
+func (s *ThreeDSTransactionStore) evict(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+
+	for id, tx := range s.store {
+		if now.Sub(tx.CreatedAt) >= s.ttl {
+			delete(s.store, id)
+		}
+	}
+}
+
 func (s *ThreeDSTransactionStore) Get(threeDSTransactionID string) (ThreeDSTransaction, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -49,10 +225,165 @@ func (s *ThreeDSTransactionStore) SetMethodStatus(threeDSTransactionID string, s
 
 	tx, ok := s.store[threeDSTransactionID]
 	if !ok {
-		return errors.New("not found")
+		return ErrTransactionNotFound
 	}
 
 	tx.MethodStatus = status
 	s.store[threeDSTransactionID] = tx
 	return nil
 }
+
+// SetResult records the result of a transaction if one has not already been recorded.
+// The recorded result is returned, along with whether it was set by this call. Only a transaction
+// whose ARes required a challenge has a result; ErrTransactionNotChallenged is returned otherwise.
+func (s *ThreeDSTransactionStore) SetResult(threeDSTransactionID string, result ThreeDSResult) (ThreeDSResult, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok {
+		return ThreeDSResult{}, false, ErrTransactionNotFound
+	}
+
+	if tx.AuthenticateTransStatus != "C" {
+		return ThreeDSResult{}, false, ErrTransactionNotChallenged
+	}
+
+	if tx.Result != nil {
+		return *tx.Result, false, nil
+	}
+
+	tx.Result = &result
+	s.store[threeDSTransactionID] = tx
+	return result, true, nil
+}
+
+// SetChallengeNotified records that the challenge notification has been received for a transaction.
+// It returns ErrSessionDataReplayed if the notification has already been received and a result
+// recorded. Until then the notification may be posted again, so that a result which could not be
+// fetched because of a transient failure is not lost.
+func (s *ThreeDSTransactionStore) SetChallengeNotified(threeDSTransactionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok {
+		return ErrTransactionNotFound
+	}
+
+	if tx.ChallengeNotified && tx.Result != nil {
+		return ErrSessionDataReplayed
+	}
+
+	tx.ChallengeNotified = true
+	s.store[threeDSTransactionID] = tx
+	return nil
+}
+
+// StartAuthentication binds an authenticate request to the transaction created at checkout, and
+// records that authentication has started so that the transaction cannot be authenticated again
+// unless it is released by ReleaseAuthentication.
+// The card and, if set, the message version must match those used at checkout.
+func (s *ThreeDSTransactionStore) StartAuthentication(threeDSTransactionID string, panFingerprint string, messageVersion string) (ThreeDSTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok {
+		return ThreeDSTransaction{}, ErrTransactionNotFound
+	}
+
+	if !tx.AuthenticationStartedAt.IsZero() {
+		return ThreeDSTransaction{}, ErrTransactionAlreadyAuthenticated
+	}
+
+	if tx.PANFingerprint == "" || !hmac.Equal([]byte(tx.PANFingerprint), []byte(panFingerprint)) {
+		return ThreeDSTransaction{}, ErrCardMismatch
+	}
+
+	if messageVersion != "" && messageVersion != tx.MessageVersion {
+		return ThreeDSTransaction{}, ErrMessageVersionMismatch
+	}
+
+	tx.AuthenticationStartedAt = time.Now()
+	s.store[threeDSTransactionID] = tx
+	return tx, nil
+}
+
+// ReleaseAuthentication allows the transaction to be authenticated again, after an authenticate
+// request started by StartAuthentication failed without being sent to Ravelin.
+func (s *ThreeDSTransactionStore) ReleaseAuthentication(threeDSTransactionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok || tx.AuthenticateTransStatus != "" {
+		return
+	}
+
+	tx.AuthenticationStartedAt = time.Time{}
+	s.store[threeDSTransactionID] = tx
+}
+
+// SetCustomerID records the customer who authenticated the transaction.
+func (s *ThreeDSTransactionStore) SetCustomerID(threeDSTransactionID string, customerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok {
+		return ErrTransactionNotFound
+	}
+
+	tx.CustomerID = customerID
+	s.store[threeDSTransactionID] = tx
+	return nil
+}
+
+// SetAuthenticateResponse records the outcome of the authenticate request and any issuer
+// or DS information which was returned with it.
+func (s *ThreeDSTransactionStore) SetAuthenticateResponse(threeDSTransactionID string, transStatus string, acsTransID string, cardholderInfo string, broadInfo *domain.BroadInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.store[threeDSTransactionID]
+	if !ok {
+		return ErrTransactionNotFound
+	}
+
+	tx.AuthenticateTransStatus = transStatus
+	tx.AuthenticatedAt = time.Now()
+	tx.ACSTransID = acsTransID
+	tx.CardholderInfo = cardholderInfo
+	tx.BroadInfo = broadInfo
+	s.store[threeDSTransactionID] = tx
+	return nil
+}
+
+// All returns a copy of every transaction in the store, keyed by threeDSServerTransID.
+func (s *ThreeDSTransactionStore) All() map[string]ThreeDSTransaction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string]ThreeDSTransaction, len(s.store))
+	for id, tx := range s.store {
+		all[id] = tx
+	}
+	return all
+}
+
+// CountAbandonedChallenges returns the number of transactions where a challenge was required
+// more than olderThan ago, but no result has been received.
+func (s *ThreeDSTransactionStore) CountAbandonedChallenges(olderThan time.Duration) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	count := 0
+	for _, tx := range s.store {
+		if tx.AuthenticateTransStatus == "C" && tx.Result == nil && tx.AuthenticatedAt.Before(cutoff) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThreeDSTransactionStore_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	store, err := NewPersistentThreeDSTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.Add("tx-1", ThreeDSTransaction{MessageVersion: "2.2.0", MethodStatus: MethodStatusCompleted, AuthenticateTransStatus: "C"})
+	if _, _, err := store.SetResult("tx-1", ThreeDSResult{TransStatus: "Y", AuthenticationValue: "AAAA"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewPersistentThreeDSTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, ok := loaded.Get("tx-1")
+	if !ok {
+		t.Fatal("expected transaction to be loaded")
+	}
+	if tx.MessageVersion != "2.2.0" || tx.MethodStatus != MethodStatusCompleted {
+		t.Errorf("expected: %v, actual: %v", "2.2.0 "+MethodStatusCompleted, tx.MessageVersion+" "+tx.MethodStatus)
+	}
+	if tx.Result == nil || !tx.Result.Successful() {
+		t.Errorf("expected successful result, actual: %+v", tx.Result)
+	}
+}
+
+func TestThreeDSTransactionStore_Flush_inMemory(t *testing.T) {
+	store := NewThreeDSTransactionStore()
+	store.Add("tx-1", ThreeDSTransaction{})
+
+	if err := store.Flush(); err != nil {
+		t.Errorf("expected nil error, actual: %v", err)
+	}
+}
+
+func TestThreeDSTransactionStore_StartAuthentication(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		panFingerprint string
+		messageVersion string
+		wantErr        error
+	}{
+		{name: "unknown transaction", id: "tx-2", panFingerprint: "card-a", wantErr: ErrTransactionNotFound},
+		{name: "other card", id: "tx-1", panFingerprint: "card-b", wantErr: ErrCardMismatch},
+		{name: "other version", id: "tx-1", panFingerprint: "card-a", messageVersion: "2.1.0", wantErr: ErrMessageVersionMismatch},
+		{name: "matching", id: "tx-1", panFingerprint: "card-a", messageVersion: "2.2.0"},
+		{name: "already started", id: "tx-1", panFingerprint: "card-a", wantErr: ErrTransactionAlreadyAuthenticated},
+	}
+
+	store := NewThreeDSTransactionStore()
+	store.Add("tx-1", ThreeDSTransaction{MessageVersion: "2.2.0", PANFingerprint: "card-a"})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.StartAuthentication(tt.id, tt.panFingerprint, tt.messageVersion)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected: %v, actual: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestThreeDSTransactionStore_ReleaseAuthentication(t *testing.T) {
+	store := NewThreeDSTransactionStore()
+	store.Add("tx-1", ThreeDSTransaction{MessageVersion: "2.2.0", PANFingerprint: "card-a"})
+
+	if _, err := store.StartAuthentication("tx-1", "card-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	store.ReleaseAuthentication("tx-1")
+	if _, err := store.StartAuthentication("tx-1", "card-a", ""); err != nil {
+		t.Fatalf("expected a released transaction to be authenticated again, actual: %v", err)
+	}
+
+	// once an ARes is received the transaction stays authenticated
+	if err := store.SetAuthenticateResponse("tx-1", "Y", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	store.ReleaseAuthentication("tx-1")
+	if _, err := store.StartAuthentication("tx-1", "card-a", ""); !errors.Is(err, ErrTransactionAlreadyAuthenticated) {
+		t.Errorf("expected: %v, actual: %v", ErrTransactionAlreadyAuthenticated, err)
+	}
+}
+
+func TestThreeDSTransactionStore_evict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	store, err := NewPersistentThreeDSTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.SetTTL(time.Hour)
+
+	store.Add("tx-1", ThreeDSTransaction{})
+	now = now.Add(30 * time.Minute)
+	store.Add("tx-2", ThreeDSTransaction{})
+
+	// adding a transaction evicts those older than the TTL
+	now = now.Add(30 * time.Minute)
+	store.Add("tx-3", ThreeDSTransaction{})
+	if _, ok := store.Get("tx-1"); ok {
+		t.Error("expected tx-1 to be evicted")
+	}
+	if _, ok := store.Get("tx-2"); !ok {
+		t.Error("expected tx-2 to be kept")
+	}
+
+	// evicted transactions are not flushed
+	now = now.Add(30 * time.Minute)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewPersistentThreeDSTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := loaded.All(); len(all) != 1 {
+		t.Errorf("expected: %d, actual: %d", 1, len(all))
+	}
+}
@@ -2,10 +2,10 @@ package handler
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/unravelin/ravelin-3ds-demo/domain"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
 )
 
 func (h Handler) TestCards(rw http.ResponseWriter, r *http.Request) {
@@ -14,16 +14,18 @@ func (h Handler) TestCards(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rsp, err := h.sendToRavelin3DSServer(http.MethodGet, nil, domain.RavelinThreeDSTestCardsEndpoint)
+	logger := logging.FromContext(r.Context())
+
+	rsp, err := h.sendToRavelin3DSServer(r.Context(), http.MethodGet, nil, domain.RavelinThreeDSTestCardsEndpoint)
 	if err != nil {
-		log.Printf("failed to send Ravelin 3DS Test Cards Request: %v", err)
-		rw.WriteHeader(http.StatusBadRequest)
+		logger.Error("failed to send Ravelin 3DS Test Cards Request", "error", err)
+		respondError(err, rw)
 		return
 	}
 
 	body, err := readBody(rsp.Body)
 	if err != nil {
-		log.Printf("failed to read /3ds/testcards response: %v", err)
+		logger.Error("failed to read /3ds/testcards response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -31,21 +33,21 @@ func (h Handler) TestCards(rw http.ResponseWriter, r *http.Request) {
 	testCardsResponse := domain.RavelinTestCardsResponse{}
 	err = json.Unmarshal(body, &testCardsResponse)
 	if err != nil {
-		log.Printf("failed to JSON decode /3ds/testcards response: %v", err)
+		logger.Error("failed to JSON decode /3ds/testcards response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	body, err = json.Marshal(testCardsResponse.Data)
 	if err != nil {
-		log.Printf("failed to JSON encode Test Cards response: %v", err)
+		logger.Error("failed to JSON encode Test Cards response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	_, err = rw.Write(body)
 	if err != nil {
-		log.Printf("failed to write Test Cards response: %v", err)
+		logger.Error("failed to write Test Cards response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/unravelin/ravelin-3ds-demo/tracing"
+)
+
+func TestHandler_tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	ravelin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("traceparent") == "" {
+			t.Error("expected trace context to be propagated to Ravelin")
+		}
+		_, _ = w.Write([]byte(`{"status":200,"data":{"threeDSServerTransID":"tx-1","threeDSMethodURL":"https://acs.example/method","versionRecommendation":"2.2.0"}}`))
+	}))
+	defer ravelin.Close()
+
+	signer, _ := NewSessionDataSigner(nil, 0)
+	h := Handler{
+		RavelinApiUrl:                      ravelin.URL,
+		RavelinApiKeys:                     testApiKeys(t),
+		ThreeDSTransactionStore:            NewThreeDSTransactionStore(),
+		SessionDataSigner:                  signer,
+		CardVault:                          testCardVault(t),
+		MethodNotificationResponseTemplate: template.Must(template.New("").Parse("{{.}}")),
+	}
+
+	checkout := tracing.Middleware(CheckoutEndpoint, h.Checkout)
+	w := httptest.NewRecorder()
+	checkout(w, httptest.NewRequest(http.MethodPost, CheckoutEndpoint, strings.NewReader(`{"accountNumber":"4000000000001000"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected checkout status %d, actual: %d", http.StatusOK, w.Code)
+	}
+
+	methodData := base64.RawURLEncoding.EncodeToString([]byte(`{"threeDSServerTransID":"tx-1"}`))
+	form := url.Values{"threeDSMethodData": {methodData}}
+	r := httptest.NewRequest(http.MethodPost, MethodNotificationEndpoint, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	tracing.Middleware(MethodNotificationEndpoint, h.MethodNotification)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected method notification status %d, actual: %d", http.StatusOK, w.Code)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	checkoutSpan, ok := spans[CheckoutEndpoint]
+	if !ok {
+		t.Fatalf("expected %s span, actual: %v", CheckoutEndpoint, spans)
+	}
+
+	versionSpan := spans["ravelin /3ds/version"]
+	if versionSpan.Parent.SpanID() != checkoutSpan.SpanContext.SpanID() {
+		t.Errorf("expected version request span to be a child of the checkout span")
+	}
+
+	methodSpan := spans["threeds.method_notification"]
+	if methodSpan.SpanContext.TraceID() != checkoutSpan.SpanContext.TraceID() {
+		t.Errorf("expected method notification to join the checkout trace %s, actual: %s",
+			checkoutSpan.SpanContext.TraceID(), methodSpan.SpanContext.TraceID())
+	}
+	if len(methodSpan.Links) != 1 || methodSpan.Links[0].SpanContext.SpanID() != spans[MethodNotificationEndpoint].SpanContext.SpanID() {
+		t.Errorf("expected method notification span to link to its request span")
+	}
+}
@@ -0,0 +1,47 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store.json")
+
+	for _, data := range []string{`{"v":1}`, `{"v":2}`} {
+		if err := WriteFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		bb, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bb) != data {
+			t.Errorf("expected: %s, actual: %s", data, bb)
+		}
+	}
+
+	// the temporary file is not left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected: %d, actual: %d", 1, len(entries))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected: %v, actual: %v", os.FileMode(0600), info.Mode().Perm())
+	}
+
+	if err := WriteFile(filepath.Join(dir, "missing", "store.json"), nil); err == nil {
+		t.Error("expected error writing to a missing directory")
+	}
+}
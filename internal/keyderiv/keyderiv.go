@@ -0,0 +1,35 @@
+// Package keyderiv derives the keys used for separate purposes from a single configured key,
+// so that a key used to encrypt data is never also used to sign or fingerprint it.
+package keyderiv
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// MinKeyLength is the shortest key accepted, in bytes. Keys are not stretched, so they must be
+// random rather than a memorable passphrase.
+const MinKeyLength = 32
+
+var ErrKeyTooShort = fmt.Errorf("key must be at least %d bytes", MinKeyLength)
+
+// Derive returns a 256 bit key for the purpose described by info, derived from key with
+// HKDF-SHA256. Different info strings give independent keys.
+func Derive(key []byte, info string) ([]byte, error) {
+	if len(key) < MinKeyLength {
+		return nil, ErrKeyTooShort
+	}
+	if info == "" {
+		return nil, errors.New("key purpose is required")
+	}
+
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), derived); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return derived, nil
+}
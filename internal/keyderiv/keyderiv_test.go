@@ -0,0 +1,32 @@
+package keyderiv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	encryption, err := Derive(key, "encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := Derive(key, "encryption")
+	if !bytes.Equal(encryption, again) {
+		t.Error("expected the same key and purpose to derive the same key")
+	}
+
+	signing, _ := Derive(key, "signing")
+	if bytes.Equal(encryption, signing) {
+		t.Error("expected different purposes to derive different keys")
+	}
+	if len(encryption) != 32 {
+		t.Errorf("expected: %d, actual: %d", 32, len(encryption))
+	}
+
+	if _, err := Derive(key[:MinKeyLength-1], "encryption"); !errors.Is(err, ErrKeyTooShort) {
+		t.Errorf("expected: %v, actual: %v", ErrKeyTooShort, err)
+	}
+}
@@ -0,0 +1,67 @@
+// Package statuswriter records the status code written by an HTTP handler, so that middleware
+// can log, count or trace the response once the handler has returned.
+package statuswriter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Writer wraps an http.ResponseWriter and records the first status code written to it.
+// A handler which never calls WriteHeader is recorded as http.StatusOK.
+type Writer struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// Wrap returns w wrapped in a Writer. If w is already a Writer it is returned as is, so that
+// stacked middleware share a single wrapper.
+func Wrap(w http.ResponseWriter) *Writer {
+	if sw, ok := w.(*Writer); ok {
+		return sw
+	}
+	return &Writer{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status returns the status code written to the response.
+func (w *Writer) Status() int {
+	return w.status
+}
+
+func (w *Writer) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher if the wrapped writer does.
+func (w *Writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the wrapped writer does.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,54 @@
+package statuswriter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+		want    int
+	}{
+		{name: "implicit", handler: func(w http.ResponseWriter) { _, _ = w.Write([]byte("ok")) }, want: http.StatusOK},
+		{name: "explicit", handler: func(w http.ResponseWriter) { w.WriteHeader(http.StatusTeapot) }, want: http.StatusTeapot},
+		{name: "first wins", handler: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, want: http.StatusNotFound},
+		{name: "after write", handler: func(w http.ResponseWriter) {
+			_, _ = w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusInternalServerError)
+		}, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw := Wrap(httptest.NewRecorder())
+			tt.handler(sw)
+			if sw.Status() != tt.want {
+				t.Errorf("expected: %v, actual: %v", tt.want, sw.Status())
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := Wrap(rec)
+	if Wrap(sw) != sw {
+		t.Error("expected a Writer to be reused")
+	}
+
+	var w http.ResponseWriter = sw
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("expected Writer to implement http.Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("expected flush to reach the wrapped writer")
+	}
+}
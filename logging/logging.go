@@ -0,0 +1,167 @@
+// Package logging provides levelled JSON logging with automatic masking of card data,
+// and helpers to carry a request scoped logger in a context.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel converts a level name such as "info" into a Level.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes one JSON object per line. Fields are given as alternating keys and values,
+// and are masked by Mask before being written.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	fields []interface{}
+	now    func() time.Time
+}
+
+// New creates a Logger which writes entries at or above level to out.
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		out:   out,
+		level: level,
+		now:   time.Now,
+	}
+}
+
+var defaultLogger = New(os.Stdout, LevelInfo)
+
+// Default returns the logger used when there is none in a context.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetDefault replaces the logger returned by Default.
+func SetDefault(l *Logger) {
+	defaultLogger = l
+}
+
+// With returns a Logger which adds the given keys and values to every entry.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keysAndValues...)
+
+	child := *l
+	child.fields = fields
+	return &child
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeJSON(buf, l.now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(buf, MaskText(msg))
+
+	writeFields(buf, l.fields)
+	writeFields(buf, keysAndValues)
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(buf.Bytes())
+}
+
+func writeFields(buf *bytes.Buffer, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		var value interface{} = "!MISSING"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+
+		buf.WriteByte(',')
+		writeJSON(buf, key)
+		buf.WriteByte(':')
+		writeJSON(buf, Mask(key, value))
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	bb, err := json.Marshal(v)
+	if err != nil {
+		bb, _ = json.Marshal(fmt.Sprintf("!ERROR %v", err))
+	}
+	buf.Write(bb)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx which carries l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger if there is none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,190 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Field names, lower cased, whose values are always masked regardless of where they appear.
+var (
+	panKeys = map[string]bool{
+		"pan":           true,
+		"accountnumber": true,
+		"acctnumber":    true,
+		"cardnumber":    true,
+	}
+	expiryKeys = map[string]bool{
+		"cardexpirydate": true,
+		"expirydate":     true,
+		"expiry":         true,
+	}
+	secretKeys = map[string]bool{
+		"authenticationvalue": true,
+		"cavv":                true,
+		"authorization":       true,
+		"apikey":              true,
+		"ravelinapikey":       true,
+		"threedssessiondata":  true,
+		"token":               true,
+	}
+	// personalKeys are the cardholder's personal details, which are also sent in the AReq. Objects
+	// such as the cardholder and their addresses are redacted whole.
+	personalKeys = map[string]bool{
+		"cardholder":       true,
+		"cardholdername":   true,
+		"email":            true,
+		"mobilephone":      true,
+		"homephone":        true,
+		"workphone":        true,
+		"billingaddress":   true,
+		"shippingaddress":  true,
+		"billaddrline1":    true,
+		"billaddrline2":    true,
+		"billaddrline3":    true,
+		"billaddrcity":     true,
+		"billaddrstate":    true,
+		"billaddrpostcode": true,
+		"shipaddrline1":    true,
+		"shipaddrline2":    true,
+		"shipaddrline3":    true,
+		"shipaddrcity":     true,
+		"shipaddrstate":    true,
+		"shipaddrpostcode": true,
+		"browserip":        true,
+	}
+)
+
+// Mask returns a copy of value which is safe to log under key. Card numbers, expiry dates,
+// authentication values and the cardholder's personal details are masked based on the key, and
+// any nested structs, maps or slices are masked by their JSON field names. Card numbers in free
+// text are also masked.
+func Mask(key string, value interface{}) interface{} {
+	lowerKey := strings.ToLower(key)
+	switch {
+	case panKeys[lowerKey]:
+		return MaskPAN(fmt.Sprint(value))
+	case expiryKeys[lowerKey]:
+		return "****"
+	case secretKeys[lowerKey], personalKeys[lowerKey]:
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return MaskText(v)
+	case error:
+		return MaskText(v.Error())
+	case json.RawMessage:
+		var generic interface{}
+		if err := json.Unmarshal(v, &generic); err != nil {
+			return MaskText(string(v))
+		}
+		return maskGeneric(generic)
+	case fmt.Stringer:
+		return MaskText(v.String())
+	}
+
+	// round trip through JSON so nested values can be masked by field name
+	bb, err := json.Marshal(value)
+	if err != nil {
+		return MaskText(fmt.Sprint(value))
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(bb, &generic); err != nil {
+		return MaskText(string(bb))
+	}
+	return maskGeneric(generic)
+}
+
+func maskGeneric(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, nested := range v {
+			v[k] = Mask(k, nested)
+		}
+		return v
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = maskGeneric(nested)
+		}
+		return v
+	case string:
+		return MaskText(v)
+	}
+	return value
+}
+
+// MaskPAN masks all but the last four digits of a card number.
+func MaskPAN(pan string) string {
+	if len(pan) <= 4 {
+		return strings.Repeat("*", len(pan))
+	}
+	return strings.Repeat("*", len(pan)-4) + pan[len(pan)-4:]
+}
+
+// MaskText masks any card numbers found in free text. A card number is a run of 13 to 19
+// digits which passes the Luhn check.
+func MaskText(text string) string {
+	var sb *strings.Builder
+	start := -1
+	flush := func(end int) {
+		digits := text[start:end]
+		if len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits) {
+			if sb == nil {
+				sb = &strings.Builder{}
+				sb.WriteString(text[:start])
+			}
+			sb.WriteString(MaskPAN(digits))
+		} else if sb != nil {
+			sb.WriteString(digits)
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c >= '0' && c <= '9' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+			start = -1
+		}
+		if sb != nil {
+			sb.WriteByte(c)
+		}
+	}
+	if start >= 0 {
+		flush(len(text))
+	}
+
+	if sb == nil {
+		return text
+	}
+	return sb.String()
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
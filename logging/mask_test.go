@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMaskText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "", want: ""},
+		{text: "no card here", want: "no card here"},
+		{text: "card 4111111111111111 declined", want: "card ************1111 declined"},
+		{text: "4000000000001091", want: "************1091"},
+		{text: "order 1234567890123 is not a card", want: "order 1234567890123 is not a card"},
+		{text: "tx 8a880dc0-d2d2-4067-bcb1-b08d1690b26e", want: "tx 8a880dc0-d2d2-4067-bcb1-b08d1690b26e"},
+		{text: "a=5555555555554444&b=1", want: "a=************4444&b=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := MaskText(tt.text); got != tt.want {
+				t.Errorf("MaskText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogger_masksFields(t *testing.T) {
+	type areq struct {
+		PAN                 string `json:"pan"`
+		CardExpiryDate      string `json:"cardExpiryDate"`
+		AuthenticationValue string `json:"authenticationValue"`
+		MessageVersion      string `json:"messageVersion"`
+	}
+
+	buf := &bytes.Buffer{}
+	logger := New(buf, LevelInfo).With("requestID", "req-1")
+	logger.Debug("not written")
+	logger.Info("sending 4111111111111111",
+		"accountNumber", "4111111111111111",
+		"cardExpiryDate", "3012",
+		"areq", areq{PAN: "4111111111111111", CardExpiryDate: "3012", AuthenticationValue: "AAABBB=", MessageVersion: "2.2.0"},
+	)
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected one log entry, actual: %q", line)
+	}
+	for _, leaked := range []string{"4111111111111111", "3012", "AAABBB="} {
+		if strings.Contains(line, leaked) {
+			t.Errorf("expected %q to be masked, actual: %s", leaked, line)
+		}
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("expected JSON log entry, actual: %v", err)
+	}
+	if entry["level"] != "info" || entry["requestID"] != "req-1" || entry["accountNumber"] != "************1111" {
+		t.Errorf("unexpected log entry: %s", line)
+	}
+	if areqEntry, _ := entry["areq"].(map[string]interface{}); areqEntry["messageVersion"] != "2.2.0" {
+		t.Errorf("expected unmasked messageVersion, actual: %s", line)
+	}
+}
+
+func TestLogger_masksPersonalFields(t *testing.T) {
+	type address struct {
+		Line1   string `json:"line1"`
+		Country string `json:"country"`
+	}
+	type cardholder struct {
+		Name           string  `json:"name"`
+		BillingAddress address `json:"billingAddress"`
+	}
+	type areq struct {
+		CardholderName string `json:"cardholderName"`
+		Email          string `json:"email"`
+		MobilePhone    struct {
+			CC         string `json:"cc"`
+			Subscriber string `json:"subscriber"`
+		} `json:"mobilePhone"`
+		BillAddrLine1    string `json:"billAddrLine1"`
+		BillAddrPostCode string `json:"billAddrPostCode"`
+		BillAddrCountry  string `json:"billAddrCountry"`
+		ShipAddrCity     string `json:"shipAddrCity"`
+		BrowserIP        string `json:"browserIP"`
+	}
+
+	request := areq{
+		CardholderName:   "Jane Smith",
+		Email:            "jane.smith@example.com",
+		BillAddrLine1:    "1 Example Street",
+		BillAddrPostCode: "EC1A 1BB",
+		BillAddrCountry:  "826",
+		ShipAddrCity:     "Manchester",
+		BrowserIP:        "192.0.2.1",
+	}
+	request.MobilePhone.CC = "44"
+	request.MobilePhone.Subscriber = "7700900123"
+
+	buf := &bytes.Buffer{}
+	logger := New(buf, LevelInfo)
+	logger.Info("authenticating",
+		"areq", request,
+		"cardholder", cardholder{Name: "Jane Smith", BillingAddress: address{Line1: "2 Example Street", Country: "GB"}},
+	)
+
+	line := buf.String()
+	for _, leaked := range []string{"Jane Smith", "jane.smith@example.com", "7700900123", "Example Street", "EC1A 1BB", "Manchester", "192.0.2.1"} {
+		if strings.Contains(line, leaked) {
+			t.Errorf("expected %q to be masked, actual: %s", leaked, line)
+		}
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("expected JSON log entry, actual: %v", err)
+	}
+	if areqEntry, _ := entry["areq"].(map[string]interface{}); areqEntry["billAddrCountry"] != "826" {
+		t.Errorf("expected unmasked billAddrCountry, actual: %s", line)
+	}
+}
@@ -1,64 +1,374 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io/fs"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/unravelin/ravelin-3ds-demo/audit"
+	"github.com/unravelin/ravelin-3ds-demo/customer"
+	"github.com/unravelin/ravelin-3ds-demo/domain"
 	"github.com/unravelin/ravelin-3ds-demo/handler"
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/metrics"
+	"github.com/unravelin/ravelin-3ds-demo/tlscert"
+	"github.com/unravelin/ravelin-3ds-demo/tracing"
+	"github.com/unravelin/ravelin-3ds-demo/vault"
 )
 
 var (
 	//go:embed static templates
 	embeddedFS embed.FS
+
+	// version is set at build time with -ldflags "-X main.version=<version>"
+	version = "dev"
 )
 
 const (
 	defaultRavelinApiUrl = "https://pci.ravelin.com"
 	defaultMerchantUrl   = "http://localhost:8085"
+	apiKeyReloadInterval = 10 * time.Second
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(runCertCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	var ravelinApiKey string
+	var ravelinApiKeyFile string
+	var ravelinApiKeySecondary string
+	var ravelinApiKeySecondaryFile string
 	var ravelinApiUrl string
 	var merchantUrl string
+	var merchantCountry string
+	var resultsToken string
+	var operatorToken string
+	var strictBase64 bool
+	var sessionDataKey string
+	var sessionDataTTL time.Duration
+	var transactionTTL time.Duration
+	var logLevel string
+	var traceExporter string
+	var auditLogPath string
+	var auditKey string
+	var ravelinTimeout time.Duration
+	var ravelinAuthenticateTimeout time.Duration
+	var ravelinMaxRetries int
+	var circuitBreakerThreshold int
+	var circuitBreakerCooldown time.Duration
+	var fallbackPolicyPath string
+	var storeFile string
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var idleTimeout time.Duration
+	var shutdownTimeout time.Duration
+	var apiKeyCheckTTL time.Duration
+	var allowedOrigins string
+	var frameOrigins string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var acmeDomains string
+	var acmeCacheDir string
+	var acmeEmail string
+	var httpRedirectAddr string
+	var maxRequestBytes int64
+	var trustedProxies string
+	var cardVaultKey string
+	var cardVaultFile string
+	var cardTokenTTL time.Duration
+	var customerCookieKey string
+	var customerStoreFile string
+	abuseLimits := handler.DefaultAbuseLimits()
 
 	flag.StringVar(&ravelinApiKey, "ravelin-api-key", ravelinApiKey, "Ravelin API Key - Can also be set as $RAVELIN_API_KEY")
 	flag.StringVar(&ravelinApiUrl, "ravelin-api-url", defaultRavelinApiUrl, "Ravelin API URL")
 	flag.StringVar(&merchantUrl, "merchant-url", defaultMerchantUrl, "Merchant URL - If url does not contain a port, server is run on $PORT")
+	flag.StringVar(&merchantCountry, "merchant-country", "GB", "ISO 3166-1 alpha-2 code of the country the merchant trades from, which decides whether SCA applies")
+	flag.StringVar(&resultsToken, "results-token", resultsToken, "Token required to call the results endpoint - Can also be set as $RESULTS_TOKEN. The endpoint is disabled if not set")
+	flag.StringVar(&operatorToken, "operator-token", operatorToken, "Token required to call the operator endpoints - Can also be set as $OPERATOR_TOKEN. The endpoints are disabled if not set")
+	flag.BoolVar(&strictBase64, "strict-base64", false, "Only accept base64url encoded CRes and threeDSMethodData without padding, as specified by EMVCo")
+	flag.StringVar(&sessionDataKey, "session-data-key", sessionDataKey, "Key used to sign threeDSSessionData - Can also be set as $SESSION_DATA_KEY. A random key is generated if not set")
+	flag.DurationVar(&sessionDataTTL, "session-data-ttl", 10*time.Minute, "How long a challenge can take before threeDSSessionData expires")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of log entries to write: debug, info, warn or error")
+	flag.StringVar(&traceExporter, "trace-exporter", tracing.ExporterNone, "OpenTelemetry trace exporter: none, stdout or otlp. The otlp exporter is configured with the $OTEL_EXPORTER_OTLP_* environment variables")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Path of the append-only audit log of every 3DS message exchanged. Auditing is disabled if not set")
+	flag.StringVar(&auditKey, "audit-key", auditKey, "Key used to sign the audit log hash chain - Can also be set as $AUDIT_KEY. Required with -audit-log")
+	flag.DurationVar(&ravelinTimeout, "ravelin-timeout", 10*time.Second, "Timeout for each attempt at a request to Ravelin's 3DS API, other than authentication")
+	flag.DurationVar(&ravelinAuthenticateTimeout, "ravelin-authenticate-timeout", 30*time.Second, "Timeout for requests to Ravelin's 3DS authenticate endpoint")
+	flag.IntVar(&ravelinMaxRetries, "ravelin-max-retries", 2, "How many times retry-safe requests to Ravelin's 3DS API are retried after a transient failure. Authentication requests are never retried")
+	flag.IntVar(&circuitBreakerThreshold, "circuit-breaker-threshold", 5, "Consecutive failures of Ravelin's 3DS API after which requests fail fast. Circuit breaking is disabled if 0")
+	flag.DurationVar(&circuitBreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "How long requests fail fast for before a trial request is sent to Ravelin's 3DS API")
+	flag.StringVar(&fallbackPolicyPath, "fallback-policy", "", "Path of a JSON fallback policy deciding whether checkouts proceed without 3DS, are retried later or are declined when 3DS is unavailable. A default policy is used if not set")
+	flag.StringVar(&storeFile, "store-file", "", "Path of the file transactions are persisted to on shutdown and loaded from on start up. Transactions are only held in memory if not set")
+	flag.DurationVar(&transactionTTL, "transaction-ttl", handler.DefaultTransactionTTL, "How long after checkout transactions are kept for. Must be longer than -card-token-ttl plus -session-data-ttl")
+	flag.DurationVar(&readTimeout, "read-timeout", 10*time.Second, "Maximum duration for reading an entire request, including the body")
+	flag.DurationVar(&writeTimeout, "write-timeout", 90*time.Second, "Maximum duration before timing out writes of the response. Must allow for requests to Ravelin's 3DS API, including retries")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 120*time.Second, "Maximum amount of time to wait for the next request on a keep-alive connection")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in flight requests to complete on SIGTERM or SIGINT")
+	flag.DurationVar(&apiKeyCheckTTL, "api-key-check-ttl", time.Minute, "How long the readiness endpoint caches the result of checking the Ravelin API key")
+	flag.StringVar(&allowedOrigins, "allowed-origins", "", "Comma separated origins, in addition to the merchant URL's origin, which browsers may call the checkout, authenticate and test cards endpoints from")
+	flag.StringVar(&frameOrigins, "frame-origins", "", "Comma separated ACS and 3DS Method origins, in addition to the Ravelin API URL's origin, which the Content Security Policy allows the checkout to frame and post forms to")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "Path of the PEM encoded TLS certificate to serve. The certificate is reloaded when the file changes. The server is run over https if set")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "Path of the PEM encoded private key of the TLS certificate")
+	flag.StringVar(&acmeDomains, "acme-domains", "", "Comma separated domains to obtain TLS certificates for automatically with ACME, as an alternative to -tls-cert and -tls-key")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", "acme-cache", "Directory ACME certificates and account keys are cached in")
+	flag.StringVar(&acmeEmail, "acme-email", "", "Contact email address for the ACME account")
+	flag.StringVar(&httpRedirectAddr, "http-redirect-addr", "", "Address of a plain http listener which redirects to the https merchant URL, for example :8080. Defaults to :80 with ACME, and is disabled otherwise")
+	flag.StringVar(&ravelinApiKeyFile, "ravelin-api-key-file", "", "Path of a file containing the Ravelin API Key, such as a mounted secret. The file is reloaded when it changes, and takes precedence over -ravelin-api-key")
+	flag.StringVar(&ravelinApiKeySecondary, "ravelin-api-key-secondary", "", "Secondary Ravelin API Key, used when the primary key is unauthorised during key rotation - Can also be set as $RAVELIN_API_KEY_SECONDARY")
+	flag.StringVar(&ravelinApiKeySecondaryFile, "ravelin-api-key-secondary-file", "", "Path of a file containing the secondary Ravelin API Key. The file is reloaded when it changes")
+	flag.StringVar(&cardVaultKey, "card-vault-key", cardVaultKey, "Key used to encrypt card numbers in the card vault, of at least 32 random characters - Can also be set as $CARD_VAULT_KEY. A random key is generated if not set, which is only allowed without -card-vault-file")
+	flag.StringVar(&cardVaultFile, "card-vault-file", "", "Path of the file encrypted card numbers are persisted to on shutdown and loaded from on start up. Card numbers are only held in memory if not set")
+	flag.DurationVar(&cardTokenTTL, "card-token-ttl", 30*time.Minute, "How long after checkout the card token can be used to authenticate")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated IP addresses and CIDR ranges of load balancers and proxies, which are trusted to set the X-Forwarded-For header")
+	flag.StringVar(&customerCookieKey, "customer-cookie-key", customerCookieKey, "Key used to sign the cookie which identifies returning customers and to digest their details, of at least 32 random characters - Can also be set as $CUSTOMER_COOKIE_KEY. A random key is generated if not set, which is only allowed without -customer-store-file")
+	flag.StringVar(&customerStoreFile, "customer-store-file", "", "Path of the file customers are persisted to on shutdown and loaded from on start up. Customers are only held in memory if not set")
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", handler.DefaultMaxRequestBytes, "Largest request body accepted. Larger requests are rejected with a 413")
+	flag.Float64Var(&abuseLimits.IPRate, "ip-rate-limit", abuseLimits.IPRate, "Checkout and authenticate requests allowed per minute from each IP address. Rate limiting by IP address is disabled if 0")
+	flag.IntVar(&abuseLimits.IPBurst, "ip-burst", abuseLimits.IPBurst, "Checkout and authenticate requests allowed in a burst from each IP address")
+	flag.Float64Var(&abuseLimits.CardRate, "card-rate-limit", abuseLimits.CardRate, "Checkout and authenticate requests allowed per minute for each card. Rate limiting by card is disabled if 0")
+	flag.IntVar(&abuseLimits.CardBurst, "card-burst", abuseLimits.CardBurst, "Checkout and authenticate requests allowed in a burst for each card")
+	flag.DurationVar(&abuseLimits.Window, "velocity-window", abuseLimits.Window, "How long distinct cards per IP address and authentication failures per card are counted for")
+	flag.IntVar(&abuseLimits.ChallengeCardsPerIP, "challenge-cards-per-ip", abuseLimits.ChallengeCardsPerIP, "Distinct cards used from an IP address in the velocity window after which a challenge is mandated. Disabled if 0")
+	flag.IntVar(&abuseLimits.MaxCardsPerIP, "max-cards-per-ip", abuseLimits.MaxCardsPerIP, "Distinct cards which can be used from an IP address in the velocity window before its requests are blocked. Disabled if 0")
+	flag.IntVar(&abuseLimits.ChallengeCardFailures, "challenge-card-failures", abuseLimits.ChallengeCardFailures, "Authentication failures of a card in the velocity window after which a challenge is mandated. Disabled if 0")
+	flag.IntVar(&abuseLimits.MaxCardFailures, "max-card-failures", abuseLimits.MaxCardFailures, "Authentication failures of a card in the velocity window after which its requests are blocked. Disabled if 0")
+	flag.IntVar(&abuseLimits.MaxTracked, "abuse-max-tracked", abuseLimits.MaxTracked, "IP addresses, and cards, remembered by the rate limits and velocity rules, beyond which the least recently seen are forgotten. Unlimited if 0")
 	flag.Parse()
 
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		panic(err)
+	}
+	logger := logging.New(os.Stdout, level)
+	logging.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), traceExporter)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}()
+
+	if operatorToken == "" {
+		operatorToken = os.Getenv("OPERATOR_TOKEN")
+	}
+
+	if sessionDataKey == "" {
+		sessionDataKey = os.Getenv("SESSION_DATA_KEY")
+	}
+
+	if cardVaultKey == "" {
+		cardVaultKey = os.Getenv("CARD_VAULT_KEY")
+	}
+
+	if customerCookieKey == "" {
+		customerCookieKey = os.Getenv("CUSTOMER_COOKIE_KEY")
+	}
+
+	if auditKey == "" {
+		auditKey = os.Getenv("AUDIT_KEY")
+	}
+
+	if resultsToken == "" {
+		resultsToken = os.Getenv("RESULTS_TOKEN")
+	}
+
 	if ravelinApiKey == "" {
 		ravelinApiKey = os.Getenv("RAVELIN_API_KEY")
-		if ravelinApiKey == "" {
-			panic("Ravelin API Key not set")
-		}
+	}
+
+	if ravelinApiKeySecondary == "" {
+		ravelinApiKeySecondary = os.Getenv("RAVELIN_API_KEY_SECONDARY")
 	}
 
 	if ravelinApiUrl == "" {
 		panic("Ravelin API URL not set")
 	}
 
+	if cardVaultFile != "" && cardVaultKey == "" {
+		panic("Card vault key must be set when the card vault is persisted to a file")
+	}
+
+	if transactionTTL <= cardTokenTTL+sessionDataTTL {
+		panic("Transaction TTL must be longer than the card token TTL plus the session data TTL")
+	}
+
+	if customerStoreFile != "" && customerCookieKey == "" {
+		panic("Customer cookie key must be set when customers are persisted to a file")
+	}
+
+	if auditLogPath != "" && auditKey == "" {
+		panic("Audit key must be set when the audit log is enabled")
+	}
+
 	if merchantUrl == "" {
 		panic("Merchant URL not set")
 	}
 
+	if !handler.ValidCountry(merchantCountry) {
+		panic("Merchant country must be an ISO 3166-1 alpha-2 country code")
+	}
+
 	mUrl, err := url.Parse(merchantUrl)
 	if err != nil {
 		panic("failed to parse Merchant URL")
 	}
 
+	tlsOpts := tlsOptions{
+		certFile:     tlsCertFile,
+		keyFile:      tlsKeyFile,
+		acmeDomains:  splitList(acmeDomains),
+		acmeCacheDir: acmeCacheDir,
+		acmeEmail:    acmeEmail,
+	}
+
+	// notification URLs, cookies and HSTS all derive from the merchant URL, so its scheme
+	// must match how the server is actually served
+	if tlsOpts.enabled() && mUrl.Scheme != "https" {
+		logger.Warn("Serving TLS, using https for the merchant URL", "merchantUrl", merchantUrl)
+		mUrl.Scheme = "https"
+		merchantUrl = mUrl.String()
+	}
+
+	sessionDataSigner, err := handler.NewSessionDataSigner([]byte(sessionDataKey), sessionDataTTL)
+	if err != nil {
+		panic(err)
+	}
+
+	var auditLog *audit.Log
+	if auditLogPath != "" {
+		auditLog, err = audit.Open(auditLogPath, []byte(auditKey))
+		if err != nil {
+			panic(err)
+		}
+		defer auditLog.Close()
+	}
+
+	var circuitBreaker *handler.CircuitBreaker
+	if circuitBreakerThreshold > 0 {
+		circuitBreaker = handler.NewCircuitBreaker(circuitBreakerThreshold, circuitBreakerCooldown)
+	}
+
+	fallbackPolicy := handler.DefaultFallbackPolicy()
+	if fallbackPolicyPath != "" {
+		fallbackPolicy, err = handler.LoadFallbackPolicy(fallbackPolicyPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var cardVault *vault.Vault
+	if cardVaultFile != "" {
+		cardVault, err = vault.Open(cardVaultFile, []byte(cardVaultKey), cardTokenTTL)
+	} else {
+		cardVault, err = vault.New([]byte(cardVaultKey), cardTokenTTL)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var customers *customer.Store
+	if customerStoreFile != "" {
+		customers, err = customer.Open(customerStoreFile, []byte(customerCookieKey))
+	} else {
+		customers, err = customer.NewStore([]byte(customerCookieKey))
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	abuseProtection := handler.NewAbuseProtection(abuseLimits, cardVault.Fingerprint)
+
+	proxies, err := handler.ParseTrustedProxies(splitList(trustedProxies))
+	if err != nil {
+		panic(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m := metrics.New(registry)
+
+	store := handler.NewThreeDSTransactionStore()
+	if storeFile != "" {
+		store, err = handler.NewPersistentThreeDSTransactionStore(storeFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	store.SetTTL(transactionTTL)
+
+	ravelinApiKeys, err := handler.NewApiKeys(handler.ApiKey{Primary: ravelinApiKey, Secondary: ravelinApiKeySecondary}, ravelinApiKeyFile, ravelinApiKeySecondaryFile)
+	if err != nil {
+		panic(err)
+	}
+	if ravelinApiKeys.Get().Primary == "" {
+		// the server is not ready until a key is configured, see /readyz
+		logger.Warn("Ravelin API Key not set")
+	}
+
 	h := handler.Handler{
-		RavelinApiUrl:           ravelinApiUrl,
-		RavelinApiKey:           ravelinApiKey,
-		MerchantUrl:             merchantUrl,
-		ThreeDSTransactionStore: handler.NewThreeDSTransactionStore(),
+		RavelinApiUrl:        ravelinApiUrl,
+		RavelinApiKeys:       ravelinApiKeys,
+		MerchantUrl:          merchantUrl,
+		MerchantCountry:      merchantCountry,
+		ResultsToken:         resultsToken,
+		OperatorToken:        operatorToken,
+		StrictBase64Decoding: strictBase64,
+		SessionDataSigner:    sessionDataSigner,
+		Metrics:              m,
+		AuditLog:             auditLog,
+		RavelinTimeouts: map[string]time.Duration{
+			domain.RavelinThreeDSVersionEndpoint:      ravelinTimeout,
+			domain.RavelinThreeDSAuthenticateEndpoint: ravelinAuthenticateTimeout,
+			domain.RavelinThreeDSResultEndpoint:       ravelinTimeout,
+			domain.RavelinThreeDSTestCardsEndpoint:    ravelinTimeout,
+		},
+		RavelinMaxRetries: ravelinMaxRetries,
+		CircuitBreaker:    circuitBreaker,
+		FallbackPolicy:    fallbackPolicy,
+		APIKeyCheck:       handler.NewAPIKeyCheck(apiKeyCheckTTL),
+		AbuseProtection:   abuseProtection,
+		MaxRequestBytes:   maxRequestBytes,
+		TrustedProxies:    proxies,
+		CardVault:         cardVault,
+		Customers:         customers,
+		Version:           buildVersion(),
+		Config: redactedConfig(map[string]string{
+			"ravelin-api-key":           ravelinApiKey,
+			"ravelin-api-key-secondary": ravelinApiKeySecondary,
+			"results-token":             resultsToken,
+			"operator-token":            operatorToken,
+			"session-data-key":          sessionDataKey,
+			"card-vault-key":            cardVaultKey,
+			"customer-cookie-key":       customerCookieKey,
+			"audit-key":                 auditKey,
+		}),
+		ThreeDSTransactionStore: store,
 	}
 
 	h.MethodNotificationResponseTemplate, err = loadTemplate(embeddedFS, "templates/method-notification-response.html")
@@ -71,19 +381,48 @@ func main() {
 		panic(err)
 	}
 
+	h.IndexTemplate, err = loadTemplate(embeddedFS, "templates/index.html")
+	if err != nil {
+		panic(err)
+	}
+
+	// a challenge is abandoned once its threeDSSessionData has expired without a result being received
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "threeds_demo",
+		Name:      "challenges_abandoned",
+		Help:      "Transactions where a challenge was required but no result was received before threeDSSessionData expired.",
+	}, func() float64 {
+		return float64(h.ThreeDSTransactionStore.CountAbandonedChallenges(sessionDataTTL))
+	}))
+
 	staticFS, err := fs.Sub(embeddedFS, "static")
 	if err != nil {
 		panic(err)
 	}
 	frontEnd := http.FileServer(http.FS(staticFS))
 
+	// the merchant's own front-end is always allowed
+	origins := append([]string{mUrl.Scheme + "://" + mUrl.Host}, splitList(allowedOrigins)...)
+
+	// the ACS and 3DS Method of Ravelin's test cards are hosted with the API
+	rUrl, err := url.Parse(ravelinApiUrl)
+	if err != nil {
+		panic("failed to parse Ravelin API URL")
+	}
+	csp := append([]string{rUrl.Scheme + "://" + rUrl.Host}, splitList(frameOrigins)...)
+
 	mux := http.NewServeMux()
-	mux.Handle("/", frontEnd)
-	mux.HandleFunc(handler.CheckoutEndpoint, h.Checkout)
-	mux.HandleFunc(handler.AuthenticateEndpoint, h.Authenticate)
-	mux.HandleFunc(handler.MethodNotificationEndpoint, h.MethodNotification)
-	mux.HandleFunc(handler.ChallengeNotificationEndpoint, h.ChallengeNotification)
-	mux.HandleFunc(handler.TestCardsEndpoint, h.TestCards)
+	mux.HandleFunc("/", h.FrontEnd(frontEnd))
+	mux.HandleFunc(handler.CheckoutEndpoint, instrument(m, handler.CheckoutEndpoint, handler.CORS(origins, h.Checkout)))
+	mux.HandleFunc(handler.AuthenticateEndpoint, instrument(m, handler.AuthenticateEndpoint, handler.CORS(origins, h.Authenticate)))
+	mux.HandleFunc(handler.MethodNotificationEndpoint, instrument(m, handler.MethodNotificationEndpoint, h.MethodNotification))
+	mux.HandleFunc(handler.ChallengeNotificationEndpoint, instrument(m, handler.ChallengeNotificationEndpoint, h.ChallengeNotification))
+	mux.HandleFunc(handler.TestCardsEndpoint, instrument(m, handler.TestCardsEndpoint, handler.CORS(origins, h.TestCards)))
+	mux.HandleFunc(handler.ResultsEndpoint, instrument(m, handler.ResultsEndpoint, handler.CORS(origins, h.Results)))
+	mux.HandleFunc(handler.OperatorTransactionsEndpoint, tracing.Middleware(handler.OperatorTransactionsEndpoint, handler.CORS(origins, h.OperatorTransactions)))
+	mux.Handle(handler.MetricsEndpoint, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(handler.HealthzEndpoint, h.Healthz)
+	mux.HandleFunc(handler.ReadyzEndpoint, h.Readyz)
 
 	port := mUrl.Port()
 	if port == "" {
@@ -91,14 +430,157 @@ func main() {
 	}
 
 	server := http.Server{
-		Handler: mux,
-		Addr:    ":" + port,
+		Handler:      handler.RequestLogging(logger, handler.SecurityHeaders(csp, mUrl.Scheme == "https", mux)),
+		Addr:         ":" + port,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
 	}
 
-	log.Printf("Using Ravelin API URL %s", ravelinApiUrl)
-	log.Printf("Starting server on port %q using merchant URL %s", server.Addr, merchantUrl)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go ravelinApiKeys.Watch(ctx, apiKeyReloadInterval, func() {
+		logger.Info("Reloaded Ravelin API Key")
+		// the cached key check no longer applies to the new key
+		h.APIKeyCheck.Reset()
+	}, func(err error) {
+		logger.Error("failed to reload Ravelin API Key", "error", err)
+	})
+
+	var redirectServer *http.Server
+	if tlsOpts.enabled() {
+		var redirect http.Handler
+		server.TLSConfig, redirect, err = tlsOpts.tlsConfig(ctx, logger, tlscert.RedirectHTTPS(mUrl.Host))
+		if err != nil {
+			panic(err)
+		}
+
+		if httpRedirectAddr == "" && len(tlsOpts.acmeDomains) > 0 {
+			httpRedirectAddr = ":80"
+		}
+		if httpRedirectAddr != "" {
+			redirectServer = &http.Server{
+				Handler:      redirect,
+				Addr:         httpRedirectAddr,
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
+			}
+		}
+	}
+
+	logger.Info("Using Ravelin API URL", "ravelinApiUrl", ravelinApiUrl)
+	logger.Info("Starting server", "addr", server.Addr, "merchantUrl", merchantUrl, "tls", server.TLSConfig != nil)
+
+	serverErr := make(chan error, 2)
+	go func() {
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	if redirectServer != nil {
+		logger.Info("Starting https redirect server", "addr", redirectServer.Addr)
+		go func() {
+			serverErr <- redirectServer.ListenAndServe()
+		}()
+	}
 
-	panic(server.ListenAndServe())
+	select {
+	case err = <-serverErr:
+	case <-ctx.Done():
+		logger.Info("Shutting down server", "shutdownTimeout", shutdownTimeout)
+		err = shutdown(&server, shutdownTimeout)
+	}
+
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+
+	// the stores and vault are flushed once no more requests can modify them
+	if flushErr := h.ThreeDSTransactionStore.Flush(); flushErr != nil {
+		logger.Error("failed to flush transaction store", "error", flushErr)
+	}
+	if flushErr := cardVault.Flush(); flushErr != nil {
+		logger.Error("failed to flush card vault", "error", flushErr)
+	}
+	if flushErr := customers.Flush(); flushErr != nil {
+		logger.Error("failed to flush customer store", "error", flushErr)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	logger.Info("Server stopped")
+}
+
+// shutdown stops the server accepting new requests and waits up to timeout for in flight requests,
+// such as authentications waiting on Ravelin's 3DS API, to complete.
+func shutdown(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		// requests still in flight are abandoned
+		server.Close()
+		return fmt.Errorf("failed to shut down gracefully: %w", err)
+	}
+	return nil
+}
+
+// instrument records metrics and traces for an endpoint.
+func instrument(m *metrics.Metrics, endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return m.InstrumentHandler(endpoint, tracing.Middleware(endpoint, h))
+}
+
+// splitList splits a comma separated flag value, ignoring empty values.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// buildVersion returns the version set at build time, or the VCS revision the binary was built from.
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return version
+}
+
+// redactedConfig returns the value of every flag, for reporting by the readiness endpoint.
+// The values of secrets, which may have been set from the environment, are redacted.
+func redactedConfig(secrets map[string]string) map[string]string {
+	config := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+
+	for name, value := range secrets {
+		config[name] = ""
+		if value != "" {
+			config[name] = "[REDACTED]"
+		}
+	}
+	return config
 }
 
 func loadTemplate(fs fs.ReadFileFS, filename string) (*template.Template, error) {
@@ -0,0 +1,151 @@
+// Package metrics defines the Prometheus metrics exposed on /metrics, covering the 3DS funnel,
+// the latency of calls to Ravelin's 3DS API and the outcome of each authentication.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/statuswriter"
+)
+
+const namespace = "threeds_demo"
+
+// Authentication outcomes.
+const (
+	OutcomeFrictionless = "frictionless"
+	OutcomeChallenge    = "challenge"
+	OutcomeFailed       = "failed"
+	OutcomeError        = "error"
+	OutcomeSuccess      = "success"
+)
+
+// Method outcomes.
+const (
+	MethodCompleted   = "completed"
+	MethodTimedOut    = "timeout"
+	MethodUnavailable = "unavailable"
+)
+
+// Metrics holds the metrics recorded by the handlers. All methods are safe to call on a nil *Metrics,
+// in which case nothing is recorded.
+type Metrics struct {
+	httpRequests          *prometheus.CounterVec
+	ravelinRequestLatency *prometheus.HistogramVec
+	authentications       *prometheus.CounterVec
+	challengeResults      *prometheus.CounterVec
+	methods               *prometheus.CounterVec
+	fallbacks             *prometheus.CounterVec
+	abuse                 *prometheus.CounterVec
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled by the merchant back-end, by endpoint and response status code.",
+		}, []string{"endpoint", "status"}),
+		ravelinRequestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "ravelin_request_duration_seconds",
+			Help:      "Latency of requests to Ravelin's 3DS API, by endpoint and response status code.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"endpoint", "status"}),
+		authentications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "authentications_total",
+			Help:      "Authenticate outcomes (frictionless, challenge, failed or error), by message version and card scheme.",
+		}, []string{"outcome", "message_version", "card_scheme"}),
+		challengeResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "challenge_results_total",
+			Help:      "Challenge outcomes (success or failed), by how the result was received, message version and card scheme.",
+		}, []string{"outcome", "source", "message_version", "card_scheme"}),
+		methods: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "methods_total",
+			Help:      "3DS Method outcomes (completed, timeout or unavailable) at the time of authentication.",
+		}, []string{"outcome"}),
+		fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fallbacks_total",
+			Help:      "Fallback decisions for checkouts which could not be authenticated with 3DS, by decision and error type.",
+		}, []string{"decision", "error_type"}),
+		abuse: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "abuse_actions_total",
+			Help:      "Requests blocked or made to challenge by the rate limits and velocity rules, by endpoint, rule and action.",
+		}, []string{"endpoint", "rule", "action"}),
+	}
+
+	reg.MustRegister(m.httpRequests, m.ravelinRequestLatency, m.authentications, m.challengeResults, m.methods, m.fallbacks, m.abuse)
+
+	return m
+}
+
+// InstrumentHandler counts the requests handled by next under the given endpoint label.
+func (m *Metrics) InstrumentHandler(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := statuswriter.Wrap(w)
+		next(sw, r)
+		m.httpRequests.WithLabelValues(endpoint, strconv.Itoa(sw.Status())).Inc()
+	}
+}
+
+// ObserveRavelinRequest records the latency of a request to Ravelin's 3DS API.
+// A status of zero indicates that no response was received.
+func (m *Metrics) ObserveRavelinRequest(endpoint string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ravelinRequestLatency.WithLabelValues(endpoint, strconv.Itoa(status)).Observe(duration.Seconds())
+}
+
+// RecordAuthentication counts the outcome of an authenticate request.
+func (m *Metrics) RecordAuthentication(outcome, messageVersion, cardScheme string) {
+	if m == nil {
+		return
+	}
+	m.authentications.WithLabelValues(outcome, messageVersion, cardScheme).Inc()
+}
+
+// RecordChallengeResult counts the outcome of a challenge.
+func (m *Metrics) RecordChallengeResult(outcome, source, messageVersion, cardScheme string) {
+	if m == nil {
+		return
+	}
+	m.challengeResults.WithLabelValues(outcome, source, messageVersion, cardScheme).Inc()
+}
+
+// RecordMethod counts the outcome of the 3DS Method.
+func (m *Metrics) RecordMethod(outcome string) {
+	if m == nil {
+		return
+	}
+	m.methods.WithLabelValues(outcome).Inc()
+}
+
+// RecordFallback counts a fallback decision made when 3DS could not be started.
+func (m *Metrics) RecordFallback(decision, errorType string) {
+	if m == nil {
+		return
+	}
+	m.fallbacks.WithLabelValues(decision, errorType).Inc()
+}
+
+// RecordAbuse counts a request which was blocked, or made to challenge, by a rate limit or velocity rule.
+func (m *Metrics) RecordAbuse(endpoint, rule, action string) {
+	if m == nil {
+		return
+	}
+	m.abuse.WithLabelValues(endpoint, rule, action).Inc()
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New(prometheus.NewRegistry())
+
+	handler := m.InstrumentHandler("/checkout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/checkout", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/checkout", nil))
+
+	m.RecordAuthentication(OutcomeChallenge, "2.2.0", "visa")
+	m.RecordChallengeResult(OutcomeSuccess, "results-request", "2.2.0", "visa")
+	m.RecordMethod(MethodTimedOut)
+	m.ObserveRavelinRequest("/3ds/version", http.StatusOK, 120*time.Millisecond)
+
+	if got := testutil.ToFloat64(m.httpRequests.WithLabelValues("/checkout", "404")); got != 2 {
+		t.Errorf("expected 2 requests, actual: %v", got)
+	}
+	if got := testutil.ToFloat64(m.authentications.WithLabelValues(OutcomeChallenge, "2.2.0", "visa")); got != 1 {
+		t.Errorf("expected 1 challenge, actual: %v", got)
+	}
+	if got := testutil.ToFloat64(m.challengeResults.WithLabelValues(OutcomeSuccess, "results-request", "2.2.0", "visa")); got != 1 {
+		t.Errorf("expected 1 challenge result, actual: %v", got)
+	}
+	if got := testutil.ToFloat64(m.methods.WithLabelValues(MethodTimedOut)); got != 1 {
+		t.Errorf("expected 1 method timeout, actual: %v", got)
+	}
+	if got := testutil.CollectAndCount(m.ravelinRequestLatency); got != 1 {
+		t.Errorf("expected 1 latency series, actual: %v", got)
+	}
+}
+
+func TestMetrics_nil(t *testing.T) {
+	var m *Metrics
+
+	called := false
+	m.InstrumentHandler("/checkout", func(w http.ResponseWriter, r *http.Request) { called = true })(
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/checkout", nil))
+	if !called {
+		t.Fatal("expected handler to be called")
+	}
+
+	m.RecordAuthentication(OutcomeFailed, "2.1.0", "mastercard")
+	m.RecordChallengeResult(OutcomeFailed, "challenge-notification", "2.1.0", "mastercard")
+	m.RecordMethod(MethodCompleted)
+	m.ObserveRavelinRequest("/3ds/result", 0, time.Second)
+}
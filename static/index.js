@@ -1,6 +1,10 @@
 // This file is an example of the Javascript a merchant or PSP would need to add to
 // their front-end in order to perform 3D Secure Authentication with Ravelin.
 
+// cardToken is returned by /checkout and refers to the card in place of the card number,
+// so the card number is only ever sent to the merchant backend once.
+let cardToken = null;
+
 // Checkout calls the /checkout endpoint on the merchant backend initiating the checkout process.
 function Checkout() {
     $('#payment').hide()
@@ -21,12 +25,21 @@ function Checkout() {
         function (response) {
             if (response.status !== 200) {
                 console.log('Looks like there was a problem. Status Code: ' + response.status);
+                handleErrorResponse(response);
                 return;
             }
 
             console.log('/checkout response received')
 
             response.json().then(function (data) {
+                // 3DS could not be started, so the merchant backend's fallback policy decides what happens
+                if (data.fallback) {
+                    handleFallback(data.fallback)
+                    return
+                }
+
+                cardToken = data.cardToken
+
                 if (data.threeDSMethodURL) {
                     console.log('threeDSMethodURL found, sending Method Request')
                     SendMethodRequest(data.threeDSMethodURL + '?success=true', data.threeDSServerTransID, window.location.origin + '/method-notification')
@@ -35,7 +48,7 @@ function Checkout() {
                             methodTimedOut: true,
                             threeDSServerTransID: data.threeDSServerTransID
                         };
-                        window.postMessage(msg, "*");
+                        window.postMessage(msg, window.location.origin);
                     }, 10000 )
                 } else {
                     console.log('threeDSMethodURL not found, sending Authenticate Request')
@@ -54,13 +67,14 @@ function Authenticate(threeDSServerTransID) {
     const requestBody = {
         productSKU: '10001',
         productQuantity: 1,
-        accountNumber: document.getElementById('cardSelector').value,
+        cardToken: cardToken,
         cardExpiryDate: '2205',
         threeDSServerTransID: threeDSServerTransID,
         browserData: GetBrowserData(),
+        cardholder: getCardholder(),
     };
 
-    console.log('Sending example merchant backend /authenticate request using card ending in ' + requestBody.accountNumber.substr(-4))
+    console.log('Sending example merchant backend /authenticate request using card token')
 
     fetch(window.location.origin + '/authenticate', {
         method: 'post',
@@ -71,14 +85,21 @@ function Authenticate(threeDSServerTransID) {
         function (response) {
             if (response.status !== 200) {
                 console.log('Looks like there was a problem. Status Code: ' + response.status);
+                handleErrorResponse(response);
                 return;
             }
 
             console.log('/authenticate response received')
 
             response.json().then(function (data) {
+                // cardholderInfo is text from the issuer which must be shown to the cardholder
+                if (data.cardholderInfo) {
+                    $('#cardholderInfo').text(data.cardholderInfo).show()
+                }
+
                 if (data.error) {
                     console.log(data.error);
+                    updatePage('FAILED', data.errorCode)
                     return
                 }
 
@@ -95,7 +116,7 @@ function Authenticate(threeDSServerTransID) {
                         acsTransID: data.acsTransID,
                         challengeWindowSize: '03'
                     }
-                    SendChallengeRequest(data.acsURL, challengeRequest, {})
+                    SendChallengeRequest(data.acsURL, challengeRequest, data.threeDSSessionData)
                 } else {
                     updatePage(data.status)
                 }
@@ -129,25 +150,84 @@ window.addEventListener('message', (e) => {
         if (event.hasOwnProperty('challengeCompleted')) {
             console.log('Challenge Request completed');
             document.getElementById('challengeIframe').remove()
-            updatePage(event.status)
+            updatePage(event.status, event.errorCode)
         }
     }
 });
 
-function updatePage(status) {
+// getCardholder reads the cardholder's details from the checkout form. The issuer uses them to
+// decide whether a challenge is needed, so the more that are sent the better.
+function getCardholder() {
+    const billingAddress = getAddress('#billingAddress');
+    const cardholder = {
+        name: $('#cardholderName').val(),
+        email: $('#email').val(),
+        billingAddress: billingAddress,
+        shippingAddress: $('#shipToBilling').is(':checked') ? billingAddress : getAddress('#shippingAddress'),
+    };
+    if ($('#phoneNumber').val()) {
+        cardholder.mobilePhone = {
+            countryCode: $('#phoneCountryCode').val(),
+            number: $('#phoneNumber').val(),
+        };
+    }
+    return cardholder;
+}
+
+function getAddress(container) {
+    const address = {
+        line1: $(container + ' .address-line1').val(),
+        city: $(container + ' .address-city').val(),
+        postCode: $(container + ' .address-post-code').val(),
+        country: $(container + ' .address-country').val(),
+    };
+    // an empty address is left out rather than rejected
+    return address.line1 || address.city ? address : undefined;
+}
+
+function updatePage(status, errorCode) {
     $('#paymentProcessing').hide()
     if (status === 'SUCCESS') {
         $('#paymentSuccess').show()
     } else if (status === 'FAILED') {
+        $('#paymentErrorCode').text(errorCode ? 'Error code: ' + errorCode : '')
         $('#paymentFailed').show()
     }
 }
 
+// handleFallback displays the fallback decision made when the payment could not be authenticated with 3DS.
+function handleFallback(fallback) {
+    console.log('3DS unavailable (' + fallback.errorType + '), fallback decision: ' + fallback.decision)
+    if (fallback.decision === 'PROCEED_WITHOUT_3DS') {
+        // no liability shift applies, the payment is sent for authorisation without authentication
+        $('#paymentNote').text('Authorised without 3D Secure').show()
+        updatePage('SUCCESS')
+    } else if (fallback.decision === 'RETRY_LATER') {
+        updatePage('FAILED', fallback.errorCode + ' - please try again later')
+    } else {
+        updatePage('FAILED', fallback.errorCode)
+    }
+}
+
+// handleErrorResponse displays the error code returned by the merchant backend, if any.
+function handleErrorResponse(response) {
+    response.json().then(function (data) {
+        console.log('Error: ' + data.error + ' (' + data.errorCode + ')', data.retryable ? 'retryable' : '');
+        updatePage('FAILED', data.errorCode)
+    }).catch(function () {
+        updatePage('FAILED')
+    });
+}
+
 function resetPage() {
+    cardToken = null
     $('#payment').show()
     $('#paymentProcessing').hide()
     $('#paymentSuccess').hide()
     $('#paymentFailed').hide()
+    $('#paymentErrorCode').text('')
+    $('#paymentNote').text('').hide()
+    $('#cardholderInfo').text('').hide()
 }
 
 function getTestCards() {
@@ -178,4 +258,15 @@ function getTestCards() {
         });
 }
 
-getTestCards()
\ No newline at end of file
+// Event handlers are bound here rather than with inline attributes, which the Content Security Policy blocks.
+document.addEventListener('DOMContentLoaded', function () {
+    document.getElementById('checkoutButton').addEventListener('click', Checkout);
+    document.getElementById('shipToBilling').addEventListener('change', function () {
+        $('#shippingAddress').toggle(!this.checked);
+    });
+    document.querySelectorAll('.reset-button').forEach(function (button) {
+        button.addEventListener('click', resetPage);
+    });
+});
+
+getTestCards()
@@ -8,7 +8,8 @@ function GetBrowserData() {
         }
         if (window.navigator) {
             browserData.browserUserAgent = window.navigator.userAgent;
-            browserData.browserJavaEnabled = window.navigator.javaEnabled();
+            // javaEnabled has been removed from some browsers
+            browserData.browserJavaEnabled = typeof window.navigator.javaEnabled === 'function' && window.navigator.javaEnabled();
             browserData.browserLanguage = window.navigator.language || window.navigator.browserLanguage || window.navigator.userLanguage;
         }
     }
@@ -47,7 +48,8 @@ function SendChallengeRequest(acsURL, creq, sessionData) {
     const windowSize = getWindowSize(creq.challengeWindowSize)
 
     const creqBase64 = encode(JSON.stringify(creq));
-    const sessionDataBase64 = encode(JSON.stringify(sessionData))
+    // threeDSSessionData issued by the merchant backend is already base64url encoded
+    const sessionDataBase64 = typeof sessionData === 'string' ? sessionData : encode(JSON.stringify(sessionData))
     const challengeIframeName = 'challengeIframe'
 
     const html = document.createElement('html');
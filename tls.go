@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/unravelin/ravelin-3ds-demo/logging"
+	"github.com/unravelin/ravelin-3ds-demo/tlscert"
+)
+
+const tlsReloadInterval = 30 * time.Second
+
+// tlsOptions configures how the server is served over TLS, either from a certificate and key file
+// or with certificates obtained automatically with ACME.
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	acmeDomains  []string
+	acmeCacheDir string
+	acmeEmail    string
+}
+
+func (o tlsOptions) enabled() bool {
+	return o.certFile != "" || o.keyFile != "" || len(o.acmeDomains) > 0
+}
+
+// tlsConfig returns the server's TLS config. Certificates loaded from files are reloaded when the
+// files change until ctx is done. With ACME, the returned handler must be served over http
+// on port 80 to answer http-01 challenges, and redirects all other requests to redirect.
+func (o tlsOptions) tlsConfig(ctx context.Context, logger *logging.Logger, redirect http.Handler) (*tls.Config, http.Handler, error) {
+	if len(o.acmeDomains) > 0 {
+		if o.certFile != "" || o.keyFile != "" {
+			return nil, nil, fmt.Errorf("tls certificate files and acme cannot be used together")
+		}
+
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.acmeDomains...),
+			Cache:      autocert.DirCache(o.acmeCacheDir),
+			Email:      o.acmeEmail,
+		}
+		config := m.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, m.HTTPHandler(redirect), nil
+	}
+
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, nil, fmt.Errorf("both a tls certificate and key are required")
+	}
+
+	reloader, err := tlscert.NewReloader(o.certFile, o.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go reloader.Watch(ctx, tlsReloadInterval, func() {
+		logger.Info("Reloaded tls certificate", "certFile", o.certFile)
+	}, func(err error) {
+		logger.Error("failed to reload tls certificate", "error", err)
+	})
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, redirect, nil
+}
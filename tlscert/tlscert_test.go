@@ -0,0 +1,115 @@
+package tlscert
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerateSelfSigned(t *testing.T) {
+	certPEM, keyPEM, err := GenerateSelfSigned([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, certPEM, keyPEM)
+
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := reloader.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("expected certificate to be valid for localhost: %v", err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("expected certificate to be valid for 127.0.0.1: %v", err)
+	}
+	if validFor := leaf.NotAfter.Sub(leaf.NotBefore); validFor != time.Hour {
+		t.Errorf("expected: %v, actual: %v", time.Hour, validFor)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM, err := GenerateSelfSigned([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t, dir, certPEM, keyPEM)
+
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := reloader.GetCertificate(nil)
+
+	reloaded, err := reloader.Reload()
+	if err != nil || reloaded {
+		t.Fatalf("expected unchanged files not to be reloaded, actual: %v %v", reloaded, err)
+	}
+
+	// a partially replaced key pair fails to load, and the current certificate is kept
+	renewedCert, renewedKey, err := GenerateSelfSigned([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// renewed files may keep the modification time of the files they replace
+	modTime := time.Now().Add(-time.Hour)
+	writeFile(t, certFile, renewedCert, modTime)
+	if _, err := reloader.Reload(); err == nil {
+		t.Fatal("expected mismatched key pair to fail to load")
+	}
+	if current, _ := reloader.GetCertificate(nil); current != original {
+		t.Fatal("expected current certificate to be kept")
+	}
+
+	writeFile(t, keyFile, renewedKey, modTime)
+	reloaded, err = reloader.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("expected renewed certificate to be reloaded, actual: %v %v", reloaded, err)
+	}
+	if current, _ := reloader.GetCertificate(nil); current == original {
+		t.Error("expected renewed certificate to be served")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	w := httptest.NewRecorder()
+	RedirectHTTPS("shop.example:8443").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://shop.example/checkout?a=1", nil))
+
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("expected: %d, actual: %d", http.StatusMovedPermanently, w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://shop.example:8443/checkout?a=1" {
+		t.Errorf("expected: %s, actual: %s", "https://shop.example:8443/checkout?a=1", location)
+	}
+}
+
+func writeKeyPair(t *testing.T, dir string, certPEM, keyPEM []byte) (string, string) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
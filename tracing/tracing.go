@@ -0,0 +1,135 @@
+// Package tracing configures OpenTelemetry tracing, and provides helpers to trace HTTP handlers
+// and to carry a trace context between the separate requests which make up a 3DS journey.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/statuswriter"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+
+	instrumentationName = "github.com/unravelin/ravelin-3ds-demo"
+	serviceName         = "ravelin-3ds-demo"
+)
+
+// Setup installs a global tracer provider which sends spans to the named exporter.
+// The OTLP exporter is configured using the standard OTEL_EXPORTER_OTLP_* environment variables.
+// The returned function flushes any buffered spans and must be called before exiting.
+func Setup(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch exporterName {
+	case ExporterNone, "":
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %v", exporterName, err)
+	}
+
+	provider := NewProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// NewProvider creates a tracer provider for this service with the given options,
+// for example a span processor wrapping an exporter.
+func NewProvider(opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Tracer returns the tracer used throughout this service.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware starts a server span named after the endpoint around each request.
+func Middleware(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, endpoint,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(endpoint),
+			))
+		defer span.End()
+
+		sw := statuswriter.Wrap(w)
+		next(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(sw.Status()))
+		if sw.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status()))
+		}
+	}
+}
+
+// Inject returns the trace context of ctx in a form which can be stored and later passed to JoinTrace.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// InjectHTTP adds the trace context of ctx to the headers of an outbound request.
+func InjectHTTP(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// JoinTrace starts a span which continues the trace stored by Inject, so that requests which
+// belong to the same 3DS transaction appear in a single trace. The span is linked to the span
+// already in ctx, if any. If stored is empty the span is a child of the span in ctx.
+func JoinTrace(ctx context.Context, stored map[string]string, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(stored))
+	if !trace.SpanContextFromContext(parent).IsValid() {
+		return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+	}
+
+	opts := []trace.SpanStartOption{trace.WithAttributes(attrs...)}
+	if current := trace.SpanContextFromContext(ctx); current.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: current}))
+	}
+
+	// keep the values in ctx, such as the request logger, but replace the parent span
+	ctx = trace.ContextWithRemoteSpanContext(ctx, trace.SpanContextFromContext(parent))
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// RecordError records err on the span in ctx and marks the span as failed.
+func RecordError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
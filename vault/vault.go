@@ -0,0 +1,230 @@
+// Package vault holds card numbers (PANs) encrypted with AES-256-GCM, and issues tokens which
+// refer to them. The front-end sends a PAN once, and afterwards only sends the token, so the
+// PAN cannot be switched part way through a transaction and is never held in plain text.
+//
+// Each token is bound to the threeDSServerTransID it was issued for. The token and transaction
+// are authenticated as additional data of the ciphertext, so an encrypted PAN cannot be moved
+// to another token or transaction, even by someone able to edit the vault file.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/atomicfile"
+	"github.com/unravelin/ravelin-3ds-demo/internal/keyderiv"
+)
+
+const (
+	tokenPrefix = "ctok_"
+	defaultTTL  = 30 * time.Minute
+)
+
+var (
+	ErrTokenNotFound = errors.New("card token not found")
+	ErrTokenExpired  = errors.New("card token has expired")
+	ErrTokenMismatch = errors.New("card token was not issued for the transaction")
+)
+
+// entry is an encrypted PAN. Ciphertext is the GCM nonce followed by the sealed PAN.
+type entry struct {
+	ThreeDSServerTransID string    `json:"threeDSServerTransID"`
+	Ciphertext           []byte    `json:"ciphertext"`
+	ExpiresAt            time.Time `json:"expiresAt"`
+}
+
+// Vault exchanges PANs for tokens.
+type Vault struct {
+	aead           cipher.AEAD
+	fingerprintKey []byte
+	ttl            time.Duration
+	now            func() time.Time
+	// path is the file the vault is persisted to by Flush. The vault is only held in memory if empty.
+	path string
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// New creates a vault which encrypts PANs with a key derived from key, which must be at least
+// keyderiv.MinKeyLength random bytes. If key is empty a random key is generated, in which case
+// tokens will not survive a restart. Tokens expire after ttl.
+func New(key []byte, ttl time.Duration) (*Vault, error) {
+	if len(key) == 0 {
+		key = make([]byte, keyderiv.MinKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate card vault key: %v", err)
+		}
+	}
+
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	// separate keys are derived for encryption and fingerprints
+	aesKey, err := keyderiv.Derive(key, "ravelin-3ds-demo card vault encryption")
+	if err != nil {
+		return nil, fmt.Errorf("invalid card vault key: %w", err)
+	}
+	fingerprintKey, err := keyderiv.Derive(key, "ravelin-3ds-demo card vault fingerprint")
+	if err != nil {
+		return nil, fmt.Errorf("invalid card vault key: %w", err)
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create card vault cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create card vault cipher: %v", err)
+	}
+
+	return &Vault{
+		aead:           aead,
+		fingerprintKey: fingerprintKey,
+		ttl:            ttl,
+		now:            time.Now,
+		entries:        make(map[string]entry),
+	}, nil
+}
+
+// Open creates a vault which is persisted to the file at path, loading any encrypted PANs
+// flushed to it previously. The same key must be used to detokenise them, so key is required.
+func Open(path string, key []byte, ttl time.Duration) (*Vault, error) {
+	if len(key) == 0 {
+		return nil, errors.New("card vault key is required to persist the card vault")
+	}
+
+	v, err := New(key, ttl)
+	if err != nil {
+		return nil, err
+	}
+	v.path = path
+
+	bb, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card vault: %v", err)
+	}
+
+	err = json.Unmarshal(bb, &v.entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode card vault: %v", err)
+	}
+
+	return v, nil
+}
+
+// Tokenise encrypts the PAN and returns a token which refers to it, bound to the transaction.
+func (v *Vault) Tokenise(pan string, threeDSServerTransID string) (string, error) {
+	tokenBytes := make([]byte, 18)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("failed to generate card token: %v", err)
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate card vault nonce: %v", err)
+	}
+	ciphertext := v.aead.Seal(nonce, nonce, []byte(pan), additionalData(token, threeDSServerTransID))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	v.prune(now)
+	v.entries[token] = entry{
+		ThreeDSServerTransID: threeDSServerTransID,
+		Ciphertext:           ciphertext,
+		ExpiresAt:            now.Add(v.ttl),
+	}
+
+	return token, nil
+}
+
+// Detokenise returns the PAN the token refers to. The token must have been issued for the transaction.
+func (v *Vault) Detokenise(token string, threeDSServerTransID string) (string, error) {
+	v.mu.Lock()
+	e, ok := v.entries[token]
+	now := v.now()
+	v.mu.Unlock()
+
+	if !ok {
+		return "", ErrTokenNotFound
+	}
+	if !now.Before(e.ExpiresAt) {
+		return "", ErrTokenExpired
+	}
+	if e.ThreeDSServerTransID != threeDSServerTransID {
+		return "", ErrTokenMismatch
+	}
+
+	nonceSize := v.aead.NonceSize()
+	if len(e.Ciphertext) < nonceSize {
+		return "", fmt.Errorf("failed to decrypt card: ciphertext too short")
+	}
+	pan, err := v.aead.Open(nil, e.Ciphertext[:nonceSize], e.Ciphertext[nonceSize:], additionalData(token, threeDSServerTransID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt card: %v", err)
+	}
+
+	return string(pan), nil
+}
+
+// Fingerprint returns a keyed hash of the PAN, which identifies the card without revealing its PAN.
+// Fingerprints are stable for as long as the vault key is unchanged.
+func (v *Vault) Fingerprint(pan string) string {
+	mac := hmac.New(sha256.New, v.fingerprintKey)
+	mac.Write([]byte(pan))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Flush atomically replaces the vault's file with every unexpired encrypted PAN. Flush does
+// nothing for an in memory vault.
+func (v *Vault) Flush() error {
+	if v.path == "" {
+		return nil
+	}
+
+	v.mu.Lock()
+	v.prune(v.now())
+	bb, err := json.Marshal(v.entries)
+	v.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode card vault: %v", err)
+	}
+
+	err = atomicfile.WriteFile(v.path, bb)
+	if err != nil {
+		return fmt.Errorf("failed to write card vault: %v", err)
+	}
+
+	return nil
+}
+
+// prune removes expired entries. The caller must hold v.mu.
+func (v *Vault) prune(now time.Time) {
+	for token, e := range v.entries {
+		if !now.Before(e.ExpiresAt) {
+			delete(v.entries, token)
+		}
+	}
+}
+
+func additionalData(token string, threeDSServerTransID string) []byte {
+	return []byte(token + "|" + threeDSServerTransID)
+}
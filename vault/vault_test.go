@@ -0,0 +1,173 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/unravelin/ravelin-3ds-demo/internal/keyderiv"
+)
+
+var (
+	testKey  = []byte("test-key-test-key-test-key-test-key")
+	otherKey = []byte("other-key-other-key-other-key-other")
+)
+
+func TestVault_Detokenise(t *testing.T) {
+	v, err := New(testKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	token, err := v.Tokenise("4000000000001000", "tx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                 string
+		token                string
+		threeDSServerTransID string
+		after                time.Duration
+		wantPAN              string
+		wantErr              error
+	}{
+		{
+			name:                 "valid",
+			token:                token,
+			threeDSServerTransID: "tx-1",
+			wantPAN:              "4000000000001000",
+		},
+		{
+			name:                 "other transaction",
+			token:                token,
+			threeDSServerTransID: "tx-2",
+			wantErr:              ErrTokenMismatch,
+		},
+		{
+			name:                 "unknown token",
+			token:                "ctok_unknown",
+			threeDSServerTransID: "tx-1",
+			wantErr:              ErrTokenNotFound,
+		},
+		{
+			name:                 "expired",
+			token:                token,
+			threeDSServerTransID: "tx-1",
+			after:                time.Minute,
+			wantErr:              ErrTokenExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v.now = func() time.Time { return now.Add(tt.after) }
+
+			pan, err := v.Detokenise(tt.token, tt.threeDSServerTransID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected: %v, actual: %v", tt.wantErr, err)
+			}
+			if pan != tt.wantPAN {
+				t.Errorf("expected: %q, actual: %q", tt.wantPAN, pan)
+			}
+		})
+	}
+}
+
+func TestVault_moveCiphertext(t *testing.T) {
+	v, err := New(nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token1, _ := v.Tokenise("4000000000001000", "tx-1")
+	token2, _ := v.Tokenise("4000000000001091", "tx-2")
+
+	// an encrypted card copied to another token must not decrypt
+	e := v.entries[token2]
+	e.Ciphertext = v.entries[token1].Ciphertext
+	v.entries[token2] = e
+
+	_, err = v.Detokenise(token2, "tx-2")
+	if err == nil {
+		t.Fatal("expected error decrypting card moved to another token")
+	}
+}
+
+func TestVault_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+	key := testKey
+
+	v, err := Open(path, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := v.Tokenise("4000000000001000", "tx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bb, []byte("4000000000001000")) {
+		t.Fatal("expected card number to be encrypted at rest")
+	}
+
+	reopened, err := Open(path, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pan, err := reopened.Detokenise(token, "tx-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pan != "4000000000001000" {
+		t.Errorf("expected: %q, actual: %q", "4000000000001000", pan)
+	}
+
+	reopenedOtherKey, err := Open(path, otherKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopenedOtherKey.Detokenise(token, "tx-1"); err == nil {
+		t.Error("expected error detokenising with another key")
+	}
+
+	// a random key could not detokenise the persisted PANs after a restart
+	if _, err := Open(path, nil, time.Minute); err == nil {
+		t.Error("expected error opening a persisted vault without a key")
+	}
+}
+
+func TestVault_Fingerprint(t *testing.T) {
+	v1, _ := New(testKey, time.Minute)
+	v2, _ := New(testKey, time.Minute)
+	other, _ := New(otherKey, time.Minute)
+
+	if v1.Fingerprint("4000000000001000") != v2.Fingerprint("4000000000001000") {
+		t.Error("expected fingerprints to be stable for the same key")
+	}
+	if v1.Fingerprint("4000000000001000") == v1.Fingerprint("4000000000001091") {
+		t.Error("expected different cards to have different fingerprints")
+	}
+	if v1.Fingerprint("4000000000001000") == other.Fingerprint("4000000000001000") {
+		t.Error("expected fingerprints to depend on the key")
+	}
+}
+
+func TestNew_shortKey(t *testing.T) {
+	// a passphrase is not random enough to derive the encryption key from
+	if _, err := New([]byte("passphrase"), time.Minute); !errors.Is(err, keyderiv.ErrKeyTooShort) {
+		t.Errorf("expected: %v, actual: %v", keyderiv.ErrKeyTooShort, err)
+	}
+}